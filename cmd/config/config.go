@@ -6,19 +6,30 @@ import (
 	"github.com/omzlo/clog"
 	"github.com/omzlo/goblynk"
 	"github.com/omzlo/nocand/models/helpers"
+	"io/ioutil"
 	"strconv"
 	"strings"
+	"time"
 )
 
 /****/
 
 type BlynkAssoc struct {
-	Pin     uint
-	Channel string
+	Pin       uint
+	Channel   string
+	Transform string
+	err       error
+	element   int
+	line      int
 }
 
+// Set parses an association written as <pin>::<channel>, optionally
+// followed by ::<transform>.
 func (ba *BlynkAssoc) Set(s string) error {
-	parts := strings.SplitN(s, "::", 2)
+	parts := strings.SplitN(s, "::", 3)
+	if len(parts) < 2 {
+		return fmt.Errorf("Blynk associations must be written as <pin>::<channel>[::<transform>], got '%s'", s)
+	}
 	pin, err := strconv.ParseUint(parts[0], 0, 32)
 	if err != nil {
 		return err
@@ -26,10 +37,20 @@ func (ba *BlynkAssoc) Set(s string) error {
 	channel := parts[1]
 	ba.Pin = uint(pin)
 	ba.Channel = channel
+	if len(parts) == 3 {
+		ba.Transform = parts[2]
+	}
 	return nil
 
 }
 
+func (ba *BlynkAssoc) String() string {
+	if ba.Transform != "" {
+		return fmt.Sprintf("%d::%s::%s", ba.Pin, ba.Channel, ba.Transform)
+	}
+	return fmt.Sprintf("%d::%s", ba.Pin, ba.Channel)
+}
+
 /*
 func (ba *BlynkAssoc) UnmarshalText(text []byte) error {
 	return ba.Set(string(text))
@@ -41,7 +62,7 @@ type BlynkMap []*BlynkAssoc
 func (bl *BlynkMap) Set(s string) error {
 	*bl = nil
 
-	v := strings.Split(s, ",")
+	v := superSplit(s)
 	for _, item := range v {
 		ba := new(BlynkAssoc)
 
@@ -57,7 +78,7 @@ func (bl BlynkMap) String() string {
 	var s []string
 
 	for _, item := range bl {
-		s = append(s, fmt.Sprintf("%d::%s", item.Pin, item.Channel))
+		s = append(s, item.String())
 	}
 	return strings.Join(s, ",")
 }
@@ -101,11 +122,23 @@ func superSplit(s string) []string {
 }
 
 type MqttAssoc struct {
-	Channel   string
-	Transform string
-	Topic     string
+	Channel   string `toml:"channel"`
+	Transform string `toml:"transform"`
+	Topic     string `toml:"topic"`
+	Qos       *byte  `toml:"qos"` // nil selects the default QoS level
+	Retain    bool   `toml:"retain"`
+	// Skip values equal to the last one forwarded to a topic or channel,
+	// and forward at most one value every MinInterval to a topic or channel.
+	ChangedOnly bool     `toml:"changed-only"`
+	MinInterval Duration `toml:"min-interval"`
+	err         error
+	element     int
+	line        int
 }
 
+// Set parses an association written as <channel>:<transform>:<topic>,
+// optionally followed by options separated by ';', as in
+// 'temp::nocan/temp;qos=1;retain;changed-only;min-interval=5s'.
 func (ma *MqttAssoc) Set(s string) error {
 	parts := strings.SplitN(s, ":", 3)
 	if len(parts) != 3 {
@@ -113,14 +146,76 @@ func (ma *MqttAssoc) Set(s string) error {
 	}
 	ma.Channel = parts[0]
 	ma.Transform = parts[1]
-	if len(parts[2]) == 0 {
+	options := strings.Split(parts[2], ";")
+	if len(options[0]) == 0 {
 		ma.Topic = parts[0]
 	} else {
-		ma.Topic = parts[2]
+		ma.Topic = options[0]
+	}
+	for _, option := range options[1:] {
+		if err := ma.setOption(strings.TrimSpace(option)); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+func (ma *MqttAssoc) setOption(option string) error {
+	var err error
+
+	key, value := option, ""
+	if i := strings.Index(option, "="); i >= 0 {
+		key, value = option[:i], option[i+1:]
+	}
+	switch key {
+	case "":
+		return nil
+	case "qos":
+		var qos uint64
+		if qos, err = strconv.ParseUint(value, 10, 8); err != nil || qos > 2 {
+			return fmt.Errorf("Mqtt association option 'qos' must be 0, 1 or 2, got '%s'", value)
+		}
+		ma.Qos = new(byte)
+		*ma.Qos = byte(qos)
+	case "retain":
+		if value == "" {
+			ma.Retain = true
+		} else if ma.Retain, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("Mqtt association option 'retain' must be a boolean, got '%s'", value)
+		}
+	case "changed-only":
+		if value == "" {
+			ma.ChangedOnly = true
+		} else if ma.ChangedOnly, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("Mqtt association option 'changed-only' must be a boolean, got '%s'", value)
+		}
+	case "min-interval":
+		if err = ma.MinInterval.Set(value); err != nil {
+			return fmt.Errorf("Mqtt association option 'min-interval' must be a duration such as '500ms' or '5s', got '%s'", value)
+		}
+	default:
+		return fmt.Errorf("Unknown mqtt association option '%s'", key)
+	}
+	return nil
+}
+
+func (ma *MqttAssoc) String() string {
+	s := fmt.Sprintf("%s:%s:%s", ma.Channel, ma.Transform, ma.Topic)
+	if ma.Qos != nil {
+		s += fmt.Sprintf(";qos=%d", *ma.Qos)
+	}
+	if ma.Retain {
+		s += ";retain"
+	}
+	if ma.ChangedOnly {
+		s += ";changed-only"
+	}
+	if ma.MinInterval > 0 {
+		s += ";min-interval=" + ma.MinInterval.String()
+	}
+	return s
+}
+
 type MqttMap []*MqttAssoc
 
 func (mm *MqttMap) Set(s string) error {
@@ -142,11 +237,141 @@ func (mm MqttMap) String() string {
 	var s []string
 
 	for _, item := range mm {
-		s = append(s, fmt.Sprintf("%s:%s:%s", item.Channel, item.Transform, item.Topic))
+		s = append(s, item.String())
 	}
 	return strings.Join(s, ",")
 }
 
+// Duration is a time.Duration written as in "1m30s".
+type Duration time.Duration
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if v < 0 {
+		return fmt.Errorf("Duration must not be negative, got '%s'", s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	return d.Set(string(text))
+}
+
+type StringList []string
+
+func (sl *StringList) Set(s string) error {
+	*sl = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*sl = append(*sl, item)
+		}
+	}
+	return nil
+}
+
+func (sl StringList) String() string {
+	return strings.Join(sl, ",")
+}
+
+/***/
+
+type OutputFormat string
+
+const (
+	OutputText   OutputFormat = "text"
+	OutputJson   OutputFormat = "json"
+	OutputNdjson OutputFormat = "ndjson"
+	OutputCsv    OutputFormat = "csv"
+)
+
+func (of *OutputFormat) Set(s string) error {
+	switch OutputFormat(s) {
+	case OutputText, OutputJson, OutputNdjson, OutputCsv:
+		*of = OutputFormat(s)
+		return nil
+	}
+	return fmt.Errorf("Output format must be either 'text', 'json', 'ndjson' or 'csv', got '%s'", s)
+}
+
+func (of OutputFormat) String() string {
+	return string(of)
+}
+
+func (of *OutputFormat) UnmarshalText(text []byte) error {
+	return of.Set(string(text))
+}
+
+/***/
+
+type WebuiRole string
+
+const (
+	WebuiRoleNone     WebuiRole = "none"
+	WebuiRoleReadOnly WebuiRole = "read-only"
+	WebuiRoleOperator WebuiRole = "operator"
+)
+
+func (wr *WebuiRole) Set(s string) error {
+	switch WebuiRole(s) {
+	case WebuiRoleNone, WebuiRoleReadOnly, WebuiRoleOperator:
+		*wr = WebuiRole(s)
+		return nil
+	}
+	return fmt.Errorf("Webui role must be either 'none', 'read-only' or 'operator', got '%s'", s)
+}
+
+func (wr WebuiRole) String() string {
+	return string(wr)
+}
+
+func (wr *WebuiRole) UnmarshalText(text []byte) error {
+	return wr.Set(string(text))
+}
+
+/***/
+
+type TargetCheck string
+
+const (
+	TargetCheckError TargetCheck = "error"
+	TargetCheckWarn  TargetCheck = "warn"
+	TargetCheckOff   TargetCheck = "off"
+)
+
+func (tc *TargetCheck) Set(s string) error {
+	switch TargetCheck(s) {
+	case TargetCheckError, TargetCheckWarn, TargetCheckOff:
+		*tc = TargetCheck(s)
+		return nil
+	}
+	return fmt.Errorf("Target check must be either 'error', 'warn' or 'off', got '%s'", s)
+}
+
+func (tc TargetCheck) String() string {
+	return string(tc)
+}
+
+func (tc *TargetCheck) UnmarshalText(text []byte) error {
+	return tc.Set(string(text))
+}
+
+// WebuiUser describes a user of the web interface, who authenticates either
+// with HTTP basic authentication (Name and Password) or with a bearer Token.
+type WebuiUser struct {
+	Name     string    `toml:"name"`
+	Password string    `toml:"password"`
+	Token    string    `toml:"token"`
+	Role     WebuiRole `toml:"role"`
+}
+
 /***/
 
 type BlynkConfiguration struct {
@@ -157,6 +382,26 @@ type BlynkConfiguration struct {
 	Notifiers   BlynkList `toml:"notifiers"`
 }
 
+// HomeAssistantEntity describes how the NoCAN channels matching Channel
+// (which may contain MQTT wildcards) are declared to Home Assistant.
+type HomeAssistantEntity struct {
+	Channel       string `toml:"channel"`
+	Component     string `toml:"component"`
+	Name          string `toml:"name"`
+	Unit          string `toml:"unit"`
+	DeviceClass   string `toml:"device-class"`
+	ValueTemplate string `toml:"value-template"`
+	Node          uint   `toml:"node"`
+}
+
+// SparkplugDevice assigns the NoCAN channels matching Channels (which may
+// contain MQTT wildcards) to the Sparkplug device of a NoCAN node.
+type SparkplugDevice struct {
+	Node     uint       `toml:"node"`
+	Name     string     `toml:"name"`
+	Channels StringList `toml:"channels"`
+}
+
 type MqttConfiguration struct {
 	ClientId       string  `toml:"client-id"`
 	MqttServer     string  `toml:"mqtt-server"`
@@ -165,55 +410,152 @@ type MqttConfiguration struct {
 	CAFile         string  `toml:"ca-file"`
 	ClientKeyFile  string  `toml:"client-key-file"`
 	ClientCertFile string  `toml:"client-cert-file"`
+	MetricsServer  string  `toml:"metrics-server"`
+	// Publish the last known value of channels when connecting.
+	PublishOnStartup bool `toml:"publish-on-startup"`
+	// Offline queues, holding messages while nocand or the MQTT server is
+	// unreachable. A queue size of 0 disables them.
+	QueueSize      uint   `toml:"queue-size"`
+	QueueMaxAge    uint   `toml:"queue-max-age"`
+	QueueDirectory string `toml:"queue-dir"`
+	// Retained availability ("online", or "offline" once the bridge stops)
+	// and network status topics, disabled when empty.
+	AvailabilityTopic string `toml:"availability-topic"`
+	StatusPrefix      string `toml:"status-prefix"`
+	// Remote management requests, disabled when empty.
+	CommandPrefix string `toml:"command-prefix"`
+	// Home Assistant MQTT discovery
+	HomeAssistant          bool                   `toml:"home-assistant"`
+	DiscoveryPrefix        string                 `toml:"discovery-prefix"`
+	NodeAvailabilityPrefix string                 `toml:"node-availability-prefix"`
+	Entities               []*HomeAssistantEntity `toml:"entities"`
+	// Sparkplug B edge node
+	Sparkplug         bool               `toml:"sparkplug"`
+	SparkplugGroup    string             `toml:"sparkplug-group"`
+	SparkplugEdgeNode string             `toml:"sparkplug-edge-node"`
+	SparkplugDevices  []*SparkplugDevice `toml:"sparkplug-devices"`
 }
 
 type WebuiConfiguration struct {
-	WebServer string `toml:"web-server"`
-	Refresh   uint   `toml:"refresh"`
+	WebServer   string `toml:"web-server"`
+	Refresh     uint   `toml:"refresh"`
+	TLSCertFile string `toml:"tls-cert-file"`
+	TLSKeyFile  string `toml:"tls-key-file"`
+	// AnonymousRole is the role of requests without credentials. It defaults
+	// to 'operator' if no users are defined and to 'none' otherwise.
+	AnonymousRole WebuiRole    `toml:"anonymous-role"`
+	Users         []*WebuiUser `toml:"users"`
+}
+
+type HistoryConfiguration struct {
+	Directory     string `toml:"directory"`
+	RetentionDays uint   `toml:"retention-days"`
+	MaxSizeMB     uint   `toml:"max-size-mb"`
+}
+
+type MetricsConfiguration struct {
+	MetricsServer   string     `toml:"metrics-server"`
+	NumericChannels StringList `toml:"numeric-channels"`
+}
+
+// TargetProfile describes the flash memory of a kind of node, as checked
+// before uploading firmware. Protected lists address ranges that firmware
+// must not overwrite, written as <start>-<end> with end excluded (e.g.
+// '0x0-0x2000'). AppOrigin defaults to FlashBase.
+type TargetProfile struct {
+	Name      string     `toml:"name"`
+	FlashBase uint       `toml:"flash-base"`
+	FlashSize uint       `toml:"flash-size"`
+	PageSize  uint       `toml:"page-size"`
+	AppOrigin uint       `toml:"app-origin"`
+	Protected StringList `toml:"protected"`
 }
 
 type Configuration struct {
-	EventServer       string `toml:"event-server"`
-	AuthToken         string `toml:"auth-token"`
-	DownloadSizeLimit uint   `toml:"download-size-limit"`
+	EventServer       string   `toml:"event-server"`
+	AuthToken         string   `toml:"auth-token"`
+	DownloadSizeLimit uint     `toml:"download-size-limit"`
+	UploadRetries     uint     `toml:"upload-retries"`
+	UploadBackoff     Duration `toml:"upload-backoff"`
+	UploadResume      bool     `toml:"upload-resume"`
 	Blynk             BlynkConfiguration
 	Mqtt              MqttConfiguration
 	Webui             WebuiConfiguration
+	History           HistoryConfiguration
+	Metrics           MetricsConfiguration
 	CheckForUpdates   bool              `toml:"check-for-updates"`
 	UpdateUrl         string            `toml:"update-url"`
 	LogTerminal       string            `toml:"log-terminal"`
 	LogLevel          clog.LogLevel     `toml:"log-level"`
 	LogFile           *helpers.FilePath `toml:"log-file"`
+	// FirmwareLedger records the firmware uploaded to each node, disabled when empty.
+	FirmwareLedger    *helpers.FilePath `toml:"firmware-ledger"`
+	Target            string            `toml:"target"`
+	TargetCheck       TargetCheck       `toml:"target-check"`
+	Targets           []*TargetProfile  `toml:"targets"`
 	OnUpdate          bool              `toml:"on-update"`
 	SimpleProgressBar bool              `toml:"simple-progress-bar"`
+	Output            OutputFormat      `toml:"output"`
 }
 
 var DefaultSettings = Configuration{
 	EventServer:       ":4242",
 	AuthToken:         "missing-password",
 	DownloadSizeLimit: (1 << 32) - 1,
+	UploadRetries:     0,
+	UploadBackoff:     Duration(2 * time.Second),
+	UploadResume:      false,
 	Blynk: BlynkConfiguration{
 		BlynkServer: blynk.BLYNK_ADDRESS,
 		BlynkToken:  "missing-token",
 	},
 	Mqtt: MqttConfiguration{
-		ClientId:       "",
-		MqttServer:     "mqtt://localhost",
-		CAFile:         "",
-		ClientKeyFile:  "",
-		ClientCertFile: "",
+		ClientId:               "",
+		MqttServer:             "mqtt://localhost",
+		CAFile:                 "",
+		ClientKeyFile:          "",
+		ClientCertFile:         "",
+		MetricsServer:          "",
+		PublishOnStartup:       false,
+		QueueSize:              0,
+		QueueMaxAge:            300,
+		QueueDirectory:         "",
+		AvailabilityTopic:      "",
+		StatusPrefix:           "",
+		CommandPrefix:          "",
+		HomeAssistant:          false,
+		DiscoveryPrefix:        "homeassistant",
+		NodeAvailabilityPrefix: "nocan/nodes",
+		SparkplugGroup:         "nocan",
+		SparkplugEdgeNode:      "nocand",
 	},
 	Webui: WebuiConfiguration{
-		WebServer: "localhost:8080",
-		Refresh:   5000,
+		WebServer:     "localhost:8080",
+		Refresh:       5000,
+		TLSCertFile:   "",
+		TLSKeyFile:    "",
+		AnonymousRole: "",
+	},
+	History: HistoryConfiguration{
+		Directory:     "",
+		RetentionDays: 30,
+		MaxSizeMB:     100,
+	},
+	Metrics: MetricsConfiguration{
+		MetricsServer:   "localhost:9342",
+		NumericChannels: nil,
 	},
 	CheckForUpdates:   true,
 	UpdateUrl:         "https://www.omzlo.com/software_update",
 	LogLevel:          clog.INFO,
 	LogTerminal:       "plain",
 	LogFile:           helpers.NewFilePath(),
+	FirmwareLedger:    helpers.HomeDir().Append(".nocanc-firmware.json"),
+	Target:            "canzero",
+	TargetCheck:       TargetCheckError,
 	OnUpdate:          false,
 	SimpleProgressBar: false,
+	Output:            OutputText,
 }
 
 var Settings = DefaultSettings
@@ -226,9 +568,14 @@ func loadFile(file_path *helpers.FilePath) (bool, error) {
 		return false, nil
 	}
 
-	if _, err := toml.DecodeFile(file_path.String(), &Settings); err != nil {
+	text, err := ioutil.ReadFile(file_path.String())
+	if err != nil {
+		return true, err
+	}
+	if _, err := toml.Decode(string(text), &Settings); err != nil {
 		return true, err
 	}
+	locate_mappings(string(text))
 
 	return true, nil
 }
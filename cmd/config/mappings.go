@@ -0,0 +1,444 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Besides the packed string syntax used by flags, mqtt and blynk mappings
+// can be written in the configuration file as arrays of tables:
+//
+//	[[mqtt.publishers]]
+//	channel = "sensors/+"
+//	topic = "nocan/{{.ChannelName}}"
+//	transform = "{{ .Value | f32 | round 1 }}"
+//	qos = 1
+//	retain = true
+//
+//	[[blynk.readers]]
+//	pin = 3
+//	channel = "temperature"
+//
+// Errors found while decoding a table are kept in the association and
+// reported by Err(), so that all invalid mappings can be listed at once
+// along with their line in the configuration file.
+
+// Err returns the error found while decoding the association from the
+// configuration file, if any.
+func (ma *MqttAssoc) Err() error {
+	return ma.err
+}
+
+func (ba *BlynkAssoc) Err() error {
+	return ba.err
+}
+
+// Line returns the line of the association in the configuration file, or 0
+// if it was not loaded from a file.
+func (ma *MqttAssoc) Line() int {
+	return ma.line
+}
+
+func (ba *BlynkAssoc) Line() int {
+	return ba.line
+}
+
+type toml_table struct {
+	values map[string]interface{}
+	err    error
+}
+
+// fail records err, keeping only the first error found in the table.
+func (t *toml_table) fail(err error) {
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+func (t *toml_table) string(key string, dest *string) {
+	if v, ok := t.values[key]; ok {
+		if s, ok := v.(string); ok {
+			*dest = s
+		} else {
+			t.fail(fmt.Errorf("'%s' must be a string", key))
+		}
+	}
+}
+
+func (t *toml_table) bool(key string, dest *bool) {
+	if v, ok := t.values[key]; ok {
+		if b, ok := v.(bool); ok {
+			*dest = b
+		} else {
+			t.fail(fmt.Errorf("'%s' must be a boolean", key))
+		}
+	}
+}
+
+func (t *toml_table) uint(key string, max int64) (uint, bool) {
+	v, ok := t.values[key]
+	if !ok {
+		return 0, false
+	}
+	i, ok := v.(int64)
+	if !ok || i < 0 || i > max {
+		t.fail(fmt.Errorf("'%s' must be an integer between 0 and %d", key, max))
+		return 0, false
+	}
+	return uint(i), true
+}
+
+func (t *toml_table) check_keys(keys ...string) {
+	for key := range t.values {
+		known := false
+		for _, k := range keys {
+			if key == k {
+				known = true
+			}
+		}
+		if !known {
+			t.fail(fmt.Errorf("unknown field '%s'", key))
+		}
+	}
+}
+
+func decode_mqtt_assoc(values map[string]interface{}) *MqttAssoc {
+	ma := new(MqttAssoc)
+	t := &toml_table{values: values}
+
+	t.check_keys("channel", "topic", "transform", "qos", "retain", "changed-only", "min-interval")
+	t.string("channel", &ma.Channel)
+	t.string("topic", &ma.Topic)
+	t.string("transform", &ma.Transform)
+	if qos, ok := t.uint("qos", 2); ok {
+		ma.Qos = new(byte)
+		*ma.Qos = byte(qos)
+	}
+	t.bool("retain", &ma.Retain)
+	t.bool("changed-only", &ma.ChangedOnly)
+	var interval string
+	t.string("min-interval", &interval)
+	if interval != "" {
+		if err := ma.MinInterval.Set(interval); err != nil {
+			t.fail(fmt.Errorf("'min-interval' must be a duration such as '500ms' or '5s'"))
+		}
+	}
+	if ma.Topic == "" {
+		ma.Topic = ma.Channel
+	}
+	ma.err = t.err
+	return ma
+}
+
+func decode_blynk_assoc(values map[string]interface{}) *BlynkAssoc {
+	ba := new(BlynkAssoc)
+	t := &toml_table{values: values}
+
+	t.check_keys("pin", "channel", "transform")
+	if pin, ok := t.uint("pin", 255); ok {
+		ba.Pin = pin
+	} else if _, ok := values["pin"]; !ok {
+		t.fail(fmt.Errorf("missing field 'pin'"))
+	}
+	t.string("channel", &ba.Channel)
+	t.string("transform", &ba.Transform)
+	ba.err = t.err
+	return ba
+}
+
+type toml_item struct {
+	value   interface{}
+	element int // index of the TOML value holding the item
+}
+
+// toml_items returns the items of a mapping, which can be a packed string,
+// an array of packed strings or an array of tables.
+func toml_items(data interface{}) ([]toml_item, error) {
+	var items []toml_item
+
+	switch v := data.(type) {
+	case string:
+		for _, s := range superSplit(v) {
+			items = append(items, toml_item{s, 0})
+		}
+		return items, nil
+	case []interface{}:
+		for i := range v {
+			items = append(items, toml_item{v[i], i})
+		}
+		return items, nil
+	case []map[string]interface{}:
+		for i := range v {
+			items = append(items, toml_item{v[i], i})
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("mappings must be a string, an array of strings or an array of tables")
+}
+
+func (mm *MqttMap) UnmarshalTOML(data interface{}) error {
+	*mm = nil
+
+	items, err := toml_items(data)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		var ma *MqttAssoc
+
+		switch v := item.value.(type) {
+		case string:
+			ma = new(MqttAssoc)
+			ma.err = ma.Set(v)
+		case map[string]interface{}:
+			ma = decode_mqtt_assoc(v)
+		default:
+			ma = &MqttAssoc{err: fmt.Errorf("mappings must be strings or tables")}
+		}
+		ma.element = item.element
+		*mm = append(*mm, ma)
+	}
+	return nil
+}
+
+func (bl *BlynkMap) UnmarshalTOML(data interface{}) error {
+	*bl = nil
+
+	items, err := toml_items(data)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		var ba *BlynkAssoc
+
+		switch v := item.value.(type) {
+		case string:
+			ba = new(BlynkAssoc)
+			ba.err = ba.Set(v)
+		case map[string]interface{}:
+			ba = decode_blynk_assoc(v)
+		default:
+			ba = &BlynkAssoc{err: fmt.Errorf("mappings must be strings or tables")}
+		}
+		ba.element = item.element
+		*bl = append(*bl, ba)
+	}
+	return nil
+}
+
+// toml_scanner finds the line of each value of a TOML document, skipping
+// strings and comments. It only understands as much TOML as needed to locate
+// mappings in a configuration file that was already decoded successfully.
+type toml_scanner struct {
+	text  string
+	pos   int
+	line  int
+	lines map[string][]int
+}
+
+// mapping_lines returns the lines of the values of text, indexed by their
+// full key in lower case (e.g. "mqtt.publishers"). Arrays of tables get the
+// line of each table header, arrays get the line of each of their elements,
+// and other values get the line where they start.
+func mapping_lines(text string) map[string][]int {
+	s := &toml_scanner{text: text, line: 1, lines: make(map[string][]int)}
+	table := ""
+
+	for {
+		s.skip_space(true)
+		if s.pos >= len(s.text) {
+			return s.lines
+		}
+		switch {
+		case strings.HasPrefix(s.text[s.pos:], "[["):
+			s.pos += 2
+			table = s.key("]]")
+			s.lines[table] = append(s.lines[table], s.line)
+		case s.text[s.pos] == '[':
+			s.pos++
+			table = s.key("]")
+		default:
+			key := s.key("=")
+			if table != "" {
+				key = table + "." + key
+			}
+			s.skip_space(false)
+			s.value(key)
+		}
+		// Skip comments, as well as the end of date-times containing a space.
+		for s.pos < len(s.text) && s.text[s.pos] != '\n' {
+			s.pos++
+		}
+	}
+}
+
+// advance moves n bytes forward, counting lines.
+func (s *toml_scanner) advance(n int) {
+	for ; n > 0 && s.pos < len(s.text); n-- {
+		if s.text[s.pos] == '\n' {
+			s.line++
+		}
+		s.pos++
+	}
+}
+
+// skip_space skips blanks and comments, and newlines if newlines is set.
+func (s *toml_scanner) skip_space(newlines bool) {
+	for s.pos < len(s.text) {
+		switch s.text[s.pos] {
+		case ' ', '\t', '\r':
+			s.pos++
+		case '\n':
+			if !newlines {
+				return
+			}
+			s.advance(1)
+		case '#':
+			for s.pos < len(s.text) && s.text[s.pos] != '\n' {
+				s.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// key reads a possibly dotted or quoted key up to end, which is consumed.
+func (s *toml_scanner) key(end string) string {
+	var key strings.Builder
+
+	for s.pos < len(s.text) && !strings.HasPrefix(s.text[s.pos:], end) {
+		switch c := s.text[s.pos]; c {
+		case '"', '\'':
+			start := s.pos
+			s.skip_string()
+			key.WriteString(strings.Trim(s.text[start:s.pos], string(c)))
+		case '\n':
+			return strings.ToLower(key.String())
+		case ' ', '\t':
+			s.pos++
+		default:
+			key.WriteByte(c)
+			s.pos++
+		}
+	}
+	s.advance(len(end))
+	return strings.ToLower(key.String())
+}
+
+// value records the line of the value of key, or the line of each of its
+// elements if it is an array.
+func (s *toml_scanner) value(key string) {
+	if s.pos >= len(s.text) || s.text[s.pos] != '[' {
+		s.lines[key] = append(s.lines[key], s.line)
+		s.skip_value()
+		return
+	}
+	s.pos++
+	for {
+		s.skip_space(true)
+		if s.pos >= len(s.text) {
+			return
+		}
+		switch s.text[s.pos] {
+		case ']':
+			s.pos++
+			return
+		case ',':
+			s.pos++
+		default:
+			s.lines[key] = append(s.lines[key], s.line)
+			s.skip_value()
+		}
+	}
+}
+
+// skip_value skips a string, an array, an inline table or a scalar. It
+// always moves forward unless the end of the text is reached.
+func (s *toml_scanner) skip_value() {
+	if s.pos >= len(s.text) {
+		return
+	}
+	switch c := s.text[s.pos]; c {
+	case '"', '\'':
+		s.skip_string()
+	case '[', '{':
+		end := byte(']')
+		if c == '{' {
+			end = '}'
+		}
+		s.pos++
+		for {
+			s.skip_space(true)
+			if s.pos >= len(s.text) {
+				return
+			}
+			switch s.text[s.pos] {
+			case end:
+				s.pos++
+				return
+			case ',', '=':
+				s.pos++
+			default:
+				s.skip_value()
+			}
+		}
+	default:
+		start := s.pos
+		for s.pos < len(s.text) && !strings.ContainsRune(",=]} \t\r\n#", rune(s.text[s.pos])) {
+			s.pos++
+		}
+		if s.pos == start {
+			s.advance(1)
+		}
+	}
+}
+
+// skip_string skips a basic or literal string, which may span several lines.
+func (s *toml_scanner) skip_string() {
+	quote := s.text[s.pos : s.pos+1]
+	if strings.HasPrefix(s.text[s.pos:], strings.Repeat(quote, 3)) {
+		quote = strings.Repeat(quote, 3)
+	}
+	s.pos += len(quote)
+	for s.pos < len(s.text) {
+		if s.text[s.pos] == '\\' && quote[0] == '"' {
+			s.advance(2)
+			continue
+		}
+		if strings.HasPrefix(s.text[s.pos:], quote) {
+			s.pos += len(quote)
+			// Multi-line strings may end with one or two quotes of their own.
+			for n := 0; n < 2 && len(quote) == 3 && s.pos < len(s.text) && s.text[s.pos] == quote[0]; n++ {
+				s.pos++
+			}
+			return
+		}
+		s.advance(1)
+	}
+}
+
+// locate_mappings sets the line of the mappings of Settings found in the
+// configuration file text.
+func locate_mappings(text string) {
+	lines := mapping_lines(text)
+
+	line_of := func(key string, element int) int {
+		if l := lines[key]; element < len(l) {
+			return l[element]
+		}
+		return 0
+	}
+	for _, ma := range Settings.Mqtt.Publishers {
+		ma.line = line_of("mqtt.publishers", ma.element)
+	}
+	for _, ma := range Settings.Mqtt.Subscribers {
+		ma.line = line_of("mqtt.subscribers", ma.element)
+	}
+	for _, ba := range Settings.Blynk.Readers {
+		ba.line = line_of("blynk.readers", ba.element)
+	}
+	for _, ba := range Settings.Blynk.Writers {
+		ba.line = line_of("blynk.writers", ba.element)
+	}
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const test_config = `# nocanc configuration
+event-server = ":4242" # [[mqtt.publishers]]
+date = 1979-05-27T07:32:00Z # [mqtt]
+description = """
+[[mqtt.publishers]]
+channel = "not a mapping"
+"""
+
+[blynk]
+readers = "1::a,2::b"
+writers = [
+  { pin = 3, channel = 'c' }, # "4::d",
+  { pin = 5, channel = "e\"]" },
+  { pin = 6, channel = "f" }, { pin = 7, channel = "g" } ]
+
+[mqtt]
+mqtt-server = 'mqtt://localhost'
+subscribers = []
+
+[[mqtt.publishers]]
+channel = "a"
+transform = "{{ .Value | printf \"%s]\" }}"
+
+[[ mqtt.publishers ]]
+channel = "b"
+qos = 3
+`
+
+func TestMappingLines(t *testing.T) {
+	lines := mapping_lines(test_config)
+
+	expected := map[string][]int{
+		"event-server":              {2},
+		"date":                      {3},
+		"description":               {4},
+		"blynk.readers":             {10},
+		"blynk.writers":             {12, 13, 14, 14},
+		"mqtt.mqtt-server":          {17},
+		"mqtt.publishers":           {20, 24},
+		"mqtt.publishers.channel":   {21, 25},
+		"mqtt.publishers.transform": {22},
+		"mqtt.publishers.qos":       {26},
+	}
+	for key, l := range expected {
+		if !reflect.DeepEqual(lines[key], l) {
+			t.Errorf("Lines of %s are %v, expected %v", key, lines[key], l)
+		}
+	}
+	if l, ok := lines["mqtt.subscribers"]; ok {
+		t.Errorf("Lines of the empty array mqtt.subscribers are %v, expected none", l)
+	}
+}
+
+func TestLoadMappingLines(t *testing.T) {
+	saved := Settings
+	defer func() { Settings = saved }()
+
+	path := filepath.Join(t.TempDir(), "nocanc.conf")
+	if err := ioutil.WriteFile(path, []byte(test_config), 0644); err != nil {
+		t.Fatalf("Failed to write configuration: %s", err)
+	}
+	Settings = DefaultSettings
+	if _, err := LoadFile(path); err != nil {
+		t.Fatalf("LoadFile failed: %s", err)
+	}
+
+	check := func(what string, got []int, expected ...int) {
+		t.Helper()
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Lines of %s are %v, expected %v", what, got, expected)
+		}
+	}
+	var lines []int
+	for _, ba := range Settings.Blynk.Readers {
+		lines = append(lines, ba.Line())
+	}
+	check("blynk readers", lines, 10, 10)
+	lines = nil
+	for _, ba := range Settings.Blynk.Writers {
+		lines = append(lines, ba.Line())
+	}
+	check("blynk writers", lines, 12, 13, 14, 14)
+	lines = nil
+	for _, ma := range Settings.Mqtt.Publishers {
+		lines = append(lines, ma.Line())
+	}
+	check("mqtt publishers", lines, 20, 24)
+
+	if err := Settings.Mqtt.Publishers[1].Err(); err == nil {
+		t.Errorf("Publisher with qos = 3 was decoded without error")
+	}
+}
@@ -0,0 +1,43 @@
+package helper
+
+import (
+	"fmt"
+	"github.com/omzlo/nocanc/cmd/config"
+	"text/template"
+)
+
+// BlynkData is passed to the transform templates of blynk readers and writers.
+type BlynkData struct {
+	Pin         uint
+	ChannelName string
+	Value       Payload
+}
+
+// BlynkRule associates a blynk virtual pin with a NoCAN channel, with an
+// optional transform applied to values.
+type BlynkRule struct {
+	Pin       uint
+	Channel   string
+	Transform *template.Template
+}
+
+func NewBlynkRule(assoc *config.BlynkAssoc) (*BlynkRule, error) {
+	var err error
+
+	rule := &BlynkRule{Pin: assoc.Pin, Channel: assoc.Channel}
+	if assoc.Transform != "" {
+		if rule.Transform, err = NewTemplate(assoc.Channel, assoc.Transform); err != nil {
+			return nil, fmt.Errorf("Invalid blynk transformation for pin %d and channel '%s', %s", assoc.Pin, assoc.Channel, err)
+		}
+	}
+	return rule, nil
+}
+
+// Apply returns value transformed by the rule, or value itself if the rule
+// has no transform.
+func (rule *BlynkRule) Apply(value []byte) ([]byte, error) {
+	if rule.Transform == nil {
+		return value, nil
+	}
+	return ExecuteTemplate(rule.Transform, &BlynkData{Pin: rule.Pin, ChannelName: rule.Channel, Value: value})
+}
@@ -0,0 +1,471 @@
+package helper
+
+import (
+	"fmt"
+	"github.com/omzlo/clog"
+	"github.com/omzlo/gomqtt-mini-client"
+	"github.com/omzlo/nocanc/cmd/config"
+	"github.com/omzlo/nocanc/metrics"
+	"github.com/omzlo/nocand/socket"
+	"time"
+)
+
+// MqttBridge forwards values between NoCAN channels and MQTT topics, as
+// described by the MQTT section of the configuration. It also takes care of
+// the features built on top of the bridge: offline queues, remote
+// management, Sparkplug B, Home Assistant discovery and status publication.
+type MqttBridge struct {
+	mqtt        *MqttConn
+	dispatcher  *EventDispatcher
+	subscribers []*MqttSubscriberRule
+	publishers  []*MqttPublisherRule
+	// echoes tracks the values forwarded in each direction, so that a value
+	// coming back to us is not forwarded again. Values are recorded when they
+	// are sent, not when they are queued, since the echo only comes back
+	// after that.
+	echoes *EchoFilter
+	// Messages are queued while the destination connection is down, and
+	// replayed in order once it is restored.
+	inbound, outbound *OfflineQueue
+	commands          *MqttCommands
+	spark             *SparkplugEdge
+	discovery         *HomeAssistantDiscovery
+	status            *MqttStatus
+	channel_values    *ChannelValues
+	availability      string
+	// lost_connection is only accessed by received, which the MQTT reader
+	// calls from a single goroutine.
+	lost_connection bool
+}
+
+// NewMqttBridge creates a bridge between the NoCAN network of dispatcher and
+// the MQTT server of mqtt, registering the callbacks it needs on both.
+func NewMqttBridge(mqtt *MqttConn, dispatcher *EventDispatcher) (*MqttBridge, error) {
+	var err error
+
+	conf := &config.Settings.Mqtt
+	b := &MqttBridge{mqtt: mqtt, dispatcher: dispatcher, echoes: NewEchoFilter(ECHO_WINDOW)}
+
+	// We parse the mappings between MQTT topics and NoCAN channels
+	for _, subs := range conf.Subscribers {
+		rule, err := NewMqttSubscriberRule(subs)
+		if err != nil {
+			return nil, err
+		}
+		b.subscribers = append(b.subscribers, rule)
+		clog.Debug("Mapping MQTT topic '%s' to NoCAN channel '%s' for subscription", subs.Topic, subs.Channel)
+	}
+	for _, pubs := range conf.Publishers {
+		rule, err := NewMqttPublisherRule(pubs)
+		if err != nil {
+			return nil, err
+		}
+		b.publishers = append(b.publishers, rule)
+		clog.Debug("Mapping NoCAN channel '%s' to MQTT topic '%s' for publication", pubs.Channel, pubs.Topic)
+	}
+
+	if conf.QueueSize > 0 {
+		size := int(conf.QueueSize)
+		max_age := time.Duration(conf.QueueMaxAge) * time.Second
+		if b.inbound, err = NewOfflineQueue("mqtt inbound", size, max_age, QueueFile(conf.QueueDirectory, "mqtt-inbound")); err != nil {
+			return nil, err
+		}
+		if b.outbound, err = NewOfflineQueue("mqtt outbound", size, max_age, QueueFile(conf.QueueDirectory, "mqtt-outbound")); err != nil {
+			return nil, err
+		}
+		dispatcher.OnConnect(func(conn *socket.EventConn) error {
+			b.inbound.Replay(b.replay_inbound)
+			return nil
+		})
+		clog.Info("Queueing up to %d messages for up to %s in each direction during outages", size, max_age)
+	}
+
+	if conf.CommandPrefix != "" {
+		b.commands = NewMqttCommands(conf.CommandPrefix, NewClient())
+		clog.Info("Accepting remote management requests on MQTT topic '%s'", b.commands.Filter())
+	}
+
+	if conf.Sparkplug {
+		if conf.AvailabilityTopic != "" {
+			return nil, fmt.Errorf("The MQTT availability topic cannot be used in Sparkplug mode, which publishes its own death certificate")
+		}
+		if b.spark, err = NewSparkplugEdge(conf, config.Settings.Metrics.NumericChannels); err != nil {
+			return nil, err
+		}
+		// As with discovery, births catch up on everything that happened
+		// while the MQTT connection was down.
+		b.publish_events(b.spark.HandleEvent, socket.ChannelListEventId, socket.ChannelUpdateEventId, socket.NodeListEventId, socket.NodeUpdateEventId)
+		clog.Info("Acting as Sparkplug B edge node '%s' in group '%s'", b.spark.EdgeNode, b.spark.Group)
+	}
+
+	if len(b.subscribers) > 0 || b.commands != nil || b.spark != nil {
+		mqtt.SubscribeCallback = b.received
+	}
+
+	if len(b.publishers) > 0 {
+		dispatcher.OnEvent(socket.ChannelUpdateEventId, b.channel_updated)
+	}
+
+	// With publish-on-startup, we keep track of the last known value of each
+	// channel, and publish all of them as soon as the MQTT connection is
+	// established, so that late-joining subscribers see the current state.
+	if conf.PublishOnStartup && len(b.publishers) > 0 {
+		b.channel_values = NewChannelValues()
+		dispatcher.OnEvent(socket.ChannelUpdateEventId, func(conn *socket.EventConn, e socket.Eventer) error {
+			b.channel_values.HandleEvent(e)
+			return nil
+		})
+		// The channel list is received each time we connect to nocand.
+		dispatcher.OnEvent(socket.ChannelListEventId, b.channels_listed)
+	}
+
+	if conf.HomeAssistant {
+		if b.discovery, err = NewHomeAssistantDiscovery(conf, b.publishers, b.subscribers); err != nil {
+			return nil, err
+		}
+		// Discovery messages are derived from channel and node events, and
+		// only published while the MQTT connection is up: Announce() catches
+		// up on everything once the connection is (re)established.
+		b.publish_events(b.discovery.HandleEvent, socket.ChannelListEventId, socket.ChannelUpdateEventId, socket.NodeListEventId, socket.NodeUpdateEventId)
+		clog.Info("Home Assistant discovery enabled with prefix '%s'", b.discovery.Prefix)
+	}
+
+	if conf.AvailabilityTopic != "" {
+		b.availability = conf.AvailabilityTopic
+		clog.Info("Publishing MQTT bridge availability on topic '%s'", b.availability)
+	}
+
+	if conf.StatusPrefix != "" {
+		b.status = NewMqttStatus(conf.StatusPrefix, config.Settings.EventServer)
+		b.publish_events(b.status.HandleEvent, socket.BusPowerStatusUpdateEventId, socket.NodeListEventId, socket.NodeUpdateEventId)
+		b.status.Connection(false)
+		dispatcher.OnConnect(func(conn *socket.EventConn) error {
+			b.publish_connection(true)
+			return nil
+		})
+		dispatcher.OnDisconnect(func(err error) {
+			b.publish_connection(false)
+		})
+		clog.Info("Publishing NoCAN network status under MQTT topic prefix '%s'", b.status.Prefix)
+	}
+
+	mqtt.OnConnect = b.connected
+	return b, nil
+}
+
+// Run connects to nocand and to the MQTT server, and forwards values until
+// Stop is called.
+func (b *MqttBridge) Run() error {
+	if err := b.dispatcher.Connect(); err != nil {
+		return err
+	}
+	if err := b.mqtt.Connect(); err != nil {
+		return err
+	}
+	go b.mqtt.Supervise()
+	return b.dispatcher.Wait()
+}
+
+// Stop publishes the will of the bridge and closes both connections, which
+// makes Run return. The MQTT client cannot register a last will, so this is
+// the only time it is published.
+func (b *MqttBridge) Stop() {
+	var will *MqttPublication
+
+	if b.spark != nil {
+		// The death certificate changes with each birth.
+		will = b.spark.Will()
+	} else if b.availability != "" {
+		will = MqttAvailability(b.availability, false)
+	}
+	b.mqtt.Close(will)
+	b.dispatcher.Conn().Terminate()
+}
+
+// connected subscribes to the relevant topics and catches up on everything
+// that must be published each time the MQTT connection is established.
+func (b *MqttBridge) connected(_ *gomqtt_mini_client.MqttClient) error {
+	if b.spark != nil {
+		// Commands must be subscribed to before the edge node is born.
+		for _, filter := range b.spark.Filters() {
+			if err := b.mqtt.Subscribe(filter, 0); err != nil {
+				clog.Warning("Failed to subscribe to MQTT topic %s: %s", filter, err)
+			}
+		}
+		b.publish_all(b.spark.Birth())
+	} else if b.availability != "" {
+		b.publish_all([]*MqttPublication{MqttAvailability(b.availability, true)})
+	}
+	for _, rule := range b.subscribers {
+		if err := b.mqtt.Subscribe(rule.Filter, rule.Qos); err != nil {
+			clog.Warning("Failed to subscribe to MQTT topic %s: %s", rule.Filter, err)
+			continue
+		}
+		clog.Info("Subscribed to MQTT topic %s with QoS %d", rule.Filter, rule.Qos)
+	}
+	if b.commands != nil {
+		if err := b.mqtt.Subscribe(b.commands.Filter(), 1); err != nil {
+			clog.Warning("Failed to subscribe to MQTT topic %s: %s", b.commands.Filter(), err)
+		}
+	}
+	if b.outbound != nil {
+		b.outbound.Replay(b.replay_outbound)
+	}
+	if b.channel_values != nil {
+		for _, cu := range b.channel_values.List() {
+			b.publish_channel(cu)
+		}
+	}
+	if b.status != nil {
+		b.publish_all(b.status.Announce())
+	}
+	if b.discovery != nil {
+		b.publish_all(b.discovery.Announce())
+	}
+	return nil
+}
+
+// received is called when data is published on an MQTT topic we subscribed
+// to. The data is transferred to NoCAN channels, once for each subscriber
+// rule whose topic filter matches.
+func (b *MqttBridge) received(topic string, value []byte) {
+	if b.commands != nil {
+		if _, ok := MatchTopic(b.commands.Filter(), topic); ok {
+			// Requests are slow, so they must not hold up the MQTT reader.
+			go func() {
+				if response, ok := b.commands.Handle(topic, value); ok {
+					b.publish_all([]*MqttPublication{response})
+				}
+			}()
+			return
+		}
+	}
+
+	if !b.dispatcher.Conn().Connected {
+		if !b.lost_connection {
+			if b.inbound != nil {
+				clog.Warning("Connection to nocand has been interrupted, mqtt messages are queued until connection is restored.")
+			} else {
+				clog.Warning("Connection to nocand has been interrupted, mqtt message forwarding is disabled until connection is restored.")
+			}
+			b.lost_connection = true
+		}
+		if b.inbound == nil {
+			return
+		}
+	} else {
+		b.lost_connection = false
+	}
+
+	if b.spark != nil {
+		writes, messages, ok, err := b.spark.Command(topic, value)
+		if ok {
+			if err != nil {
+				metrics.MqttForwardFailures.Inc()
+				clog.Warning("Failed to process Sparkplug command on MQTT topic '%s': %s", topic, err)
+				return
+			}
+			for _, w := range writes {
+				b.forward_channel(topic, w.Channel, w.Value)
+			}
+			b.publish_all(messages)
+			return
+		}
+	}
+
+	if origin, ok := b.echoes.Match("mqtt:"+topic, value); ok {
+		clog.Debug("Ignoring echo of NoCAN channel '%s' publication on MQTT topic '%s'", origin, topic)
+		return
+	}
+
+	matched := false
+	for _, rule := range b.subscribers {
+		channel, svalue, ok, err := rule.Apply(topic, value)
+		if !ok {
+			continue
+		}
+		matched = true
+		if err != nil {
+			metrics.MqttForwardFailures.Inc()
+			clog.Warning("Failed to transform value of topic '%s' for MQTT subscription: %s", topic, err)
+			continue
+		}
+		if !rule.Limiter.Admit(channel, svalue, func(v []byte) { b.forward_channel(topic, channel, v) }) {
+			clog.DebugX("Holding back value of MQTT topic '%s' for NoCAN channel '%s'", topic, channel)
+			continue
+		}
+		b.forward_channel(topic, channel, svalue)
+	}
+	if !matched {
+		clog.Warning("Received message for MQTT topic '%s', but this topic is not mapped to any NoCAN channel", topic)
+	}
+}
+
+// send_channel transfers a value received on an MQTT topic to a NoCAN channel.
+func (b *MqttBridge) send_channel(topic string, channel string, svalue []byte) {
+	source := fmt.Sprintf("MQTT topic '%s'", topic)
+	b.echoes.Record("nocan:"+channel, svalue, topic)
+	b.dispatcher.Conn().SendAsync(socket.NewChannelUpdateEvent(channel, 0xFFFF, socket.CHANNEL_UPDATED, svalue, time.Now()),
+		func(c *socket.EventConn, err error) error {
+			if err != nil {
+				metrics.MqttForwardFailures.Inc()
+				clog.Warning("Failed to transfer %d byte message from %s to NoCAN channel '%s': %s", len(svalue), source, channel, err)
+			} else {
+				clog.Info("Transfered %d bytes from %s to NoCAN channel '%s'", len(svalue), source, channel)
+			}
+			return nil
+		})
+}
+
+func (b *MqttBridge) replay_inbound(m *QueuedMessage) error {
+	b.send_channel(m.Origin, m.Topic, m.Payload)
+	return nil
+}
+
+// forward_channel forwards a value received on an MQTT topic to a NoCAN
+// channel, or queues it while nocand is unreachable.
+func (b *MqttBridge) forward_channel(topic string, channel string, svalue []byte) {
+	// Queued messages go first, to preserve ordering.
+	if b.inbound != nil && (!b.dispatcher.Conn().Connected || b.inbound.Replay(b.replay_inbound) != nil) {
+		b.inbound.Push(channel, svalue, 0, false, topic)
+		return
+	}
+	b.send_channel(topic, channel, svalue)
+}
+
+// subscribed reports whether we receive the messages published on topic.
+func (b *MqttBridge) subscribed(topic string) bool {
+	for _, rule := range b.subscribers {
+		if _, ok := MatchTopic(rule.Filter, topic); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// send_topic publishes the value of a NoCAN channel on an MQTT topic.
+func (b *MqttBridge) send_topic(channel string, topic string, value []byte, qos byte, retain bool) error {
+	if b.subscribed(topic) {
+		b.echoes.Record("mqtt:"+topic, value, channel)
+	}
+	return b.mqtt.Publish(topic, value, qos, retain)
+}
+
+func (b *MqttBridge) replay_outbound(m *QueuedMessage) error {
+	return b.send_topic(m.Origin, m.Topic, m.Payload, m.Qos, m.Retain)
+}
+
+// publish_value publishes the value of a NoCAN channel on an MQTT topic, or
+// queues it while the MQTT server is unreachable.
+func (b *MqttBridge) publish_value(rule *MqttPublisherRule, channel string, topic string, value []byte) {
+	// Queued messages go first, to preserve ordering.
+	if b.outbound != nil && (!b.mqtt.Connected() || b.outbound.Replay(b.replay_outbound) != nil) {
+		b.outbound.Push(topic, value, rule.Qos, rule.Retain, channel)
+		return
+	}
+	if err := b.send_topic(channel, topic, value, rule.Qos, rule.Retain); err != nil {
+		metrics.MqttForwardFailures.Inc()
+		clog.Warning("Failed to transfer %d bytes from NoCAN channel '%s' to MQTT topic '%s': %s", len(value), channel, topic, err)
+		if b.outbound != nil {
+			b.outbound.Push(topic, value, rule.Qos, rule.Retain, channel)
+		}
+	} else {
+		clog.Info("Transfered %d bytes from NoCAN channel '%s' to MQTT topic '%s'", len(value), channel, topic)
+		clog.DebugXX("Transfered value is %q on MQTT topic '%s'", value, topic)
+	}
+}
+
+// publish_channel publishes a channel update once for each rule whose
+// channel pattern matches, except on the topic the value came from.
+func (b *MqttBridge) publish_channel(cu *socket.ChannelUpdateEvent) {
+	origin, from_mqtt := b.echoes.Match("nocan:"+cu.ChannelName, cu.Value)
+
+	for _, rule := range b.publishers {
+		topic, value, ok, err := rule.Apply(cu)
+		if !ok {
+			continue
+		}
+		if err != nil {
+			metrics.MqttForwardFailures.Inc()
+			clog.Warning("Failed to transform value of channel '%s' for MQTT publication: %s", cu.ChannelName, err)
+			continue
+		}
+		if from_mqtt && topic == origin {
+			clog.Debug("Not publishing NoCAN channel '%s' back to MQTT topic '%s', where its value came from", cu.ChannelName, topic)
+			continue
+		}
+		rule := rule
+		channel := cu.ChannelName
+		if !rule.Limiter.Admit(topic, value, func(v []byte) { b.publish_value(rule, channel, topic, v) }) {
+			clog.DebugX("Holding back value of NoCAN channel '%s' for MQTT topic '%s'", channel, topic)
+			continue
+		}
+		b.publish_value(rule, channel, topic, value)
+	}
+}
+
+// channel_updated propagates NoCAN channel updates to MQTT topics.
+func (b *MqttBridge) channel_updated(conn *socket.EventConn, e socket.Eventer) error {
+	if !b.mqtt.Connected() && b.outbound == nil {
+		return nil
+	}
+	cu := e.(*socket.ChannelUpdateEvent)
+
+	if cu.Status != socket.CHANNEL_UPDATED {
+		return nil
+	}
+	b.publish_channel(cu)
+	return nil
+}
+
+// channels_listed records the values of all channels, and publishes them if
+// the MQTT connection is up.
+func (b *MqttBridge) channels_listed(conn *socket.EventConn, e socket.Eventer) error {
+	b.channel_values.HandleEvent(e)
+	if b.mqtt.Connected() {
+		for _, cu := range e.(*socket.ChannelListEvent).Channels {
+			if len(cu.Value) > 0 {
+				b.publish_channel(cu)
+			}
+		}
+	}
+	return nil
+}
+
+// publish_events registers handle for each event in eids, and publishes the
+// messages it returns if the MQTT connection is up.
+func (b *MqttBridge) publish_events(handle func(socket.Eventer) []*MqttPublication, eids ...socket.EventId) {
+	cb := func(conn *socket.EventConn, e socket.Eventer) error {
+		messages := handle(e)
+		if b.mqtt.Connected() {
+			b.publish_all(messages)
+		}
+		return nil
+	}
+	for _, eid := range eids {
+		b.dispatcher.OnEvent(eid, cb)
+	}
+}
+
+// publish_connection publishes the state of the connection to nocand.
+func (b *MqttBridge) publish_connection(connected bool) {
+	m := b.status.Connection(connected)
+	if b.mqtt.Connected() {
+		b.publish_all([]*MqttPublication{m})
+	}
+}
+
+// publish_all publishes messages in order, logging failures.
+func (b *MqttBridge) publish_all(messages []*MqttPublication) {
+	for _, m := range messages {
+		if m == nil {
+			continue
+		}
+		if err := b.mqtt.Publish(m.Topic, m.Payload, m.Qos, m.Retain); err != nil {
+			metrics.MqttForwardFailures.Inc()
+			clog.Warning("Failed to publish %d bytes to MQTT topic '%s': %s", len(m.Payload), m.Topic, err)
+		} else {
+			clog.Debug("Published %d bytes to MQTT topic '%s'", len(m.Payload), m.Topic)
+		}
+	}
+}
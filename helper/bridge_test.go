@@ -0,0 +1,57 @@
+package helper
+
+import (
+	"github.com/omzlo/gomqtt-mini-client"
+	"github.com/omzlo/nocanc/cmd/config"
+	"github.com/omzlo/nocand/socket"
+	"testing"
+	"time"
+)
+
+func TestMqttBridge(t *testing.T) {
+	saved := config.Settings
+	defer func() { config.Settings = saved }()
+
+	broker := new_test_broker(t)
+	defer broker.listener.Close()
+
+	config.Settings = config.DefaultSettings
+	config.Settings.Mqtt.Publishers.Set("temp::nocan/temp")
+	config.Settings.Mqtt.Subscribers.Set("temp::nocan/temp")
+	config.Settings.Mqtt.AvailabilityTopic = "status"
+
+	client, err := gomqtt_mini_client.NewMqttClient("test", "mqtt://"+broker.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("NewMqttClient failed: %s", err)
+	}
+	mqtt := NewMqttConn(client)
+	bridge, err := NewMqttBridge(mqtt, NewEventDispatcher(NewNocanClient()))
+	if err != nil {
+		t.Fatalf("NewMqttBridge failed: %s", err)
+	}
+	if err := mqtt.Connect(); err != nil {
+		t.Fatalf("Connect failed: %s", err)
+	}
+	go mqtt.Supervise()
+	<-broker.packets // CONNECT
+
+	// Once connected, the bridge announces itself and subscribes.
+	broker.expect(t, "availability", []byte("\x33\x00\x06status\x00\x01online"))
+	broker.expect(t, "subscribe", []byte("\x82\x00\x02\x00\x0anocan/temp\x00"))
+
+	bridge.publish_channel(&socket.ChannelUpdateEvent{ChannelName: "temp", Status: socket.CHANNEL_UPDATED, Value: []byte("21")})
+	broker.expect(t, "publication", []byte("\x32\x00\x0anocan/temp\x00\x0321"))
+
+	// A value that came from the topic is not published back to it.
+	bridge.echoes.Record("nocan:temp", []byte("22"), "nocan/temp")
+	bridge.publish_channel(&socket.ChannelUpdateEvent{ChannelName: "temp", Status: socket.CHANNEL_UPDATED, Value: []byte("22")})
+
+	// Stop publishes the will.
+	bridge.Stop()
+	broker.expect(t, "will", []byte("\x33\x00\x06status\x00\x04offline"))
+	select {
+	case packet := <-broker.packets:
+		t.Errorf("Broker received unexpected packet % x", packet)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,53 @@
+package helper
+
+import (
+	"github.com/omzlo/nocand/socket"
+	"sort"
+	"sync"
+)
+
+// ChannelValues keeps the last known value of each NoCAN channel, as
+// reported by channel list and channel update events.
+type ChannelValues struct {
+	mutex  sync.Mutex
+	values map[string]*socket.ChannelUpdateEvent
+}
+
+func NewChannelValues() *ChannelValues {
+	return &ChannelValues{values: make(map[string]*socket.ChannelUpdateEvent)}
+}
+
+func (cv *ChannelValues) update(cu *socket.ChannelUpdateEvent) {
+	if cu.Status == socket.CHANNEL_DESTROYED || cu.Status == socket.CHANNEL_NOT_FOUND {
+		delete(cv.values, cu.ChannelName)
+	} else if len(cu.Value) > 0 {
+		cv.values[cu.ChannelName] = cu
+	}
+}
+
+func (cv *ChannelValues) HandleEvent(e socket.Eventer) {
+	cv.mutex.Lock()
+	defer cv.mutex.Unlock()
+
+	switch ev := e.(type) {
+	case *socket.ChannelListEvent:
+		for _, cu := range ev.Channels {
+			cv.update(cu)
+		}
+	case *socket.ChannelUpdateEvent:
+		cv.update(ev)
+	}
+}
+
+// List returns the channels that have a value, sorted by name.
+func (cv *ChannelValues) List() []*socket.ChannelUpdateEvent {
+	cv.mutex.Lock()
+	defer cv.mutex.Unlock()
+
+	list := make([]*socket.ChannelUpdateEvent, 0, len(cv.values))
+	for _, cu := range cv.values {
+		list = append(list, cu)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ChannelName < list[j].ChannelName })
+	return list
+}
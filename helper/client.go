@@ -1,15 +1,15 @@
 package helper
 
 import (
+	"context"
 	"fmt"
 	"github.com/omzlo/clog"
 	"github.com/omzlo/nocanc/cmd/config"
 	"github.com/omzlo/nocanc/intelhex"
-	//"github.com/omzlo/nocand/models"
-	//"github.com/omzlo/nocand/models/device"
+	"github.com/omzlo/nocand/models"
 	"github.com/omzlo/nocand/models/nocan"
-	//"github.com/omzlo/nocand/models/properties"
 	"github.com/omzlo/nocand/socket"
+	"time"
 )
 
 func NewNocanClient() *socket.EventConn {
@@ -25,264 +25,366 @@ func StartDefaultJobManager() {
 	}
 }
 
-/*
-func ListNodes() (*socket.NodeListEvent, *ExtendedError) {
-	list_nodes := make(chan *socket.NodeListEvent)
-
-	nocan_client := NewNocanClient()
-	defer nocan_client.Close()
-
-	nocan_client.OnConnect(func(conn *socket.EventConn) error {
-		return conn.Send(socket.NewNodeListRequestEvent())
-	})
-
-	nocan_client.OnEvent(socket.NodeListEventId, func(conn *socket.EventConn, e socket.Eventer) error {
-		list_nodes <- e.(*socket.NodeListEvent)
-		return socket.Terminate
-	})
-
-	err := nocan_client.DispatchEvents()
-	if err != nil && err != socket.Terminate {
-		return nil, NewExtendedError(err)
+// NewFirmwareUploadRequest creates an upload request containing all the data
+// records of firmware.
+func NewFirmwareUploadRequest(nodeId nocan.NodeId, firmware *intelhex.IntelHex) *socket.NodeFirmwareEvent {
+	upload_request := socket.NewNodeFirmwareEvent(nodeId).ConfigureAsUpload()
+	for _, block := range firmware.Blocks {
+		if block.Type == intelhex.DataRecord {
+			upload_request.AppendBlock(block.Address, block.Data)
+		} else {
+			clog.Debug("Ignoring record of type %d in hex file", block.Type)
+		}
 	}
-
-	return <-list_nodes, nil
+	return upload_request
 }
 
-func GetNode(nodeId uint) (*socket.NodeUpdateEvent, *ExtendedError) {
-	node_update := make(chan *socket.NodeUpdateEvent)
+// UploadFirmware starts uploading firmware to a node on conn, and returns
+// the job tracking the upload. A failed upload is retried as allowed by
+// DefaultRetryPolicy, and resumed from the last acknowledged flash page if
+// upload-resume is enabled.
+func UploadFirmware(conn *socket.EventConn, nodeId nocan.NodeId, firmware *intelhex.IntelHex, updater JobUpdater) (*Job, *ExtendedError) {
+	upload := NewFirmwareUpload(nodeId, firmware)
+	policy := DefaultRetryPolicy()
+	attempt := 0
 
-	nocan_client := NewNocanClient()
-	defer nocan_client.Close()
+	job := DefaultJobManager.NewJob(updater)
 
-	nocan_client.OnConnect(func(conn *socket.EventConn) error {
-		return conn.Send(socket.NewNodeUpdateRequestEvent(nodeId))
-	})
+	conn.OnEvent(socket.NodeFirmwareProgressEventId, func(conn *socket.EventConn, e socket.Eventer) error {
+		np := e.(*socket.NodeFirmwareProgressEvent)
+		if np.NodeId != nodeId {
+			return nil
+		}
 
-	nocan_client.OnEvent(socket.NodeUpdateEventId, func(conn *socket.EventConn, e socket.Eventer) error {
-		nu := e.(*NodeUpdateEvent)
-		if nu.NodeId == nodeId {
-			node_update <- nu
-			return socket.Terminate
+		switch np.Progress {
+		case socket.ProgressSuccess:
+			job.Success()
+		case socket.ProgressFailed:
+			upload.Acknowledge(np.BytesTransferred)
+			if attempt >= policy.Retries {
+				job.Fail(fmt.Errorf("Upload failed after %d attempt(s), %d bytes were not acknowledged", attempt+1, upload.Remaining()))
+				return nil
+			}
+			attempt++
+			delay := policy.Delay(attempt)
+			if upload.Resume {
+				clog.Warning("Upload to node %d failed, resuming with %d bytes left in %s (retry %d of %d)", nodeId, upload.Remaining(), delay, attempt, policy.Retries)
+			} else {
+				clog.Warning("Upload to node %d failed after %d bytes, retrying in %s (retry %d of %d)", nodeId, np.BytesTransferred, delay, attempt, policy.Retries)
+			}
+			job.Restart()
+			time.AfterFunc(delay, func() {
+				conn.SendAsync(upload.Request(), socket.ReturnErrorOrContinue)
+			})
+		default:
+			upload.Acknowledge(np.BytesTransferred)
+			job.UpdateProgress(upload.Progress())
 		}
 		return nil
 	})
 
-	err := nocan_client.DispatchEvents()
-	if err != nil && err != socket.Terminate {
-		return nil, ExtendedError(err)
-	}
-
-	return <-node_update, nil
+	conn.SendAsync(upload.Request(), socket.ReturnErrorOrContinue)
+	return job, nil
 }
 
-func ListChannels() (*socket.ChannelListEvent, *ExtendedError) {
-	list_channels := make(chan *socket.ChannelListEvent)
+/* SYNCHRONOUS CLIENT */
 
-	nocan_client := NewNocanClient()
-	defer nocan_client.Close()
+// Client performs blocking requests on a nocand event server.
+// Each request opens its own connection, which is closed as soon as the
+// response is received, so a single Client can be shared between goroutines.
+type Client struct {
+	Addr       string
+	ClientName string
+	AuthToken  string
+}
 
-	nocan_client.OnConnect(func(conn *socket.EventConn) error {
-		return conn.Send(socket.NewChannelListRequestEvent())
-	})
+func NewClient() *Client {
+	return &Client{
+		Addr:       config.Settings.EventServer,
+		ClientName: "nocanc",
+		AuthToken:  config.Settings.AuthToken,
+	}
+}
 
-	nocan_client.OnEvent(socket.NodeListEventId, func(conn *socket.EventConn, e socket.Eventer) error {
-		list_nodes <- e.(*socket.NodeListEvent)
-		return socket.Terminate
-	})
+// session connects to the server, registers handlers, sends event and waits
+// until a handler returns socket.Terminate, an error occurs or ctx is done.
+// If wait_ack is true, the session also terminates once the server
+// acknowledges event. If event is nil, nothing is sent.
+func (c *Client) session(ctx context.Context, event socket.Eventer, wait_ack bool, handlers map[socket.EventId]socket.EventCallback) *ExtendedError {
+	var timeout time.Duration
 
-	err := nocan_client.DispatchEvents()
-	if err != nil && err != socket.Terminate {
-		return nil, ExtendedError(err)
+	if err := ctx.Err(); err != nil {
+		return ServiceUnavailable(err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if timeout = time.Until(deadline); timeout <= 0 {
+			return ServiceUnavailable(context.DeadlineExceeded)
+		}
 	}
 
-	return <-list_nodes, nil
-
-}
+	clog.Debug("Preparing to connect to NoCAN event server '%s'", c.Addr)
+	conn := socket.NewEventConn(c.Addr, c.ClientName, c.AuthToken)
 
-func GetChannel(channelId nocan.ChannelId) (*socket.ChannelUpdate, *ExtendedError) {
-	conn, err := config.DialNocanServer()
-	if err != nil {
-		return nil, ExtendError(err)
-	}
-	defer conn.Close()
-	sl := socket.NewSubscriptionList(socket.ChannelUpdateEvent)
-	if err = conn.Subscribe(sl); err != nil {
-		return nil, ExtendError(err)
+	for eid, handler := range handlers {
+		conn.OnEvent(eid, handler)
 	}
-	if err = conn.Put(socket.ChannelUpdateRequestEvent, socket.NewChannelUpdateRequest("", channelId)); err != nil {
-		return nil, ExtendError(err)
+
+	if err := conn.Connect(); err != nil {
+		return ExtendError(err)
 	}
 
-	value, err := conn.WaitFor(socket.ChannelUpdateEvent)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Terminate()
+		case <-done:
+		}
+	}()
 
-	if err != nil {
-		return nil, ExtendError(err)
+	switch {
+	case event == nil:
+		// only wait for events
+	case wait_ack:
+		conn.SendAsync(event, socket.ReturnErrorOrTerminate)
+	default:
+		conn.SendAsync(event, socket.ReturnErrorOrContinue)
 	}
 
-	cu := new(socket.ChannelUpdate)
-	if err = cu.UnpackValue(value); err != nil {
-		return nil, InternalServerError(err)
+	err := conn.WaitTermination(timeout)
+	if ctx.Err() != nil {
+		return ServiceUnavailable(ctx.Err())
 	}
+	return ExtendError(err)
+}
 
-	if cu.Status == socket.CHANNEL_NOT_FOUND {
-		return nil, NotFound(fmt.Sprintf("Node %d not found", channelId))
+// request sends event to the server and waits for the first event of type
+// eid that satisfies accept. If eid is socket.NoEventId, request only waits
+// for the server acknowledgment. If event is nil, nothing is sent.
+func (c *Client) request(ctx context.Context, event socket.Eventer, eid socket.EventId, accept func(socket.Eventer) bool) (socket.Eventer, *ExtendedError) {
+	if eid == socket.NoEventId {
+		return nil, c.session(ctx, event, true, nil)
+	}
+
+	response := make(chan socket.Eventer, 1)
+	handlers := map[socket.EventId]socket.EventCallback{
+		eid: func(conn *socket.EventConn, e socket.Eventer) error {
+			if accept != nil && !accept(e) {
+				return nil
+			}
+			response <- e
+			return socket.Terminate
+		},
 	}
 
-	return cu, nil
+	if err := c.session(ctx, event, false, handlers); err != nil {
+		return nil, err
+	}
 
+	select {
+	case e := <-response:
+		return e, nil
+	default:
+		return nil, ServiceUnavailable(fmt.Sprintf("No %s received from server", eid))
+	}
 }
 
-func UpdateChannel(channelId nocan.ChannelId, channelName string, channelValue []byte) *ExtendedError {
-	conn, err := config.DialNocanServer()
+func (c *Client) ListNodes(ctx context.Context) (*socket.NodeListEvent, *ExtendedError) {
+	e, err := c.request(ctx, socket.NewNodeListRequestEvent(), socket.NodeListEventId, nil)
 	if err != nil {
-		return ExtendError(err)
+		return nil, err
 	}
-	defer conn.Close()
+	return e.(*socket.NodeListEvent), nil
+}
 
-	err = conn.Put(socket.ChannelUpdateEvent, socket.NewChannelUpdate(channelName, channelId, socket.CHANNEL_UPDATED, channelValue))
-	if err != nil {
-		return ExtendError(err)
+func (c *Client) GetNode(ctx context.Context, nodeId nocan.NodeId) (*socket.NodeUpdateEvent, *ExtendedError) {
+	if nodeId < 1 {
+		return nil, BadRequest(fmt.Sprintf("Node id must be between 1 and 127 included, but %d was provided", nodeId))
 	}
-	return nil
-}
 
-func GetPowerStatus() (*device.PowerStatus, *ExtendedError) {
-	conn, err := config.DialNocanServer()
+	e, err := c.request(ctx, socket.NewNodeUpdateRequestEvent(nodeId), socket.NodeUpdateEventId, func(e socket.Eventer) bool {
+		return e.(*socket.NodeUpdateEvent).NodeId == nodeId
+	})
 	if err != nil {
-		return nil, ExtendError(err)
+		return nil, err.WithInformation(fmt.Sprintf("Node %d", nodeId))
 	}
-	defer conn.Close()
-	sl := socket.NewSubscriptionList(socket.BusPowerStatusUpdateEvent)
-	if err = conn.Subscribe(sl); err != nil {
-		return nil, ExtendError(err)
+	nu := e.(*socket.NodeUpdateEvent)
+	if nu.State == models.NodeStateUnknown {
+		return nil, NotFound(fmt.Sprintf("Node %d does not exist", nodeId))
 	}
-	if err = conn.Put(socket.BusPowerStatusUpdateRequestEvent, nil); err != nil {
-		return nil, ExtendError(err)
-	}
-
-	value, err := conn.WaitFor(socket.BusPowerStatusUpdateEvent)
+	return nu, nil
+}
 
+func (c *Client) ListChannels(ctx context.Context) (*socket.ChannelListEvent, *ExtendedError) {
+	e, err := c.request(ctx, socket.NewChannelListRequestEvent(), socket.ChannelListEventId, nil)
 	if err != nil {
-		return nil, ExtendError(err)
+		return nil, err
 	}
-
-	ps := new(device.PowerStatus)
-	if err = ps.UnpackValue(value); err != nil {
-		return nil, InternalServerError(err)
-	}
-
-	return ps, nil
+	return e.(*socket.ChannelListEvent), nil
 }
-*/
-func UploadFirmware(conn *socket.EventConn, nodeId nocan.NodeId, firmware *intelhex.IntelHex, updater JobUpdater) (*Job, *ExtendedError) {
 
-	upload_request := socket.NewNodeFirmwareEvent(nodeId).ConfigureAsUpload()
-	for _, block := range firmware.Blocks {
-		if block.Type == intelhex.DataRecord {
-			upload_request.AppendBlock(block.Address, block.Data)
-		} else {
-			clog.Debug("Ignoring record of type %d in hex file", block.Type)
-		}
+// ReadChannel returns the last value published on the channel called channelName.
+func (c *Client) ReadChannel(ctx context.Context, channelName string) (*socket.ChannelUpdateEvent, *ExtendedError) {
+	e, err := c.request(ctx, socket.NewChannelUpdateRequestEvent(channelName, 0xFFFF), socket.ChannelUpdateEventId, func(e socket.Eventer) bool {
+		return e.(*socket.ChannelUpdateEvent).ChannelName == channelName
+	})
+	if err != nil {
+		return nil, err.WithInformation(fmt.Sprintf("Channel '%s'", channelName))
 	}
+	cu := e.(*socket.ChannelUpdateEvent)
+	if cu.Status == socket.CHANNEL_NOT_FOUND {
+		return nil, NotFound(fmt.Sprintf("Channel '%s' does not exist", channelName))
+	}
+	return cu, nil
+}
 
-	conn.SendAsync(upload_request, socket.ReturnErrorOrContinue)
-
-	job := DefaultJobManager.NewJob(updater)
-
-	conn.OnEvent(socket.NodeFirmwareProgressEventId, func(conn *socket.EventConn, e socket.Eventer) error {
-		np := e.(*socket.NodeFirmwareProgressEvent)
-
-		switch np.Progress {
-		case socket.ProgressSuccess:
-			job.Success()
-		case socket.ProgressFailed:
-			job.Fail(fmt.Errorf("Upload failed"))
-		default:
-			job.UpdateProgress(float32(np.Progress))
-		}
-		return nil
+// WaitForChannelUpdate blocks until a new value is published on the channel
+// called channelName, or until ctx is done.
+func (c *Client) WaitForChannelUpdate(ctx context.Context, channelName string) (*socket.ChannelUpdateEvent, *ExtendedError) {
+	e, err := c.request(ctx, nil, socket.ChannelUpdateEventId, func(e socket.Eventer) bool {
+		cu := e.(*socket.ChannelUpdateEvent)
+		return cu.ChannelName == channelName && cu.Status == socket.CHANNEL_UPDATED
 	})
-	return job, nil
+	if err != nil {
+		return nil, err.WithInformation(fmt.Sprintf("Channel '%s'", channelName))
+	}
+	return e.(*socket.ChannelUpdateEvent), nil
 }
 
-/*
-func GetDeviceInformation() (*device.Information, *ExtendedError) {
-	conn, err := config.DialNocanServer()
+func (c *Client) PublishChannel(ctx context.Context, channelName string, value []byte) *ExtendedError {
+	_, err := c.request(ctx, socket.NewChannelUpdateEvent(channelName, 0xFFFF, socket.CHANNEL_UPDATED, value, time.Now()), socket.NoEventId, nil)
 	if err != nil {
-		return nil, ExtendError(err)
-	}
-	defer conn.Close()
-	sl := socket.NewSubscriptionList(socket.DeviceInformationEvent)
-	if err = conn.Subscribe(sl); err != nil {
-		return nil, ExtendError(err)
+		return err.WithInformation(fmt.Sprintf("Channel '%s'", channelName))
 	}
-	if err = conn.Put(socket.DeviceInformationRequestEvent, nil); err != nil {
-		return nil, ExtendError(err)
-	}
-
-	value, err := conn.WaitFor(socket.DeviceInformationEvent)
+	return nil
+}
 
-	if err != nil {
-		return nil, ExtendError(err)
+func (c *Client) Reboot(ctx context.Context, nodeId nocan.NodeId, force bool) *ExtendedError {
+	if nodeId < 1 {
+		return BadRequest(fmt.Sprintf("Node id must be between 1 and 127 included, but %d was provided", nodeId))
 	}
 
-	di := new(device.Information)
-	if err = di.UnpackValue(value); err != nil {
-		return nil, InternalServerError(err)
+	_, err := c.request(ctx, socket.NewNodeRebootRequestEvent(nodeId, force), socket.NoEventId, nil)
+	if err != nil {
+		return err.WithInformation(fmt.Sprintf("Node %d", nodeId))
 	}
+	return nil
+}
 
-	return di, nil
+func (c *Client) SetPower(ctx context.Context, powerOn bool) *ExtendedError {
+	_, err := c.request(ctx, socket.NewBusPowerEvent(powerOn), socket.NoEventId, nil)
+	return err
 }
 
-func GetSystemProperties() (*properties.Properties, *ExtendedError) {
-	conn, err := config.DialNocanServer()
+func (c *Client) PowerStatus(ctx context.Context) (*socket.BusPowerStatusUpdateEvent, *ExtendedError) {
+	e, err := c.request(ctx, socket.NewBusPowerStatusUpdateRequestEvent(), socket.BusPowerStatusUpdateEventId, nil)
 	if err != nil {
-		return nil, ExtendError(err)
+		return nil, err
 	}
-	defer conn.Close()
-	sl := socket.NewSubscriptionList(socket.SystemPropertiesEvent)
-	if err = conn.Subscribe(sl); err != nil {
-		return nil, ExtendError(err)
-	}
-	if err = conn.Put(socket.SystemPropertiesRequestEvent, nil); err != nil {
-		return nil, ExtendError(err)
-	}
-
-	value, err := conn.WaitFor(socket.SystemPropertiesEvent)
+	return e.(*socket.BusPowerStatusUpdateEvent), nil
+}
 
+func (c *Client) DeviceInfo(ctx context.Context) (*socket.DeviceInformationEvent, *ExtendedError) {
+	e, err := c.request(ctx, socket.NewDeviceInformationRequestEvent(), socket.DeviceInformationEventId, nil)
 	if err != nil {
-		return nil, ExtendError(err)
+		return nil, err
 	}
+	return e.(*socket.DeviceInformationEvent), nil
+}
 
-	sp := properties.New()
-	if err = sp.UnpackValue(value); err != nil {
-		return nil, InternalServerError(err)
+func (c *Client) SystemProperties(ctx context.Context) (*socket.SystemPropertiesEvent, *ExtendedError) {
+	e, err := c.request(ctx, socket.NewSystemPropertiesRequestEvent(), socket.SystemPropertiesEventId, nil)
+	if err != nil {
+		return nil, err
 	}
-
-	return sp, nil
+	return e.(*socket.SystemPropertiesEvent), nil
 }
 
-func RebootNode(nodeId int, force bool) *ExtendedError {
-
-	if nodeId > 127 || nodeId == 0 {
-		return BadRequest(fmt.Errorf("Node id must be between 1 and 127 included, but %d was provided.", nodeId))
+// DownloadFirmware reads up to limit bytes of flash memory from a node.
+// If progress is not nil, it is called for each progress report sent by the server.
+func (c *Client) DownloadFirmware(ctx context.Context, nodeId nocan.NodeId, limit uint32, progress func(*socket.NodeFirmwareProgressEvent)) (*intelhex.IntelHex, *ExtendedError) {
+	download_request := socket.NewNodeFirmwareEvent(nodeId).ConfigureAsDownload()
+	download_request.Limit = limit
+
+	response := make(chan *intelhex.IntelHex, 1)
+	handlers := map[socket.EventId]socket.EventCallback{
+		socket.NodeFirmwareProgressEventId: func(conn *socket.EventConn, e socket.Eventer) error {
+			np := e.(*socket.NodeFirmwareProgressEvent)
+			if np.NodeId != nodeId {
+				return nil
+			}
+			if progress != nil {
+				progress(np)
+			}
+			if np.Progress == socket.ProgressFailed {
+				return InternalServerError(fmt.Sprintf("Download from node %d failed", nodeId))
+			}
+			return nil
+		},
+		socket.NodeFirmwareEventId: func(conn *socket.EventConn, e socket.Eventer) error {
+			nf := e.(*socket.NodeFirmwareEvent)
+			if nf.NodeId != nodeId {
+				return fmt.Errorf("Unexpected firmware event for node %d", nf.NodeId)
+			}
+			ihex := intelhex.New()
+			for _, block := range nf.Code {
+				ihex.Add(intelhex.DataRecord, block.Offset, block.Data)
+			}
+			response <- ihex
+			return socket.Terminate
+		},
 	}
 
-	request := socket.CreateNodeRebootRequest(nocan.NodeId(nodeId), force)
-
-	conn, err := config.DialNocanServer()
-	if err != nil {
-		return ExtendError(err)
+	if err := c.session(ctx, download_request, false, handlers); err != nil {
+		return nil, err
 	}
-	defer conn.Close()
 
-	if err := conn.Put(socket.NodeRebootRequestEvent, request); err != nil {
-		return ExtendError(err)
-	}
-	if err := conn.GetAck(); err != nil {
-		return ExtendError(err).WithInformation(fmt.Sprintf("Node %d", nodeId))
+	select {
+	case ihex := <-response:
+		return ihex, nil
+	default:
+		return nil, ServiceUnavailable(fmt.Sprintf("No firmware received from node %d", nodeId))
 	}
+}
+
+// UploadFirmware sends firmware to a node and blocks until the upload
+// succeeds or fails. Progress is reported to job, which is marked as
+// succeeded when the upload terminates. On failure, the error is returned
+// and job is left running, so that the caller can retry the upload before
+// marking job as failed.
+func (c *Client) UploadFirmware(ctx context.Context, nodeId nocan.NodeId, firmware *intelhex.IntelHex, job *Job) *ExtendedError {
+	return c.ResumeUpload(ctx, NewFirmwareUpload(nodeId, firmware), job)
+}
+
+// ResumeUpload sends the next request of upload and blocks until the upload
+// succeeds or fails, like UploadFirmware. After a failure, it can be called
+// again with the same upload to retry it, sending only the data that was not
+// acknowledged if upload.Resume is set.
+func (c *Client) ResumeUpload(ctx context.Context, upload *FirmwareUpload, job *Job) *ExtendedError {
+	handlers := map[socket.EventId]socket.EventCallback{
+		socket.NodeFirmwareProgressEventId: func(conn *socket.EventConn, e socket.Eventer) error {
+			np := e.(*socket.NodeFirmwareProgressEvent)
+			if np.NodeId != upload.NodeId {
+				return nil
+			}
+			switch np.Progress {
+			case socket.ProgressSuccess:
+				return socket.Terminate
+			case socket.ProgressFailed:
+				upload.Acknowledge(np.BytesTransferred)
+				return InternalServerError(fmt.Sprintf("Upload to node %d failed with %d bytes left", upload.NodeId, upload.Remaining()))
+			default:
+				upload.Acknowledge(np.BytesTransferred)
+				job.UpdateProgress(upload.Progress())
+			}
+			return nil
+		},
+	}
+
+	if err := c.session(ctx, upload.Request(), false, handlers); err != nil {
+		return err
+	}
+	job.Success()
 	return nil
 }
-*/
@@ -0,0 +1,129 @@
+package helper
+
+import (
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocand/socket"
+	"sync"
+	"time"
+)
+
+// DISPATCH_MAX_BACKOFF caps the delay between two attempts to redial nocand.
+const DISPATCH_MAX_BACKOFF = 8 * time.Second
+
+// EventDispatcher allows several callbacks to be registered for the same
+// event on a socket.EventConn, which only keeps one callback per event id.
+// Callbacks are called in the order they were registered, until one of them
+// returns an error.
+type EventDispatcher struct {
+	conn       *socket.EventConn
+	mutex      sync.RWMutex
+	callbacks  map[socket.EventId][]socket.EventCallback
+	connect    []func(*socket.EventConn) error
+	disconnect []func(error)
+}
+
+func NewEventDispatcher(conn *socket.EventConn) *EventDispatcher {
+	d := &EventDispatcher{conn: conn, callbacks: make(map[socket.EventId][]socket.EventCallback)}
+	conn.OnConnect(d.dispatch_connect)
+	return d
+}
+
+func (d *EventDispatcher) Conn() *socket.EventConn {
+	return d.conn
+}
+
+func (d *EventDispatcher) OnEvent(eid socket.EventId, cb socket.EventCallback) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if len(d.callbacks[eid]) == 0 {
+		d.conn.OnEvent(eid, d.dispatch)
+	}
+	d.callbacks[eid] = append(d.callbacks[eid], cb)
+}
+
+// OnConnect adds a callback called each time the connection to nocand is established.
+func (d *EventDispatcher) OnConnect(cb func(*socket.EventConn) error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.connect = append(d.connect, cb)
+}
+
+// OnDisconnect adds a callback called with the cause each time the
+// connection to nocand is lost, before redialing it.
+func (d *EventDispatcher) OnDisconnect(cb func(error)) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.disconnect = append(d.disconnect, cb)
+}
+
+// Connect connects to nocand, calling the connect callbacks.
+func (d *EventDispatcher) Connect() error {
+	return d.conn.Connect()
+}
+
+// Wait dispatches events until a callback terminates the connection. Each
+// time the dispatch loop ends because the connection was lost, the
+// disconnect callbacks are called and the connection is redialed, waiting
+// up to DISPATCH_MAX_BACKOFF between attempts.
+func (d *EventDispatcher) Wait() error {
+	for {
+		err := d.conn.WaitTermination(0)
+		if err == nil || err == socket.Terminate {
+			return nil
+		}
+		d.dispatch_disconnect(err)
+
+		clog.Warning("Connection to nocand lost: %s", err)
+		for backoff := time.Second; ; {
+			time.Sleep(backoff)
+			err := d.conn.Connect()
+			if err == nil {
+				break
+			}
+			clog.Debug("Failed to reconnect to nocand: %s", err)
+			if backoff < DISPATCH_MAX_BACKOFF {
+				backoff *= 2
+			}
+		}
+		clog.Info("Reconnected to nocand")
+	}
+}
+
+func (d *EventDispatcher) dispatch(conn *socket.EventConn, e socket.Eventer) error {
+	d.mutex.RLock()
+	callbacks := d.callbacks[e.Id()]
+	d.mutex.RUnlock()
+
+	for _, cb := range callbacks {
+		if err := cb(conn, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *EventDispatcher) dispatch_connect(conn *socket.EventConn) error {
+	d.mutex.RLock()
+	callbacks := d.connect
+	d.mutex.RUnlock()
+
+	for _, cb := range callbacks {
+		if err := cb(conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *EventDispatcher) dispatch_disconnect(err error) {
+	d.mutex.RLock()
+	callbacks := d.disconnect
+	d.mutex.RUnlock()
+
+	for _, cb := range callbacks {
+		cb(err)
+	}
+}
@@ -0,0 +1,77 @@
+package helper
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+const ECHO_WINDOW = 10 * time.Second
+
+// EchoFilter tracks the values forwarded by the MQTT bridge, so that their
+// echoes can be recognized: a value written to a NoCAN channel comes back as
+// a channel update, and a value published on a subscribed MQTT topic comes
+// back from the MQTT server. Without suppression, a channel that is both
+// published and subscribed to would bounce between MQTT and NoCAN forever.
+type EchoFilter struct {
+	Window  time.Duration
+	mutex   sync.Mutex
+	entries map[string][]*echo_entry
+}
+
+type echo_entry struct {
+	value   []byte
+	origin  string
+	expires time.Time
+}
+
+func NewEchoFilter(window time.Duration) *EchoFilter {
+	return &EchoFilter{Window: window, entries: make(map[string][]*echo_entry)}
+}
+
+func (f *EchoFilter) prune(key string, now time.Time) []*echo_entry {
+	entries := f.entries[key]
+	i := 0
+	for i < len(entries) && now.After(entries[i].expires) {
+		i++
+	}
+	entries = entries[i:]
+	if len(entries) == 0 {
+		delete(f.entries, key)
+	} else {
+		f.entries[key] = entries
+	}
+	return entries
+}
+
+// Record notes that value was forwarded to key (e.g. "nocan:<channel>" or
+// "mqtt:<topic>") on behalf of origin.
+func (f *EchoFilter) Record(key string, value []byte, origin string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	now := time.Now()
+	f.entries[key] = append(f.prune(key, now), &echo_entry{value: value, origin: origin, expires: now.Add(f.Window)})
+}
+
+// Match reports whether value received from key is the echo of a value
+// recorded within the time window, and returns the origin of that value.
+// Each recorded value matches at most once.
+func (f *EchoFilter) Match(key string, value []byte) (string, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	entries := f.prune(key, time.Now())
+	for i, e := range entries {
+		if bytes.Equal(e.value, value) {
+			entries = append(entries[:i:i], entries[i+1:]...)
+			if len(entries) == 0 {
+				delete(f.entries, key)
+			} else {
+				f.entries[key] = entries
+			}
+			return e.origin, true
+		}
+	}
+	return "", false
+}
@@ -86,3 +86,7 @@ func InternalServerError(info interface{}) *ExtendedError {
 func Unauthorized(info interface{}) *ExtendedError {
 	return NewExtendedError(http.StatusUnauthorized, "unauthorized", info)
 }
+
+func Forbidden(info interface{}) *ExtendedError {
+	return NewExtendedError(http.StatusForbidden, "forbidden", info)
+}
@@ -0,0 +1,269 @@
+package helper
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/omzlo/nocanc/cmd/config"
+	"github.com/omzlo/nocand/models"
+	"github.com/omzlo/nocand/models/nocan"
+	"github.com/omzlo/nocand/socket"
+	"strings"
+	"sync"
+)
+
+// MqttPublication is a message to publish on an MQTT server.
+type MqttPublication struct {
+	Topic   string
+	Payload []byte
+	Qos     byte
+	Retain  bool
+}
+
+const HA_DEFAULT_COMPONENT = "sensor"
+
+type ha_device struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+type ha_availability struct {
+	Topic               string `json:"topic"`
+	PayloadAvailable    string `json:"payload_available"`
+	PayloadNotAvailable string `json:"payload_not_available"`
+}
+
+type ha_config struct {
+	Name              string             `json:"name"`
+	UniqueId          string             `json:"unique_id"`
+	StateTopic        string             `json:"state_topic"`
+	CommandTopic      string             `json:"command_topic,omitempty"`
+	UnitOfMeasurement string             `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string             `json:"device_class,omitempty"`
+	ValueTemplate     string             `json:"value_template,omitempty"`
+	Availability      []*ha_availability `json:"availability,omitempty"`
+	AvailabilityMode  string             `json:"availability_mode,omitempty"`
+	Device            *ha_device         `json:"device"`
+}
+
+// HomeAssistantDiscovery generates the Home Assistant MQTT discovery
+// messages for the channels mapped by MQTT publisher rules, as well as the
+// availability of the nodes these channels belong to.
+type HomeAssistantDiscovery struct {
+	Prefix             string
+	AvailabilityPrefix string
+	AvailabilityTopic  string
+	ClientId           string
+	entities           []*config.HomeAssistantEntity
+	publishers         []*MqttPublisherRule
+	subscribers        []*MqttSubscriberRule
+	mutex              sync.Mutex
+	channels           map[string]*socket.ChannelUpdateEvent
+	announced          map[string]string
+	availability       map[nocan.NodeId]string
+}
+
+func NewHomeAssistantDiscovery(conf *config.MqttConfiguration, publishers []*MqttPublisherRule, subscribers []*MqttSubscriberRule) (*HomeAssistantDiscovery, error) {
+	for i, entity := range conf.Entities {
+		if err := ValidateTopicFilter(entity.Channel); err != nil {
+			return nil, fmt.Errorf("Home Assistant entity %d: %s", i+1, err)
+		}
+		if entity.Node > 127 {
+			return nil, fmt.Errorf("Home Assistant entity %d: node id must be between 1 and 127, got %d", i+1, entity.Node)
+		}
+	}
+	return &HomeAssistantDiscovery{
+		Prefix:             strings.TrimRight(conf.DiscoveryPrefix, "/"),
+		AvailabilityPrefix: strings.TrimRight(conf.NodeAvailabilityPrefix, "/"),
+		AvailabilityTopic:  conf.AvailabilityTopic,
+		ClientId:           conf.ClientId,
+		entities:           conf.Entities,
+		publishers:         publishers,
+		subscribers:        subscribers,
+		channels:           make(map[string]*socket.ChannelUpdateEvent),
+		announced:          make(map[string]string),
+		availability:       make(map[nocan.NodeId]string),
+	}, nil
+}
+
+func ha_object_id(channel_name string) string {
+	return "nocan_" + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, channel_name)
+}
+
+func (d *HomeAssistantDiscovery) entity(channel_name string) *config.HomeAssistantEntity {
+	for _, entity := range d.entities {
+		if _, ok := MatchTopic(entity.Channel, channel_name); ok {
+			return entity
+		}
+	}
+	return &config.HomeAssistantEntity{Channel: channel_name}
+}
+
+func (d *HomeAssistantDiscovery) node_availability_topic(id nocan.NodeId) string {
+	return fmt.Sprintf("%s/%d/availability", d.AvailabilityPrefix, id)
+}
+
+// command_topic returns the topic of the first subscriber rule that writes
+// to channel_name without using wildcards, if any.
+func (d *HomeAssistantDiscovery) command_topic(channel_name string) string {
+	for _, rule := range d.subscribers {
+		if IsTopicPattern(rule.Filter) {
+			continue
+		}
+		name, err := ExecuteTemplate(rule.Channel, &MqttSubscriberData{Topic: rule.Filter})
+		if err == nil && string(name) == channel_name {
+			return rule.Filter
+		}
+	}
+	return ""
+}
+
+func (d *HomeAssistantDiscovery) config_message(cu *socket.ChannelUpdateEvent) *MqttPublication {
+	var state_topic string
+
+	for _, rule := range d.publishers {
+		if topic, _, ok, err := rule.Apply(cu); ok && err == nil {
+			state_topic = topic
+			break
+		}
+	}
+	if state_topic == "" {
+		return nil
+	}
+
+	entity := d.entity(cu.ChannelName)
+	component := entity.Component
+	if component == "" {
+		component = HA_DEFAULT_COMPONENT
+	}
+	object_id := ha_object_id(cu.ChannelName)
+
+	conf := &ha_config{
+		Name:              entity.Name,
+		UniqueId:          object_id,
+		StateTopic:        state_topic,
+		CommandTopic:      d.command_topic(cu.ChannelName),
+		UnitOfMeasurement: entity.Unit,
+		DeviceClass:       entity.DeviceClass,
+		ValueTemplate:     entity.ValueTemplate,
+	}
+	if conf.Name == "" {
+		conf.Name = cu.ChannelName
+	}
+	// An entity is available only if the bridge and its node are both available.
+	if d.AvailabilityTopic != "" {
+		conf.Availability = append(conf.Availability, &ha_availability{d.AvailabilityTopic, MQTT_AVAILABLE, MQTT_NOT_AVAILABLE})
+	}
+	if entity.Node != 0 {
+		conf.Availability = append(conf.Availability, &ha_availability{d.node_availability_topic(nocan.NodeId(entity.Node)), MQTT_AVAILABLE, MQTT_NOT_AVAILABLE})
+	}
+	if len(conf.Availability) > 1 {
+		conf.AvailabilityMode = "all"
+	}
+	if entity.Node != 0 {
+		conf.Device = &ha_device{
+			Identifiers:  []string{fmt.Sprintf("nocan_node_%d", entity.Node)},
+			Name:         fmt.Sprintf("NoCAN node %d", entity.Node),
+			Manufacturer: "Omzlo",
+			Model:        "NoCAN node",
+		}
+	} else {
+		conf.Device = &ha_device{
+			Identifiers:  []string{"nocanc_" + d.ClientId},
+			Name:         "NoCAN network",
+			Manufacturer: "Omzlo",
+			Model:        "nocanc mqtt bridge",
+		}
+	}
+
+	payload, err := json.Marshal(conf)
+	if err != nil {
+		return nil
+	}
+	topic := fmt.Sprintf("%s/%s/%s/config", d.Prefix, component, object_id)
+	d.announced[cu.ChannelName] = topic
+	return &MqttPublication{Topic: topic, Payload: payload, Qos: 1, Retain: true}
+}
+
+func (d *HomeAssistantDiscovery) update_channel(cu *socket.ChannelUpdateEvent) []*MqttPublication {
+	switch cu.Status {
+	case socket.CHANNEL_CREATED, socket.CHANNEL_UPDATED:
+		d.channels[cu.ChannelName] = cu
+		if _, ok := d.announced[cu.ChannelName]; !ok {
+			if m := d.config_message(cu); m != nil {
+				return []*MqttPublication{m}
+			}
+		}
+	case socket.CHANNEL_DESTROYED:
+		delete(d.channels, cu.ChannelName)
+		if topic, ok := d.announced[cu.ChannelName]; ok {
+			delete(d.announced, cu.ChannelName)
+			// An empty retained config message removes the entity from Home Assistant.
+			return []*MqttPublication{{Topic: topic, Payload: []byte{}, Qos: 1, Retain: true}}
+		}
+	}
+	return nil
+}
+
+func (d *HomeAssistantDiscovery) update_node(nu *socket.NodeUpdateEvent) []*MqttPublication {
+	availability := MQTT_NOT_AVAILABLE
+	if nu.State == models.NodeStateRunning {
+		availability = MQTT_AVAILABLE
+	}
+	if d.availability[nu.NodeId] == availability {
+		return nil
+	}
+	d.availability[nu.NodeId] = availability
+	return []*MqttPublication{{Topic: d.node_availability_topic(nu.NodeId), Payload: []byte(availability), Qos: 1, Retain: true}}
+}
+
+// HandleEvent returns the discovery and availability messages to publish
+// following an event received from nocand.
+func (d *HomeAssistantDiscovery) HandleEvent(e socket.Eventer) []*MqttPublication {
+	var messages []*MqttPublication
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	switch ev := e.(type) {
+	case *socket.ChannelListEvent:
+		for _, cu := range ev.Channels {
+			messages = append(messages, d.update_channel(cu)...)
+		}
+	case *socket.ChannelUpdateEvent:
+		messages = d.update_channel(ev)
+	case *socket.NodeListEvent:
+		for _, nu := range ev.Nodes {
+			messages = append(messages, d.update_node(nu)...)
+		}
+	case *socket.NodeUpdateEvent:
+		messages = d.update_node(ev)
+	}
+	return messages
+}
+
+// Announce returns the messages describing all known channels and nodes.
+// It is used when (re)connecting to the MQTT server.
+func (d *HomeAssistantDiscovery) Announce() []*MqttPublication {
+	var messages []*MqttPublication
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.announced = make(map[string]string)
+	for _, cu := range d.channels {
+		if m := d.config_message(cu); m != nil {
+			messages = append(messages, m)
+		}
+	}
+	for id, availability := range d.availability {
+		messages = append(messages, &MqttPublication{Topic: d.node_availability_topic(id), Payload: []byte(availability), Qos: 1, Retain: true})
+	}
+	return messages
+}
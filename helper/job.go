@@ -3,6 +3,7 @@ package helper
 import (
 	"errors"
 	"github.com/omzlo/clog"
+	"github.com/omzlo/nocanc/metrics"
 	//"github.com/omzlo/nocanc/intelhex"
 	"sync"
 	"time"
@@ -170,11 +171,21 @@ func (job *Job) Fail(err error) {
 	job.Touch()
 	job.Error = err
 	job.Status = JOB_ERROR
+	metrics.JobOutcomes.Inc("error")
 	job.updater.Update(job)
 }
 
 func (job *Job) Success() {
 	job.Touch()
 	job.Status = JOB_SUCCESS
+	metrics.JobOutcomes.Inc("success")
+	job.updater.Update(job)
+}
+
+func (job *Job) Restart() {
+	job.Touch()
+	job.Progress = 0
+	job.Error = nil
+	job.Status = JOB_RUNNING
 	job.updater.Update(job)
 }
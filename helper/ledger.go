@@ -0,0 +1,152 @@
+package helper
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocanc/intelhex"
+	"github.com/omzlo/nocand/models"
+	"github.com/omzlo/nocand/models/nocan"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LedgerEntry records the last firmware uploaded to a node.
+type LedgerEntry struct {
+	Udid       string             `json:"udid"`
+	NodeId     nocan.NodeId       `json:"node_id"`
+	UploadedAt time.Time          `json:"uploaded_at"`
+	File       string             `json:"file,omitempty"`
+	Size       uint               `json:"size"`
+	Digest     *intelhex.Digest   `json:"digest"`
+	Metadata   *intelhex.Metadata `json:"metadata,omitempty"`
+}
+
+// NewLedgerEntry describes the upload of firmware, loaded from file, to a node.
+func NewLedgerEntry(node_id nocan.NodeId, udid models.Udid8, file string, firmware *intelhex.IntelHex, metadata *intelhex.Metadata) (*LedgerEntry, error) {
+	digest, err := firmware.Digest()
+	if err != nil {
+		return nil, err
+	}
+	return &LedgerEntry{
+		Udid:       udid.String(),
+		NodeId:     node_id,
+		UploadedAt: time.Now(),
+		File:       file,
+		Size:       firmware.Size,
+		Digest:     digest,
+		Metadata:   metadata,
+	}, nil
+}
+
+// FirmwareLedger keeps track of the last firmware uploaded to each node, by
+// node UDID, in a JSON file.
+type FirmwareLedger struct {
+	mutex sync.Mutex
+	path  string
+}
+
+func NewFirmwareLedger(path string) *FirmwareLedger {
+	return &FirmwareLedger{path: path}
+}
+
+func (l *FirmwareLedger) load() (map[string]*LedgerEntry, error) {
+	entries := make(map[string]*LedgerEntry)
+
+	data, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Record adds entry to the ledger, replacing the previous entry of the same node UDID.
+func (l *FirmwareLedger) Record(entry *LedgerEntry) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	entries, err := l.load()
+	if err != nil {
+		return err
+	}
+	entries[entry.Udid] = entry
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := l.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
+
+// List returns all entries, sorted by node id and UDID.
+func (l *FirmwareLedger) List() ([]*LedgerEntry, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	entries, err := l.load()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*LedgerEntry, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].NodeId != list[j].NodeId {
+			return list[i].NodeId < list[j].NodeId
+		}
+		return list[i].Udid < list[j].Udid
+	})
+	return list, nil
+}
+
+// Find returns the entry of a node UDID, or nil if there is none.
+func (l *FirmwareLedger) Find(udid models.Udid8) (*LedgerEntry, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	entries, err := l.load()
+	if err != nil {
+		return nil, err
+	}
+	return entries[udid.String()], nil
+}
+
+// RecordUpload records a successful upload in the ledger, looking up the
+// UDID of the node if it is not known. Failures are logged, since they
+// should not fail the upload itself.
+func (l *FirmwareLedger) RecordUpload(client *Client, node_id nocan.NodeId, udid models.Udid8, file string, firmware *intelhex.IntelHex, metadata *intelhex.Metadata) {
+	if udid == models.NullUdid8 {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		node, err := client.GetNode(ctx, node_id)
+		cancel()
+		if err != nil {
+			clog.Warning("Could not record upload to node %d in firmware ledger, failed to get node UDID: %s", node_id, err)
+			return
+		}
+		udid = node.Udid
+	}
+
+	entry, err := NewLedgerEntry(node_id, udid, file, firmware, metadata)
+	if err == nil {
+		err = l.Record(entry)
+	}
+	if err != nil {
+		clog.Warning("Could not record upload to node %d in firmware ledger %s: %s", node_id, l.path, err)
+		return
+	}
+	clog.Info("Recorded upload of %s to node %d (%s) in firmware ledger", entry.Digest.SHA256String(), node_id, entry.Udid)
+}
@@ -0,0 +1,91 @@
+package helper
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// Limiter implements the changed-only and min-interval options of mqtt
+// mappings. Each destination (an MQTT topic or a NoCAN channel) of a
+// mapping is limited independently.
+type Limiter struct {
+	ChangedOnly  bool
+	MinInterval  time.Duration
+	mutex        sync.Mutex
+	destinations map[string]*limiter_state
+}
+
+type limiter_state struct {
+	value       []byte
+	sent        time.Time
+	has_pending bool
+	pending     []byte
+	deferred    func([]byte)
+	timer       *time.Timer
+}
+
+// NewLimiter returns a limiter, or nil if neither option is enabled. A nil
+// limiter admits all values.
+func NewLimiter(changed_only bool, min_interval time.Duration) *Limiter {
+	if !changed_only && min_interval <= 0 {
+		return nil
+	}
+	return &Limiter{ChangedOnly: changed_only, MinInterval: min_interval, destinations: make(map[string]*limiter_state)}
+}
+
+// Admit reports whether value can be forwarded to dest now. A value that is
+// held back by MinInterval is passed to deferred once the interval has
+// elapsed, unless a more recent value supersedes it in the meantime.
+func (l *Limiter) Admit(dest string, value []byte, deferred func([]byte)) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	st, ok := l.destinations[dest]
+	if !ok {
+		l.destinations[dest] = &limiter_state{value: value, sent: time.Now()}
+		return true
+	}
+	if l.ChangedOnly && bytes.Equal(value, st.value) {
+		// dest already has this value, anything pending is obsolete.
+		st.has_pending = false
+		return false
+	}
+	if l.MinInterval > 0 {
+		if wait := l.MinInterval - time.Since(st.sent); wait > 0 {
+			st.has_pending = true
+			st.pending = value
+			st.deferred = deferred
+			if st.timer == nil {
+				st.timer = time.AfterFunc(wait, func() { l.flush(dest) })
+			}
+			return false
+		}
+	}
+	st.value = value
+	st.sent = time.Now()
+	st.has_pending = false
+	return true
+}
+
+func (l *Limiter) flush(dest string) {
+	l.mutex.Lock()
+	st := l.destinations[dest]
+	st.timer = nil
+	if !st.has_pending {
+		l.mutex.Unlock()
+		return
+	}
+	value, deferred := st.pending, st.deferred
+	st.value = value
+	st.sent = time.Now()
+	st.has_pending = false
+	st.pending, st.deferred = nil, nil
+	l.mutex.Unlock()
+
+	deferred(value)
+}
@@ -0,0 +1,70 @@
+package helper
+
+import (
+	"errors"
+	"fmt"
+	"github.com/omzlo/nocanc/cmd/config"
+	"strings"
+)
+
+type mapping_errors []string
+
+// add records an error for the mapping at position index, counted from 1,
+// of the list named setting, found at line of the configuration file if line
+// is not 0.
+func (me *mapping_errors) add(setting string, index int, line int, what string, err error) {
+	if line > 0 {
+		*me = append(*me, fmt.Sprintf("line %d: %s #%d: %s: %s", line, setting, index+1, what, err))
+	} else {
+		*me = append(*me, fmt.Sprintf("%s #%d: %s: %s", setting, index+1, what, err))
+	}
+}
+
+// ValidateMappings checks the mqtt and blynk mappings of conf, returning an
+// error that lists every invalid mapping with its position in its list and
+// its line in the configuration file.
+func ValidateMappings(conf *config.Configuration) error {
+	var errs mapping_errors
+
+	for i, assoc := range conf.Mqtt.Publishers {
+		what := fmt.Sprintf("mqtt publisher for channel '%s'", assoc.Channel)
+		if err := assoc.Err(); err != nil {
+			errs.add("mqtt.publishers", i, assoc.Line(), what, err)
+		} else if assoc.Channel == "" {
+			errs.add("mqtt.publishers", i, assoc.Line(), what, errors.New("missing field 'channel'"))
+		} else if _, err := NewMqttPublisherRule(assoc); err != nil {
+			errs.add("mqtt.publishers", i, assoc.Line(), what, err)
+		}
+	}
+	for i, assoc := range conf.Mqtt.Subscribers {
+		what := fmt.Sprintf("mqtt subscriber for topic '%s'", assoc.Topic)
+		if err := assoc.Err(); err != nil {
+			errs.add("mqtt.subscribers", i, assoc.Line(), what, err)
+		} else if assoc.Topic == "" || assoc.Channel == "" {
+			errs.add("mqtt.subscribers", i, assoc.Line(), what, errors.New("both 'channel' and 'topic' are required"))
+		} else if _, err := NewMqttSubscriberRule(assoc); err != nil {
+			errs.add("mqtt.subscribers", i, assoc.Line(), what, err)
+		}
+	}
+	check_blynk := func(kind string, assocs config.BlynkMap) {
+		for i, assoc := range assocs {
+			what := fmt.Sprintf("blynk %s for pin %d", kind, assoc.Pin)
+			if err := assoc.Err(); err != nil {
+				errs.add("blynk."+kind+"s", i, assoc.Line(), what, err)
+			} else if assoc.Channel == "" {
+				errs.add("blynk."+kind+"s", i, assoc.Line(), what, errors.New("missing field 'channel'"))
+			} else if assoc.Pin > 255 {
+				errs.add("blynk."+kind+"s", i, assoc.Line(), what, errors.New("pin must be between 0 and 255"))
+			} else if _, err := NewBlynkRule(assoc); err != nil {
+				errs.add("blynk."+kind+"s", i, assoc.Line(), what, err)
+			}
+		}
+	}
+	check_blynk("reader", conf.Blynk.Readers)
+	check_blynk("writer", conf.Blynk.Writers)
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package helper
+
+import (
+	"github.com/omzlo/nocanc/cmd/config"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateMappings(t *testing.T) {
+	saved := config.Settings
+	defer func() { config.Settings = saved }()
+
+	path := filepath.Join(t.TempDir(), "nocanc.conf")
+	text := `[blynk]
+readers = "1::a"
+
+[[mqtt.publishers]]
+channel = "a"
+
+[[mqtt.publishers]]
+channel = "b"
+retain = "yes"
+
+[[mqtt.subscribers]]
+topic = "c"
+
+[[mqtt.publishers]]
+channel = "d"
+qos = 2
+`
+	if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatalf("Failed to write configuration: %s", err)
+	}
+	config.Settings = config.DefaultSettings
+	if _, err := config.LoadFile(path); err != nil {
+		t.Fatalf("LoadFile failed: %s", err)
+	}
+	// Mappings set by flags have no line.
+	config.Settings.Blynk.Writers.Set("300::d")
+
+	err := ValidateMappings(&config.Settings)
+	if err == nil {
+		t.Fatalf("ValidateMappings succeeded, expected an error")
+	}
+	expected := []string{
+		"line 7: mqtt.publishers #2: mqtt publisher for channel 'b': 'retain' must be a boolean",
+		"line 14: mqtt.publishers #3: mqtt publisher for channel 'd': MQTT QoS level 2 is not supported, 'qos' must be 0 or 1",
+		"line 11: mqtt.subscribers #1: mqtt subscriber for topic 'c': both 'channel' and 'topic' are required",
+		"blynk.writers #1: blynk writer for pin 300: pin must be between 0 and 255",
+	}
+	if err.Error() != strings.Join(expected, "\n") {
+		t.Errorf("ValidateMappings returned\n%s\nexpected\n%s", err, strings.Join(expected, "\n"))
+	}
+}
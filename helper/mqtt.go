@@ -0,0 +1,426 @@
+package helper
+
+import (
+	"fmt"
+	"github.com/omzlo/clog"
+	"github.com/omzlo/gomqtt-mini-client"
+	"github.com/omzlo/nocanc/cmd/config"
+	"github.com/omzlo/nocand/socket"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+const DEFAULT_MQTT_TRANSFORM = `{{ printf "%s" .Value }}`
+
+// ValidateTopicFilter checks that filter is a valid MQTT topic filter:
+// '+' must occupy an entire topic level, and '#' must occupy the last one.
+func ValidateTopicFilter(filter string) error {
+	if filter == "" {
+		return fmt.Errorf("MQTT topic filter cannot be empty")
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return fmt.Errorf("Invalid MQTT topic filter '%s': '#' must be the last topic level", filter)
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return fmt.Errorf("Invalid MQTT topic filter '%s': '+' must occupy an entire topic level", filter)
+		}
+	}
+	return nil
+}
+
+// IsTopicPattern returns true if filter contains MQTT wildcards.
+func IsTopicPattern(filter string) bool {
+	return strings.ContainsAny(filter, "+#")
+}
+
+// MatchTopic reports whether topic matches the MQTT topic filter, which may
+// contain '+' (single level) and '#' (multi-level) wildcards. It also returns
+// the topic levels captured by each wildcard, in order. The levels matched by
+// '#' are captured as a single string.
+//
+// As required by the MQTT specification, topics starting with '$' are not
+// matched by filters starting with a wildcard.
+func MatchTopic(filter string, topic string) ([]string, bool) {
+	var captures []string
+
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return nil, false
+	}
+
+	filter_levels := strings.Split(filter, "/")
+	topic_levels := strings.Split(topic, "/")
+	for i, level := range filter_levels {
+		if level == "#" {
+			// 'a/#' matches 'a' as well as 'a/b/c'.
+			if i < len(topic_levels) {
+				captures = append(captures, strings.Join(topic_levels[i:], "/"))
+			} else {
+				captures = append(captures, "")
+			}
+			return captures, true
+		}
+		if i >= len(topic_levels) {
+			return nil, false
+		}
+		if level == "+" {
+			captures = append(captures, topic_levels[i])
+		} else if level != topic_levels[i] {
+			return nil, false
+		}
+	}
+	if len(filter_levels) != len(topic_levels) {
+		return nil, false
+	}
+	return captures, true
+}
+
+// MqttConn wraps an MQTT client, adding QoS levels, retained messages and
+// connection supervision on top of the public API of the client. Its
+// Publish and Subscribe methods replace those of the client, which always
+// publish with QoS 1 and subscribe with QoS 0: since MqttConn allocates its
+// own packet identifiers, the methods of the client must not be used.
+//
+// The client performs the MQTT handshake itself and cannot register a last
+// will message, so the will passed to Close is published when the bridge
+// stops instead, and is not published if the bridge dies.
+type MqttConn struct {
+	*gomqtt_mini_client.MqttClient
+	// OnConnect is called each time the connection is established, in
+	// place of the callback of the client.
+	OnConnect func(*gomqtt_mini_client.MqttClient) error
+	// request_mutex serializes the requests that wait for an acknowledgment,
+	// since the client delivers all acknowledgments on a single queue.
+	request_mutex sync.Mutex
+	last_pid      uint16
+	// ready is set once the client is connected and cleared as soon as a
+	// request fails, sessions counts connections and closed is set by Close.
+	ready    int32
+	sessions int32
+	closed   int32
+}
+
+func NewMqttConn(client *gomqtt_mini_client.MqttClient) *MqttConn {
+	c := &MqttConn{MqttClient: client}
+	client.OnConnect = c.connected
+	return c
+}
+
+// connected is called by the client once it is connected, and all its
+// state is set up.
+func (c *MqttConn) connected(client *gomqtt_mini_client.MqttClient) error {
+	atomic.AddInt32(&c.sessions, 1)
+	atomic.StoreInt32(&c.ready, 1)
+	if c.OnConnect != nil {
+		return c.OnConnect(client)
+	}
+	return nil
+}
+
+// Connected returns true if the client is connected and no request failed
+// since.
+func (c *MqttConn) Connected() bool {
+	return atomic.LoadInt32(&c.ready) == 1
+}
+
+func (c *MqttConn) packet_identifier() uint16 {
+	c.last_pid++
+	if c.last_pid == 0 {
+		c.last_pid++
+	}
+	return c.last_pid
+}
+
+// fail disconnects the client after a failed request, so that Supervise
+// connects it again. It must be called with request_mutex held.
+func (c *MqttConn) fail(err error) {
+	if atomic.CompareAndSwapInt32(&c.ready, 1, 0) {
+		clog.Warning("Lost connection to MQTT server %s: %s", c.ServerURL.Host, err)
+		c.MqttClient.Disconnect()
+	}
+}
+
+// request sends m and waits for its acknowledgment of type ack, unless ack
+// is 0. A packet identifier is appended to the variable header of m if it
+// expects an acknowledgment.
+func (c *MqttConn) request(m *gomqtt_mini_client.MqttMessage, ack gomqtt_mini_client.MqttControlPacketType) (*gomqtt_mini_client.MqttMessage, error) {
+	var pid uint16
+
+	c.request_mutex.Lock()
+	defer c.request_mutex.Unlock()
+
+	if !c.Connected() {
+		return nil, fmt.Errorf("Not connected to MQTT server %s", c.ServerURL.Host)
+	}
+	if ack != 0 {
+		pid = c.packet_identifier()
+		m.VarHeader.AppendUint16(pid)
+	}
+	if err := c.SendMessage(m); err != nil {
+		c.fail(err)
+		return nil, err
+	}
+	if ack == 0 {
+		return nil, nil
+	}
+	// The reader of the client reports a lost connection as an error in
+	// place of the acknowledgment.
+	resp, err := c.ReceiveMessageWithPacketId(ack, pid)
+	if err != nil {
+		c.fail(err)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// MQTT_MAX_QOS is the highest QoS level supported by the MQTT client, which
+// cannot complete the PUBREC/PUBREL/PUBCOMP exchange of QoS 2.
+const MQTT_MAX_QOS = 1
+
+// Publications default to QoS 1 and subscriptions to QoS 0, as with
+// MqttClient.Publish and MqttClient.Subscribe.
+const (
+	MQTT_DEFAULT_PUBLISH_QOS   = 1
+	MQTT_DEFAULT_SUBSCRIBE_QOS = 0
+)
+
+func mqtt_rule_qos(assoc *config.MqttAssoc, default_qos byte) (byte, error) {
+	if assoc.Qos == nil {
+		return default_qos, nil
+	}
+	if *assoc.Qos > MQTT_MAX_QOS {
+		return 0, fmt.Errorf("MQTT QoS level %d is not supported, 'qos' must be 0 or 1", *assoc.Qos)
+	}
+	return *assoc.Qos, nil
+}
+
+// Publish publishes value to topic with the given QoS level (0 or 1) and
+// retain flag.
+func (c *MqttConn) Publish(topic string, value []byte, qos byte, retain bool) error {
+	if qos > MQTT_MAX_QOS {
+		return fmt.Errorf("Unsupported MQTT QoS level %d", qos)
+	}
+
+	m := gomqtt_mini_client.NewMqttMessage(gomqtt_mini_client.PUBLISH)
+	m.Qos = qos
+	m.Retain = retain
+	m.VarHeader.AppendString(topic)
+	m.Payload.AppendBytes(value)
+
+	var ack gomqtt_mini_client.MqttControlPacketType
+	if qos > 0 {
+		ack = gomqtt_mini_client.PUBACK
+	}
+	if _, err := c.request(m, ack); err != nil {
+		return fmt.Errorf("Failed to publish to %s: %s", topic, err)
+	}
+	return nil
+}
+
+// Subscribe subscribes to topic with the given maximum QoS level (0 or 1).
+func (c *MqttConn) Subscribe(topic string, qos byte) error {
+	if qos > MQTT_MAX_QOS {
+		return fmt.Errorf("Unsupported MQTT QoS level %d", qos)
+	}
+
+	m := gomqtt_mini_client.NewMqttMessage(gomqtt_mini_client.SUBSCRIBE)
+	m.Qos = 1 // SUBSCRIBE requires flags 0010
+	m.Payload.AppendString(topic).AppendUint8(qos)
+
+	resp, err := c.request(m, gomqtt_mini_client.SUBACK)
+	if err != nil {
+		return fmt.Errorf("Failed to subscribe to %s: %s", topic, err)
+	}
+	if len(resp.Payload.Data) > 0 && resp.Payload.Data[0] == 0x80 {
+		return fmt.Errorf("Subscription to %s was refused by the server", topic)
+	}
+	return nil
+}
+
+// Supervise keeps the client connected to its server, running the event
+// loop of the client, which sends keep-alive pings, and reconnecting with an
+// exponential backoff when the connection is lost. It returns once Close is
+// called.
+func (c *MqttConn) Supervise() {
+	backoff := 2 * time.Second
+
+	for {
+		sessions := atomic.LoadInt32(&c.sessions)
+		err := c.RunEventLoop()
+		atomic.StoreInt32(&c.ready, 0)
+		if atomic.LoadInt32(&c.closed) == 1 {
+			return
+		}
+		if atomic.LoadInt32(&c.sessions) != sessions {
+			backoff = 2 * time.Second
+		}
+		clog.Warning("Disconnected from MQTT server %s (%s), waiting %s to try again", c.ServerURL.Host, err, backoff)
+		time.Sleep(backoff)
+		if backoff < 64*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// Close publishes will, unless it is nil, and disconnects from the server
+// for good.
+func (c *MqttConn) Close(will *MqttPublication) {
+	if will != nil && c.Connected() {
+		if err := c.Publish(will.Topic, will.Payload, will.Qos, will.Retain); err != nil {
+			clog.Warning("%s", err)
+		}
+	}
+
+	c.request_mutex.Lock()
+	defer c.request_mutex.Unlock()
+
+	atomic.StoreInt32(&c.closed, 1)
+	if atomic.CompareAndSwapInt32(&c.ready, 1, 0) {
+		c.MqttClient.Disconnect()
+	}
+}
+
+// MqttSubscriberData is passed to the templates of subscriber rules.
+type MqttSubscriberData struct {
+	Topic    string
+	Value    Payload
+	Captures []string
+}
+
+// MqttSubscriberRule forwards messages published on MQTT topics matching
+// Filter to a NoCAN channel. Both the channel name and the transform are
+// templates, which have access to the topic levels captured by wildcards.
+type MqttSubscriberRule struct {
+	Filter    string
+	Qos       byte
+	Limiter   *Limiter
+	Channel   *template.Template
+	Transform *template.Template
+}
+
+func NewMqttSubscriberRule(assoc *config.MqttAssoc) (*MqttSubscriberRule, error) {
+	var err error
+
+	if err = ValidateTopicFilter(assoc.Topic); err != nil {
+		return nil, err
+	}
+	if assoc.Retain {
+		return nil, fmt.Errorf("The retain option of MQTT topic '%s' only applies to publications", assoc.Topic)
+	}
+	rule := &MqttSubscriberRule{Filter: assoc.Topic, Limiter: NewLimiter(assoc.ChangedOnly, time.Duration(assoc.MinInterval))}
+	if rule.Qos, err = mqtt_rule_qos(assoc, MQTT_DEFAULT_SUBSCRIBE_QOS); err != nil {
+		return nil, err
+	}
+	if rule.Channel, err = NewTemplate(assoc.Topic, assoc.Channel); err != nil {
+		return nil, fmt.Errorf("Invalid MQTT channel name for topic '%s' subscription, %s", assoc.Topic, err)
+	}
+	transform := assoc.Transform
+	if len(transform) == 0 {
+		transform = DEFAULT_MQTT_TRANSFORM
+	}
+	if rule.Transform, err = NewTemplate(assoc.Topic, transform); err != nil {
+		return nil, fmt.Errorf("Invalid MQTT transformation for topic '%s' subscription, %s", assoc.Topic, err)
+	}
+	return rule, nil
+}
+
+// Apply returns the name of the channel and the value to forward for a
+// message received on topic. It returns ok=false if topic does not match the rule.
+func (rule *MqttSubscriberRule) Apply(topic string, value []byte) (channel string, result []byte, ok bool, err error) {
+	captures, ok := MatchTopic(rule.Filter, topic)
+	if !ok {
+		return "", nil, false, nil
+	}
+	data := &MqttSubscriberData{Topic: topic, Value: value, Captures: captures}
+
+	name, err := ExecuteTemplate(rule.Channel, data)
+	if err != nil {
+		return "", nil, true, err
+	}
+	if len(name) == 0 {
+		return "", nil, true, fmt.Errorf("Empty channel name for topic '%s'", topic)
+	}
+	if result, err = ExecuteTemplate(rule.Transform, data); err != nil {
+		return "", nil, true, err
+	}
+	return string(name), result, true, nil
+}
+
+// MqttPublisherData is passed to the templates of publisher rules. It embeds
+// the channel update, so templates can use fields such as .ChannelName.
+type MqttPublisherData struct {
+	*socket.ChannelUpdateEvent
+	Value    Payload
+	Captures []string
+}
+
+// MqttPublisherRule forwards updates of the NoCAN channels matching Pattern
+// to an MQTT topic. Pattern uses the MQTT wildcard syntax, and '*' matches
+// all channels. The topic and the transform are templates.
+type MqttPublisherRule struct {
+	Pattern   string
+	Qos       byte
+	Retain    bool
+	Limiter   *Limiter
+	Topic     *template.Template
+	Transform *template.Template
+}
+
+func NewMqttPublisherRule(assoc *config.MqttAssoc) (*MqttPublisherRule, error) {
+	var err error
+
+	pattern := assoc.Channel
+	if pattern == "*" {
+		pattern = "#"
+	}
+	if err = ValidateTopicFilter(pattern); err != nil {
+		return nil, err
+	}
+	rule := &MqttPublisherRule{Pattern: pattern, Retain: assoc.Retain, Limiter: NewLimiter(assoc.ChangedOnly, time.Duration(assoc.MinInterval))}
+	if rule.Qos, err = mqtt_rule_qos(assoc, MQTT_DEFAULT_PUBLISH_QOS); err != nil {
+		return nil, err
+	}
+
+	topic := assoc.Topic
+	if IsTopicPattern(pattern) && topic == assoc.Channel {
+		// No topic was specified: publish each channel to the topic of the same name.
+		topic = "{{.ChannelName}}"
+	}
+	if rule.Topic, err = NewTemplate(assoc.Channel, topic); err != nil {
+		return nil, fmt.Errorf("Invalid MQTT topic for channel '%s' publications, %s", assoc.Channel, err)
+	}
+	transform := assoc.Transform
+	if len(transform) == 0 {
+		transform = DEFAULT_MQTT_TRANSFORM
+	}
+	if rule.Transform, err = NewTemplate(assoc.Channel, transform); err != nil {
+		return nil, fmt.Errorf("Invalid MQTT transformation for channel '%s' publications, %s", assoc.Channel, err)
+	}
+	return rule, nil
+}
+
+// Apply returns the topic and the value to publish for a channel update.
+// It returns ok=false if the channel does not match the rule.
+func (rule *MqttPublisherRule) Apply(cu *socket.ChannelUpdateEvent) (topic string, result []byte, ok bool, err error) {
+	captures, ok := MatchTopic(rule.Pattern, cu.ChannelName)
+	if !ok {
+		return "", nil, false, nil
+	}
+	data := &MqttPublisherData{ChannelUpdateEvent: cu, Value: Payload(cu.Value), Captures: captures}
+
+	name, err := ExecuteTemplate(rule.Topic, data)
+	if err != nil {
+		return "", nil, true, err
+	}
+	if len(name) == 0 || IsTopicPattern(string(name)) {
+		return "", nil, true, fmt.Errorf("Invalid MQTT topic '%s' for channel '%s'", name, cu.ChannelName)
+	}
+	if result, err = ExecuteTemplate(rule.Transform, data); err != nil {
+		return "", nil, true, err
+	}
+	return string(name), result, true, nil
+}
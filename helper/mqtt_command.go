@@ -0,0 +1,123 @@
+package helper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/omzlo/clog"
+	"strings"
+	"time"
+)
+
+const MQTT_COMMAND_TIMEOUT = 10 * time.Second
+
+// MqttCommands lets nocand be managed remotely through an MQTT server.
+// Requests are published under <prefix>/request and each response is
+// published under <prefix>/response with the same subtopic:
+//
+//	<prefix>/request/nodes             list nodes
+//	<prefix>/request/node/<id>         get the state of a node
+//	<prefix>/request/reboot/<id>       reboot a node, "force" as payload forces a reboot
+//	<prefix>/request/power             set bus power with "on" or "off" as payload,
+//	                                   or get the bus power status with an empty payload
+//	<prefix>/request/device            get device information
+//
+// A response is the JSON result of the request, or an ExtendedError.
+type MqttCommands struct {
+	Prefix string
+	Client *Client
+}
+
+func NewMqttCommands(prefix string, client *Client) *MqttCommands {
+	return &MqttCommands{Prefix: strings.TrimRight(prefix, "/"), Client: client}
+}
+
+// Filter returns the topic filter matching all requests.
+func (mc *MqttCommands) Filter() string {
+	return mc.Prefix + "/request/#"
+}
+
+// Handle performs the request published on topic and returns its response.
+// It returns false if topic is not a request topic.
+func (mc *MqttCommands) Handle(topic string, payload []byte) (*MqttPublication, bool) {
+	request := strings.TrimPrefix(topic, mc.Prefix+"/request/")
+	if request == topic || request == "" {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), MQTT_COMMAND_TIMEOUT)
+	defer cancel()
+
+	var response interface{}
+	result, xerr := mc.perform(ctx, strings.Split(request, "/"), strings.TrimSpace(string(payload)))
+	if xerr != nil {
+		clog.Warning("MQTT request '%s' failed: %s", request, xerr)
+		response = xerr
+	} else {
+		clog.Info("Performed MQTT request '%s'", request)
+		response = result
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		data, _ = json.Marshal(InternalServerError(err))
+	}
+	return &MqttPublication{Topic: mc.Prefix + "/response/" + request, Payload: data, Qos: 1}, true
+}
+
+func (mc *MqttCommands) perform(ctx context.Context, request []string, payload string) (interface{}, *ExtendedError) {
+	switch request[0] {
+	case "nodes":
+		if len(request) == 1 {
+			return mc.Client.ListNodes(ctx)
+		}
+	case "node":
+		if len(request) == 2 {
+			nodeId, err := parseNodeId(request[1])
+			if err != nil {
+				return nil, BadRequest(err)
+			}
+			return mc.Client.GetNode(ctx, nodeId)
+		}
+	case "reboot":
+		if len(request) == 2 {
+			nodeId, err := parseNodeId(request[1])
+			if err != nil {
+				return nil, BadRequest(err)
+			}
+			if payload != "" && payload != "force" {
+				return nil, BadRequest(fmt.Sprintf("Expected 'force' or an empty payload, got '%s'", payload))
+			}
+			if xerr := mc.Client.Reboot(ctx, nodeId, payload == "force"); xerr != nil {
+				return nil, xerr
+			}
+			return map[string]interface{}{"id": nodeId, "force": payload == "force"}, nil
+		}
+	case "power":
+		if len(request) == 1 {
+			switch payload {
+			case "":
+			case "on", "1":
+				if xerr := mc.Client.SetPower(ctx, true); xerr != nil {
+					return nil, xerr
+				}
+			case "off", "0":
+				if xerr := mc.Client.SetPower(ctx, false); xerr != nil {
+					return nil, xerr
+				}
+			default:
+				return nil, BadRequest(fmt.Sprintf("Expected 'on', 'off', '1', '0' or an empty payload, got '%s'", payload))
+			}
+			ps, xerr := mc.Client.PowerStatus(ctx)
+			if xerr != nil {
+				return nil, xerr
+			}
+			return ps.Status, nil
+		}
+	case "device":
+		if len(request) == 1 {
+			return mc.Client.DeviceInfo(ctx)
+		}
+	}
+	return nil, NotFound(fmt.Sprintf("Unknown request '%s'", strings.Join(request, "/")))
+}
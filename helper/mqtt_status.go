@@ -0,0 +1,121 @@
+package helper
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/omzlo/nocand/models/device"
+	"github.com/omzlo/nocand/socket"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MQTT_AVAILABLE     = "online"
+	MQTT_NOT_AVAILABLE = "offline"
+)
+
+// MqttAvailability returns the retained message announcing on topic whether
+// the MQTT bridge is available. The "offline" message is meant to be
+// published when the bridge stops.
+func MqttAvailability(topic string, available bool) *MqttPublication {
+	payload := MQTT_NOT_AVAILABLE
+	if available {
+		payload = MQTT_AVAILABLE
+	}
+	return &MqttPublication{Topic: topic, Payload: []byte(payload), Qos: 1, Retain: true}
+}
+
+// MqttStatus builds the retained JSON messages describing the state of the
+// NoCAN network under a topic prefix:
+//
+//	<prefix>/nocand      connection state between the bridge and nocand
+//	<prefix>/power       bus power status
+//	<prefix>/nodes/<id>  state of each node
+type MqttStatus struct {
+	Prefix      string
+	EventServer string
+	mutex       sync.Mutex
+	topics      []string
+	last        map[string]*MqttPublication
+}
+
+func NewMqttStatus(prefix string, event_server string) *MqttStatus {
+	return &MqttStatus{
+		Prefix:      strings.TrimRight(prefix, "/"),
+		EventServer: event_server,
+		last:        make(map[string]*MqttPublication),
+	}
+}
+
+func (ms *MqttStatus) message(subtopic string, v interface{}) *MqttPublication {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	m := &MqttPublication{Topic: ms.Prefix + "/" + subtopic, Payload: payload, Qos: 1, Retain: true}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if _, ok := ms.last[m.Topic]; !ok {
+		ms.topics = append(ms.topics, m.Topic)
+	}
+	ms.last[m.Topic] = m
+	return m
+}
+
+// Announce returns the last message published on each status topic, in the
+// order the topics first appeared. It is used when (re)connecting to the
+// MQTT server, since status changes are not published while disconnected.
+func (ms *MqttStatus) Announce() []*MqttPublication {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	messages := make([]*MqttPublication, 0, len(ms.topics))
+	for _, topic := range ms.topics {
+		messages = append(messages, ms.last[topic])
+	}
+	return messages
+}
+
+// Connection returns the message describing the state of the connection to nocand.
+func (ms *MqttStatus) Connection(connected bool) *MqttPublication {
+	return ms.message("nocand", &struct {
+		Connected   bool      `json:"connected"`
+		EventServer string    `json:"event_server"`
+		UpdatedAt   time.Time `json:"updated_at"`
+	}{connected, ms.EventServer, time.Now()})
+}
+
+func (ms *MqttStatus) power(ps *device.PowerStatus) *MqttPublication {
+	return ms.message("power", &struct {
+		*device.PowerStatus
+		Powered   bool      `json:"powered"`
+		Fault     bool      `json:"fault"`
+		UpdatedAt time.Time `json:"updated_at"`
+	}{ps, ps.Status&device.STATUS_POWERED != 0, ps.Status&device.STATUS_FAULT != 0, time.Now()})
+}
+
+func (ms *MqttStatus) node(nu *socket.NodeUpdateEvent) *MqttPublication {
+	return ms.message(fmt.Sprintf("nodes/%d", nu.NodeId), nu)
+}
+
+// HandleEvent returns the status messages to publish following an event
+// received from nocand.
+func (ms *MqttStatus) HandleEvent(e socket.Eventer) []*MqttPublication {
+	var messages []*MqttPublication
+
+	switch ev := e.(type) {
+	case *socket.BusPowerStatusUpdateEvent:
+		if ev.Status != nil {
+			messages = append(messages, ms.power(ev.Status))
+		}
+	case *socket.NodeListEvent:
+		for _, nu := range ev.Nodes {
+			messages = append(messages, ms.node(nu))
+		}
+	case *socket.NodeUpdateEvent:
+		messages = append(messages, ms.node(ev))
+	}
+	return messages
+}
@@ -0,0 +1,233 @@
+package helper
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/omzlo/gomqtt-mini-client"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValidateTopicFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		valid  bool
+	}{
+		{"nocan/temp", true},
+		{"nocan/+/temp", true},
+		{"nocan/#", true},
+		{"#", true},
+		{"+", true},
+		{"+/+/#", true},
+		{"/", true},
+		{"", false},
+		{"nocan/#/temp", false},
+		{"nocan/temp#", false},
+		{"nocan/te+mp", false},
+		{"nocan/++", false},
+		{"##", false},
+	}
+	for _, test := range tests {
+		err := ValidateTopicFilter(test.filter)
+		if (err == nil) != test.valid {
+			t.Errorf("ValidateTopicFilter(%q) returned %v, expected valid=%v", test.filter, err, test.valid)
+		}
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		filter   string
+		topic    string
+		match    bool
+		captures []string
+	}{
+		{"nocan/temp", "nocan/temp", true, nil},
+		{"nocan/temp", "nocan/humidity", false, nil},
+		{"nocan/temp", "nocan/temp/1", false, nil},
+		{"nocan/+", "nocan/temp", true, []string{"temp"}},
+		{"nocan/+", "nocan", false, nil},
+		{"nocan/+", "nocan/temp/1", false, nil},
+		{"nocan/+", "nocan/", true, []string{""}},
+		{"+/+/value", "nocan/temp/value", true, []string{"nocan", "temp"}},
+		{"+/+/value", "nocan/temp/status", false, nil},
+		{"nocan/#", "nocan/temp", true, []string{"temp"}},
+		{"nocan/#", "nocan/a/b/c", true, []string{"a/b/c"}},
+		{"nocan/#", "nocan", true, []string{""}},
+		{"nocan/#", "other/temp", false, nil},
+		{"nocan/+/#", "nocan/node/1/temp", true, []string{"node", "1/temp"}},
+		{"#", "nocan/temp", true, []string{"nocan/temp"}},
+		{"#", "$SYS/uptime", false, nil},
+		{"+/uptime", "$SYS/uptime", false, nil},
+		{"$SYS/#", "$SYS/uptime", true, []string{"uptime"}},
+	}
+	for _, test := range tests {
+		captures, ok := MatchTopic(test.filter, test.topic)
+		if ok != test.match {
+			t.Errorf("MatchTopic(%q, %q) returned %v, expected %v", test.filter, test.topic, ok, test.match)
+			continue
+		}
+		if ok && !reflect.DeepEqual(captures, test.captures) {
+			t.Errorf("MatchTopic(%q, %q) captured %q, expected %q", test.filter, test.topic, captures, test.captures)
+		}
+	}
+}
+
+// test_broker accepts MQTT connections, acknowledging each packet and
+// reporting the packets it receives, with their fixed header, on packets.
+type test_broker struct {
+	listener net.Listener
+	packets  chan []byte
+	conns    chan net.Conn
+}
+
+func new_test_broker(t *testing.T) *test_broker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	b := &test_broker{listener: listener, packets: make(chan []byte, 16), conns: make(chan net.Conn, 4)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			b.conns <- conn
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *test_broker) serve(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		head, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		length, err := gomqtt_mini_client.MqttReadLength(r)
+		if err != nil {
+			return
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+		packet := append([]byte{head}, body...)
+
+		var ack *gomqtt_mini_client.MqttMessage
+		switch gomqtt_mini_client.MqttControlPacketType(head & 0xF0) {
+		case gomqtt_mini_client.CONNECT:
+			ack = gomqtt_mini_client.NewMqttMessage(gomqtt_mini_client.CONNACK)
+			ack.VarHeader.AppendUint16(0)
+		case gomqtt_mini_client.PUBLISH:
+			if head&0x06 != 0 {
+				ack = gomqtt_mini_client.NewMqttMessage(gomqtt_mini_client.PUBACK)
+				topic_length := int(body[0])<<8 | int(body[1])
+				ack.VarHeader.AppendBytes(body[2+topic_length : 4+topic_length])
+			}
+		case gomqtt_mini_client.SUBSCRIBE:
+			ack = gomqtt_mini_client.NewMqttMessage(gomqtt_mini_client.SUBACK)
+			ack.VarHeader.AppendBytes(body[:2])
+			ack.Payload.AppendUint8(body[len(body)-1])
+		case gomqtt_mini_client.PINGREQ:
+			continue
+		}
+		b.packets <- packet
+		if ack != nil {
+			gomqtt_mini_client.MqttMessageWrite(conn, ack)
+		}
+	}
+}
+
+func (b *test_broker) expect(t *testing.T, what string, expected []byte) {
+	t.Helper()
+
+	select {
+	case packet := <-b.packets:
+		if !bytes.Equal(packet, expected) {
+			t.Errorf("%s: broker received % x, expected % x", what, packet, expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s: broker received nothing", what)
+	}
+}
+
+func TestMqttConn(t *testing.T) {
+	broker := new_test_broker(t)
+	defer broker.listener.Close()
+
+	client, err := gomqtt_mini_client.NewMqttClient("test", "mqtt://"+broker.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("NewMqttClient failed: %s", err)
+	}
+	conn := NewMqttConn(client)
+	connected := make(chan bool, 4)
+	conn.OnConnect = func(_ *gomqtt_mini_client.MqttClient) error {
+		connected <- true
+		return nil
+	}
+	wait_connection := func() {
+		t.Helper()
+		select {
+		case <-connected:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Client did not connect")
+		}
+	}
+	if err := conn.Connect(); err != nil {
+		t.Fatalf("Connect failed: %s", err)
+	}
+	go conn.Supervise()
+	wait_connection()
+	<-broker.packets // CONNECT
+
+	// Packet identifiers are allocated by MqttConn, from 1.
+	if err := conn.Publish("a", []byte("value"), 1, true); err != nil {
+		t.Fatalf("Publish failed: %s", err)
+	}
+	broker.expect(t, "qos 1", []byte("\x33\x00\x01a\x00\x01value"))
+	if err := conn.Publish("a", []byte("value"), 0, false); err != nil {
+		t.Fatalf("Publish failed: %s", err)
+	}
+	broker.expect(t, "qos 0", []byte("\x30\x00\x01avalue"))
+	if err := conn.Subscribe("b/#", 1); err != nil {
+		t.Fatalf("Subscribe failed: %s", err)
+	}
+	broker.expect(t, "subscribe", []byte("\x82\x00\x02\x00\x03b/#\x01"))
+	if err := conn.Publish("a", nil, 2, false); err == nil {
+		t.Errorf("Publishing with QoS 2 succeeded, expected an error")
+	}
+
+	// A request failing after the connection is lost makes Supervise connect
+	// again.
+	(<-broker.conns).Close()
+	for i := 0; conn.Connected(); i++ {
+		if i == 50 {
+			t.Fatalf("Connection loss was not detected")
+		}
+		conn.Publish("a", []byte("value"), 1, false)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := conn.Publish("a", []byte("value"), 1, false); err == nil {
+		t.Errorf("Publishing while disconnected succeeded, expected an error")
+	}
+	wait_connection()
+	<-broker.packets // CONNECT
+	if err := conn.Publish("a", []byte("value"), 1, false); err != nil {
+		t.Fatalf("Publish after reconnection failed: %s", err)
+	}
+	broker.expect(t, "after reconnection", []byte("\x32\x00\x01a\x00\x04value"))
+
+	// Close publishes the will, and stops Supervise.
+	conn.Close(&MqttPublication{Topic: "a", Payload: []byte("value"), Qos: 1, Retain: true})
+	broker.expect(t, "will", []byte("\x33\x00\x01a\x00\x05value"))
+	if conn.Connected() {
+		t.Errorf("Client is still connected after Close")
+	}
+}
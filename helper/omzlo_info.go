@@ -21,12 +21,12 @@ var LatestNews OmzloNews
 
 var http_client = &http.Client{Timeout: 10 * time.Second}
 
-func UpdateLatestNews(client_type string, version string, os string, arch string, deviceInfo **socket.DeviceInformationEvent) {
+func UpdateLatestNews(client_type string, version string, os string, arch string, deviceInfo func() *socket.DeviceInformationEvent) {
 	var chip_id string
 
 	for {
-		if *deviceInfo != nil {
-			chip_id = base64.StdEncoding.EncodeToString((*deviceInfo).Information.ChipId[:])
+		if di := deviceInfo(); di != nil {
+			chip_id = base64.StdEncoding.EncodeToString(di.Information.ChipId[:])
 			break
 		}
 		time.Sleep(10 * time.Second)
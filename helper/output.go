@@ -0,0 +1,150 @@
+package helper
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/omzlo/nocanc/cmd/config"
+	"github.com/omzlo/nocand/socket"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EventRecord wraps an event received from nocand with the time it was
+// received, as emitted by the monitor command.
+type EventRecord struct {
+	ReceivedAt time.Time      `json:"received_at"`
+	EventId    socket.EventId `json:"event_id"`
+	Event      string         `json:"event"`
+	Data       socket.Eventer `json:"data"`
+}
+
+func NewEventRecord(e socket.Eventer) *EventRecord {
+	return &EventRecord{
+		ReceivedAt: time.Now(),
+		EventId:    e.Id(),
+		Event:      e.Id().String(),
+		Data:       e,
+	}
+}
+
+// OutputWriter emits structured records in one of the formats described by
+// config.OutputFormat. The text format is handled by callers, since each
+// command has its own historical text layout.
+type OutputWriter struct {
+	Format    config.OutputFormat
+	w         io.Writer
+	csv       *csv.Writer
+	csvHeader bool
+}
+
+func NewOutputWriter(w io.Writer, format config.OutputFormat) *OutputWriter {
+	return &OutputWriter{Format: format, w: w, csv: csv.NewWriter(w)}
+}
+
+// WriteRecords writes a collection of records: a JSON array in json format,
+// one JSON object per line in ndjson format, or a header line followed by
+// one row per record in csv format.
+func (ow *OutputWriter) WriteRecords(records []interface{}) error {
+	if ow.Format == config.OutputJson {
+		if records == nil {
+			records = make([]interface{}, 0)
+		}
+		return ow.writeJson(records, true)
+	}
+	for _, record := range records {
+		if err := ow.WriteRecord(record); err != nil {
+			return err
+		}
+	}
+	return ow.Flush()
+}
+
+// WriteRecord writes a single record.
+func (ow *OutputWriter) WriteRecord(record interface{}) error {
+	switch ow.Format {
+	case config.OutputJson:
+		return ow.writeJson(record, true)
+	case config.OutputNdjson:
+		return ow.writeJson(record, false)
+	case config.OutputCsv:
+		header, values, err := CsvFields(record)
+		if err != nil {
+			return err
+		}
+		if !ow.csvHeader {
+			if err := ow.csv.Write(header); err != nil {
+				return err
+			}
+			ow.csvHeader = true
+		}
+		return ow.csv.Write(values)
+	}
+	_, err := fmt.Fprintln(ow.w, record)
+	return err
+}
+
+// StreamRecord writes a record and flushes it immediately, using ndjson
+// in place of json so that each event stays on a single line.
+func (ow *OutputWriter) StreamRecord(record interface{}) error {
+	if ow.Format == config.OutputJson {
+		return ow.writeJson(record, false)
+	}
+	if err := ow.WriteRecord(record); err != nil {
+		return err
+	}
+	return ow.Flush()
+}
+
+func (ow *OutputWriter) Flush() error {
+	ow.csv.Flush()
+	return ow.csv.Error()
+}
+
+func (ow *OutputWriter) writeJson(v interface{}, indent bool) error {
+	var b []byte
+	var err error
+
+	if indent {
+		b, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		b, err = json.Marshal(v)
+	}
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	_, err = ow.w.Write(b)
+	return err
+}
+
+// CsvFields returns the column names and values used to represent record as
+// a CSV row.
+func CsvFields(record interface{}) ([]string, []string, error) {
+	switch r := record.(type) {
+	case *socket.NodeUpdateEvent:
+		return []string{"id", "udid", "state", "last_seen"},
+			[]string{strconv.Itoa(int(r.NodeId)), r.Udid.String(), r.State.String(), r.LastSeen.Format(time.RFC3339Nano)}, nil
+	case *socket.ChannelUpdateEvent:
+		return []string{"id", "name", "status", "value", "updated_at"},
+			[]string{strconv.Itoa(int(r.ChannelId)), r.ChannelName, r.Status.String(), string(r.Value), r.UpdatedAt.Format(time.RFC3339Nano)}, nil
+	case *socket.DeviceInformationEvent:
+		di := r.Information
+		return []string{"type", "signature", "version_major", "version_minor", "chip_id"},
+			[]string{strings.TrimRight(string(di.Type[:]), "\x00"), string(di.Signature[:]), strconv.Itoa(int(di.VersionMajor)), strconv.Itoa(int(di.VersionMinor)), hex.EncodeToString(di.ChipId[:])}, nil
+	case *socket.BusPowerStatusUpdateEvent:
+		ps := r.Status
+		return []string{"status", "voltage", "current_sense", "reference_voltage"},
+			[]string{ps.Status.String(), strconv.FormatFloat(float64(ps.Voltage), 'f', 2, 32), strconv.Itoa(int(ps.CurrentSense)), strconv.FormatFloat(float64(ps.RefLevel), 'f', 2, 32)}, nil
+	case *RolloutResult:
+		return []string{"id", "udid", "status", "attempts", "duration", "error"},
+			[]string{strconv.Itoa(int(r.NodeId)), r.Udid.String(), r.Status.String(), strconv.Itoa(r.Attempts), strconv.FormatFloat(r.Duration.Seconds(), 'f', 1, 64), r.ErrorString()}, nil
+	case *EventRecord:
+		return []string{"received_at", "event_id", "event", "data"},
+			[]string{r.ReceivedAt.Format(time.RFC3339Nano), strconv.Itoa(int(r.EventId)), r.Event, r.Data.String()}, nil
+	}
+	return nil, nil, fmt.Errorf("Records of type %T cannot be represented in CSV", record)
+}
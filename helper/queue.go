@@ -0,0 +1,212 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/omzlo/clog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// QueuedMessage is a message held in an OfflineQueue. Topic is an MQTT
+// topic or a NoCAN channel name, depending on the direction of the queue,
+// and Origin is the channel name or MQTT topic the message came from.
+type QueuedMessage struct {
+	QueuedAt time.Time `json:"queued_at"`
+	Topic    string    `json:"topic"`
+	Origin   string    `json:"origin,omitempty"`
+	Payload  []byte    `json:"payload"`
+	Qos      byte      `json:"qos,omitempty"`
+	Retain   bool      `json:"retain,omitempty"`
+}
+
+// OfflineQueue holds messages that cannot be delivered while a connection
+// is down, so that they can be replayed in order once it is restored.
+// The queue holds at most MaxSize messages, and messages older than MaxAge
+// are dropped. If a file name is provided, each queued message is appended
+// to that file as a line of JSON, and the file is rewritten with the messages
+// left in the queue after a replay, or when it holds twice MaxSize messages.
+// The file is reloaded when the queue is created.
+type OfflineQueue struct {
+	Name     string
+	MaxSize  int
+	MaxAge   time.Duration
+	path     string
+	log      *os.File
+	logged   int
+	mutex    sync.Mutex
+	messages []*QueuedMessage
+}
+
+func NewOfflineQueue(name string, max_size int, max_age time.Duration, path string) (*OfflineQueue, error) {
+	q := &OfflineQueue{Name: name, MaxSize: max_size, MaxAge: max_age, path: path}
+
+	if path == "" {
+		return q, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		// Queues used to be saved as a single JSON array.
+		if err = json.Unmarshal(data, &q.messages); err != nil {
+			return nil, err
+		}
+	} else {
+		for i, line := range bytes.Split(data, []byte("\n")) {
+			var m QueuedMessage
+
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			// The last line may be incomplete after a crash.
+			if err := json.Unmarshal(line, &m); err != nil {
+				clog.Warning("Ignoring invalid message on line %d of %s: %s", i+1, path, err)
+				continue
+			}
+			q.messages = append(q.messages, &m)
+		}
+	}
+	q.expire()
+	q.trim()
+	q.compact()
+	if len(q.messages) > 0 {
+		clog.Info("Loaded %d messages in %s queue from %s", len(q.messages), q.Name, path)
+	}
+	return q, nil
+}
+
+func (q *OfflineQueue) drop(m *QueuedMessage, reason string) {
+	clog.Warning("Dropped %d byte message for '%s' queued at %s from %s queue: %s", len(m.Payload), m.Topic, m.QueuedAt.Format(time.RFC3339), q.Name, reason)
+}
+
+func (q *OfflineQueue) expire() {
+	if q.MaxAge <= 0 {
+		return
+	}
+	i := 0
+	for i < len(q.messages) && time.Since(q.messages[i].QueuedAt) > q.MaxAge {
+		q.drop(q.messages[i], "message expired")
+		i++
+	}
+	q.messages = q.messages[i:]
+}
+
+func (q *OfflineQueue) trim() {
+	for len(q.messages) > q.MaxSize {
+		q.drop(q.messages[0], "queue is full")
+		q.messages = q.messages[1:]
+	}
+}
+
+// compact rewrites the queue file with the messages left in the queue.
+func (q *OfflineQueue) compact() {
+	var buf bytes.Buffer
+
+	if q.path == "" {
+		return
+	}
+	if q.log != nil {
+		q.log.Close()
+		q.log = nil
+	}
+	encoder := json.NewEncoder(&buf)
+	for _, m := range q.messages {
+		encoder.Encode(m)
+	}
+	tmp := q.path + ".tmp"
+	err := ioutil.WriteFile(tmp, buf.Bytes(), 0600)
+	if err == nil {
+		err = os.Rename(tmp, q.path)
+	}
+	if err != nil {
+		clog.Warning("Failed to save %s queue to %s: %s", q.Name, q.path, err)
+		return
+	}
+	q.logged = len(q.messages)
+}
+
+// append adds m at the end of the queue file, compacting the file instead
+// if it holds too many messages that were dropped from the queue.
+func (q *OfflineQueue) append(m *QueuedMessage) {
+	if q.path == "" {
+		return
+	}
+	if q.logged >= 2*q.MaxSize {
+		q.compact()
+		return
+	}
+	data, err := json.Marshal(m)
+	if err == nil && q.log == nil {
+		q.log, err = os.OpenFile(q.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	}
+	if err == nil {
+		_, err = q.log.Write(append(data, '\n'))
+	}
+	if err != nil {
+		clog.Warning("Failed to save message to %s queue in %s: %s", q.Name, q.path, err)
+		return
+	}
+	q.logged++
+}
+
+// Push adds a message at the end of the queue, dropping the oldest messages
+// if the queue is full.
+func (q *OfflineQueue) Push(topic string, payload []byte, qos byte, retain bool, origin string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	m := &QueuedMessage{QueuedAt: time.Now(), Topic: topic, Origin: origin, Payload: payload, Qos: qos, Retain: retain}
+	q.messages = append(q.messages, m)
+	q.expire()
+	q.trim()
+	q.append(m)
+}
+
+// Replay calls send for each message in the queue, in order, dropping
+// expired messages. It stops at the first error returned by send, keeping
+// the failed message and all the following ones in the queue.
+func (q *OfflineQueue) Replay(send func(*QueuedMessage) error) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.expire()
+	if len(q.messages) == 0 {
+		return nil
+	}
+	defer q.compact()
+
+	count := len(q.messages)
+	for len(q.messages) > 0 {
+		if err := send(q.messages[0]); err != nil {
+			clog.Warning("Stopped replaying %s queue, %d messages remain queued: %s", q.Name, len(q.messages), err)
+			return err
+		}
+		q.messages = q.messages[1:]
+	}
+	clog.Info("Replayed %d messages from %s queue", count, q.Name)
+	return nil
+}
+
+func (q *OfflineQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.messages)
+}
+
+// QueueFile returns the file used to persist a queue in directory dir, or
+// an empty string if dir is empty.
+func QueueFile(dir string, name string) string {
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, name+".json")
+}
@@ -0,0 +1,280 @@
+package helper
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocanc/intelhex"
+	"github.com/omzlo/nocand/models"
+	"github.com/omzlo/nocand/models/nocan"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ParseNodeIdList parses node identifiers expressed as comma separated lists
+// of single identifiers or ranges, such as "1,3-12,15".
+func ParseNodeIdList(specs []string) ([]nocan.NodeId, error) {
+	var nodes []nocan.NodeId
+
+	seen := make(map[nocan.NodeId]bool)
+	for _, spec := range specs {
+		for _, item := range strings.Split(spec, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			first, last := item, item
+			if i := strings.Index(item, "-"); i > 0 {
+				first, last = item[:i], item[i+1:]
+			}
+			from, err := parseNodeId(first)
+			if err != nil {
+				return nil, err
+			}
+			to, err := parseNodeId(last)
+			if err != nil {
+				return nil, err
+			}
+			if to < from {
+				return nil, fmt.Errorf("Invalid node range '%s'", item)
+			}
+			for id := from; id <= to; id++ {
+				if !seen[id] {
+					seen[id] = true
+					nodes = append(nodes, id)
+				}
+			}
+		}
+	}
+	return nodes, nil
+}
+
+func parseNodeId(s string) (nocan.NodeId, error) {
+	id, err := strconv.ParseUint(s, 0, 8)
+	if err != nil || id < 1 || id > 127 {
+		return 0, fmt.Errorf("Node id must be a number between 1 and 127 included, got '%s'", s)
+	}
+	return nocan.NodeId(id), nil
+}
+
+// ParseUdid parses a node UDID written as 8 hex bytes, optionally separated by ':'.
+func ParseUdid(s string) (models.Udid8, error) {
+	var udid models.Udid8
+
+	b, err := hex.DecodeString(strings.Replace(s, ":", "", -1))
+	if err != nil || len(b) != len(udid) {
+		return udid, fmt.Errorf("Invalid node UDID '%s'", s)
+	}
+	copy(udid[:], b)
+	return udid, nil
+}
+
+// LoadUdidManifest reads a list of node UDIDs, one per line. Empty lines and
+// lines starting with '#' are ignored.
+func LoadUdidManifest(r io.Reader) ([]models.Udid8, error) {
+	var udids []models.Udid8
+
+	line_count := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line_count++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		udid, err := ParseUdid(strings.Fields(line)[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s on line %d", err.Error(), line_count)
+		}
+		udids = append(udids, udid)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return udids, nil
+}
+
+// RolloutStatus describes the outcome of a firmware upload to a node during a rollout.
+type RolloutStatus uint
+
+const (
+	ROLLOUT_PENDING RolloutStatus = iota
+	ROLLOUT_SUCCESS
+	ROLLOUT_FAILED
+	ROLLOUT_SKIPPED
+)
+
+var rolloutStatusStrings = [...]string{"pending", "success", "failed", "skipped"}
+
+func (rs RolloutStatus) String() string {
+	if int(rs) < len(rolloutStatusStrings) {
+		return rolloutStatusStrings[rs]
+	}
+	return "unknown"
+}
+
+func (rs RolloutStatus) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + rs.String() + `"`), nil
+}
+
+type RolloutResult struct {
+	NodeId   nocan.NodeId
+	Udid     models.Udid8
+	Status   RolloutStatus
+	Attempts int
+	Duration time.Duration
+	Job      *Job
+	Error    error
+}
+
+func (rr *RolloutResult) ErrorString() string {
+	if rr.Error == nil {
+		return ""
+	}
+	return rr.Error.Error()
+}
+
+func (rr *RolloutResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		NodeId   nocan.NodeId  `json:"id"`
+		Udid     models.Udid8  `json:"udid"`
+		Status   RolloutStatus `json:"status"`
+		Attempts int           `json:"attempts"`
+		Duration float64       `json:"duration"`
+		Error    string        `json:"error,omitempty"`
+	}{
+		NodeId:   rr.NodeId,
+		Udid:     rr.Udid,
+		Status:   rr.Status,
+		Attempts: rr.Attempts,
+		Duration: rr.Duration.Seconds(),
+		Error:    rr.ErrorString(),
+	})
+}
+
+// Rollout uploads the same firmware to a list of nodes.
+type Rollout struct {
+	Client        *Client
+	Firmware      *intelhex.IntelHex
+	Parallelism   int
+	Retries       int
+	Backoff       time.Duration
+	StopOnFailure bool
+	Timeout       time.Duration
+	// OnUpdate, if not nil, is called each time the result of a node changes.
+	OnUpdate func(*RolloutResult)
+}
+
+func NewRollout(client *Client, firmware *intelhex.IntelHex) *Rollout {
+	return &Rollout{
+		Client:      client,
+		Firmware:    firmware,
+		Parallelism: 1,
+		Retries:     DefaultRetryPolicy().Retries,
+		Backoff:     DefaultRetryPolicy().Backoff,
+		Timeout:     60 * time.Second,
+	}
+}
+
+// Run uploads the firmware to each node in results, updating each result
+// as uploads complete. Each upload is tracked as a job of DefaultJobManager.
+func (ro *Rollout) Run(ctx context.Context, results []*RolloutResult) {
+	var wg sync.WaitGroup
+
+	StartDefaultJobManager()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	parallelism := ro.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	slots := make(chan struct{}, parallelism)
+
+	for _, result := range results {
+		slots <- struct{}{}
+		if ctx.Err() != nil {
+			<-slots
+			break
+		}
+		wg.Add(1)
+		go func(result *RolloutResult) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if !ro.upload(ctx, result) && ro.StopOnFailure {
+				cancel()
+			}
+		}(result)
+	}
+	wg.Wait()
+
+	for _, result := range results {
+		if result.Status == ROLLOUT_PENDING {
+			result.Status = ROLLOUT_SKIPPED
+			ro.notify(result)
+		}
+	}
+}
+
+func (ro *Rollout) upload(ctx context.Context, result *RolloutResult) bool {
+	start := time.Now()
+
+	policy := RetryPolicy{Retries: ro.Retries, Backoff: ro.Backoff}
+	upload := NewFirmwareUpload(result.NodeId, ro.Firmware)
+	result.Job = DefaultJobManager.NewJob(nil)
+	for result.Attempts <= ro.Retries {
+		if result.Attempts > 0 {
+			delay := policy.Delay(result.Attempts)
+			if upload.Resume {
+				clog.Warning("Resuming upload to node %d with %d bytes left in %s (attempt %d of %d)", result.NodeId, upload.Remaining(), delay, result.Attempts+1, ro.Retries+1)
+			} else {
+				clog.Warning("Retrying upload to node %d in %s (attempt %d of %d)", result.NodeId, delay, result.Attempts+1, ro.Retries+1)
+			}
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			if result.Attempts == 0 {
+				return false
+			}
+			break
+		}
+		if result.Attempts > 0 {
+			result.Job.Restart()
+		}
+		result.Attempts++
+
+		uctx, cancel := context.WithTimeout(ctx, ro.Timeout)
+		err := ro.Client.ResumeUpload(uctx, upload, result.Job)
+		cancel()
+
+		result.Duration = time.Since(start)
+		if err == nil {
+			result.Status = ROLLOUT_SUCCESS
+			result.Error = nil
+			ro.notify(result)
+			return true
+		}
+		result.Error = err
+		clog.Warning("Upload to node %d failed: %s", result.NodeId, err)
+	}
+	result.Job.Fail(result.Error)
+	result.Status = ROLLOUT_FAILED
+	ro.notify(result)
+	return false
+}
+
+func (ro *Rollout) notify(result *RolloutResult) {
+	if ro.OnUpdate != nil {
+		ro.OnUpdate(result)
+	}
+}
@@ -0,0 +1,472 @@
+package helper
+
+import (
+	"fmt"
+	"github.com/omzlo/nocanc/cmd/config"
+	"github.com/omzlo/nocanc/sparkplug"
+	"github.com/omzlo/nocand/models"
+	"github.com/omzlo/nocand/models/nocan"
+	"github.com/omzlo/nocand/socket"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SPARKPLUG_DEVICE_NAME = "node-%d"
+	SPARKPLUG_REBIRTH     = "Node Control/Rebirth"
+)
+
+// SparkplugWrite is a channel update requested through a Sparkplug command.
+type SparkplugWrite struct {
+	Channel string
+	Value   []byte
+}
+
+type sparkplug_device struct {
+	id       string
+	node     nocan.NodeId
+	channels []string
+	state    models.NodeState
+	born     bool
+	metrics  map[string]bool
+}
+
+// SparkplugEdge models nocand as a Sparkplug B edge node and each NoCAN node
+// as a device of that edge node. Channels are metrics of the device they are
+// assigned to in the configuration, or of the edge node itself.
+//
+// Births are only published once Birth() is called, each time the MQTT
+// connection is established. Afterwards, HandleEvent turns nocand events
+// into data, birth and death messages.
+type SparkplugEdge struct {
+	Group    string
+	EdgeNode string
+	numeric  []string
+	mutex    sync.Mutex
+	// bd_seq is the birth/death sequence number of the current session,
+	// next_bd_seq the one of the next session.
+	bd_seq      uint64
+	next_bd_seq uint64
+	seq         uint64
+	born        bool
+	will        *MqttPublication
+	channels    map[string]*socket.ChannelUpdateEvent
+	metrics     map[string]bool
+	devices     map[nocan.NodeId]*sparkplug_device
+}
+
+// NewSparkplugEdge creates an edge node. The values of channels whose name
+// matches one of the numeric patterns (see path.Match) are published as
+// doubles, other values as strings.
+func NewSparkplugEdge(conf *config.MqttConfiguration, numeric []string) (*SparkplugEdge, error) {
+	if err := sparkplug.ValidateId(conf.SparkplugGroup); err != nil {
+		return nil, err
+	}
+	if err := sparkplug.ValidateId(conf.SparkplugEdgeNode); err != nil {
+		return nil, err
+	}
+	edge := &SparkplugEdge{
+		Group:    conf.SparkplugGroup,
+		EdgeNode: conf.SparkplugEdgeNode,
+		numeric:  numeric,
+		channels: make(map[string]*socket.ChannelUpdateEvent),
+		metrics:  make(map[string]bool),
+		devices:  make(map[nocan.NodeId]*sparkplug_device),
+	}
+
+	names := make(map[string]bool)
+	for i, dev := range conf.SparkplugDevices {
+		if dev.Node < 1 || dev.Node > 127 {
+			return nil, fmt.Errorf("Sparkplug device %d: node id must be between 1 and 127, got %d", i+1, dev.Node)
+		}
+		d := edge.device(nocan.NodeId(dev.Node))
+		if dev.Name != "" {
+			if err := sparkplug.ValidateId(dev.Name); err != nil {
+				return nil, err
+			}
+			d.id = dev.Name
+		}
+		if names[d.id] {
+			return nil, fmt.Errorf("Sparkplug device %d: duplicate device id '%s'", i+1, d.id)
+		}
+		names[d.id] = true
+		for _, pattern := range dev.Channels {
+			if err := ValidateTopicFilter(pattern); err != nil {
+				return nil, fmt.Errorf("Sparkplug device '%s': %s", d.id, err)
+			}
+			d.channels = append(d.channels, pattern)
+		}
+	}
+
+	edge.will = &MqttPublication{Topic: edge.topic(sparkplug.NDEATH, ""), Qos: 1}
+	edge.set_will()
+	return edge, nil
+}
+
+func (edge *SparkplugEdge) topic(message_type string, device string) string {
+	t := sparkplug.Topic{Group: edge.Group, MessageType: message_type, EdgeNode: edge.EdgeNode, Device: device}
+	return t.String()
+}
+
+// Filters returns the topic filters of the commands sent to the edge node and its devices.
+func (edge *SparkplugEdge) Filters() []string {
+	return []string{edge.topic(sparkplug.NCMD, ""), edge.topic(sparkplug.DCMD, "+")}
+}
+
+// Will returns the NDEATH message of the current session, to be published
+// when the edge node stops.
+func (edge *SparkplugEdge) Will() *MqttPublication {
+	edge.mutex.Lock()
+	defer edge.mutex.Unlock()
+
+	will := *edge.will
+	return &will
+}
+
+func (edge *SparkplugEdge) set_will() {
+	p := &sparkplug.Payload{
+		Timestamp: sparkplug_time(time.Now()),
+		Metrics:   []*sparkplug.Metric{{Name: "bdSeq", DataType: sparkplug.UInt64, Value: edge.bd_seq}},
+	}
+	edge.will.Payload, _ = p.Marshal()
+}
+
+func (edge *SparkplugEdge) device(node nocan.NodeId) *sparkplug_device {
+	d, ok := edge.devices[node]
+	if !ok {
+		d = &sparkplug_device{id: fmt.Sprintf(SPARKPLUG_DEVICE_NAME, node), node: node, metrics: make(map[string]bool)}
+		edge.devices[node] = d
+	}
+	return d
+}
+
+// device_of returns the device a channel is assigned to, or nil if the
+// channel belongs to the edge node.
+func (edge *SparkplugEdge) device_of(channel string) *sparkplug_device {
+	for _, d := range edge.sorted_devices() {
+		for _, pattern := range d.channels {
+			if _, ok := MatchTopic(pattern, channel); ok {
+				return d
+			}
+		}
+	}
+	return nil
+}
+
+func (edge *SparkplugEdge) sorted_devices() []*sparkplug_device {
+	devices := make([]*sparkplug_device, 0, len(edge.devices))
+	for _, d := range edge.devices {
+		devices = append(devices, d)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].node < devices[j].node })
+	return devices
+}
+
+func sparkplug_time(t time.Time) uint64 {
+	return uint64(t.UnixNano() / int64(time.Millisecond))
+}
+
+func sparkplug_alive(state models.NodeState) bool {
+	switch state {
+	case models.NodeStateConnecting, models.NodeStateConnected, models.NodeStateBootloader, models.NodeStateRunning, models.NodeStateProgramming:
+		return true
+	}
+	return false
+}
+
+func (edge *SparkplugEdge) is_numeric(channel string) bool {
+	for _, pattern := range edge.numeric {
+		if ok, _ := path.Match(pattern, channel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (edge *SparkplugEdge) channel_metric(cu *socket.ChannelUpdateEvent) *sparkplug.Metric {
+	m := &sparkplug.Metric{Name: cu.ChannelName, Timestamp: sparkplug_time(cu.UpdatedAt)}
+	if edge.is_numeric(cu.ChannelName) {
+		m.DataType = sparkplug.Double
+		v, err := strconv.ParseFloat(strings.TrimSpace(string(cu.Value)), 64)
+		if err != nil {
+			m.IsNull = true
+		} else {
+			m.Value = v
+		}
+	} else {
+		m.DataType = sparkplug.String
+		m.Value = strings.ToValidUTF8(string(cu.Value), "\uFFFD")
+	}
+	return m
+}
+
+// channel_metrics returns the metrics of the channels of d, or of the edge
+// node if d is nil, recording their names in metrics.
+func (edge *SparkplugEdge) channel_metrics(d *sparkplug_device, metrics map[string]bool) []*sparkplug.Metric {
+	var result []*sparkplug.Metric
+
+	names := make([]string, 0, len(edge.channels))
+	for name := range edge.channels {
+		if edge.device_of(name) == d {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		metrics[name] = true
+		result = append(result, edge.channel_metric(edge.channels[name]))
+	}
+	return result
+}
+
+func (edge *SparkplugEdge) message(message_type string, device string, metrics []*sparkplug.Metric) *MqttPublication {
+	seq := edge.seq
+	edge.seq = (edge.seq + 1) % 256
+
+	p := &sparkplug.Payload{Timestamp: sparkplug_time(time.Now()), Metrics: metrics, Seq: &seq}
+	payload, err := p.Marshal()
+	if err != nil {
+		return nil
+	}
+	return &MqttPublication{Topic: edge.topic(message_type, device), Payload: payload, Qos: 0}
+}
+
+func (edge *SparkplugEdge) node_birth() []*MqttPublication {
+	edge.seq = 0
+	edge.born = true
+	edge.metrics = make(map[string]bool)
+
+	metrics := []*sparkplug.Metric{
+		{Name: "bdSeq", DataType: sparkplug.UInt64, Value: edge.bd_seq},
+		{Name: SPARKPLUG_REBIRTH, DataType: sparkplug.Boolean, Value: false},
+	}
+	metrics = append(metrics, edge.channel_metrics(nil, edge.metrics)...)
+	messages := []*MqttPublication{edge.message(sparkplug.NBIRTH, "", metrics)}
+
+	// All devices must be born again after the edge node.
+	for _, d := range edge.sorted_devices() {
+		d.born = false
+		if sparkplug_alive(d.state) {
+			messages = append(messages, edge.device_birth(d))
+		}
+	}
+	return messages
+}
+
+func (edge *SparkplugEdge) device_birth(d *sparkplug_device) *MqttPublication {
+	d.born = true
+	d.metrics = make(map[string]bool)
+
+	metrics := []*sparkplug.Metric{
+		{Name: "Node/Id", DataType: sparkplug.UInt8, Value: uint64(d.node)},
+		{Name: "Node/State", DataType: sparkplug.String, Value: d.state.String()},
+	}
+	metrics = append(metrics, edge.channel_metrics(d, d.metrics)...)
+	return edge.message(sparkplug.DBIRTH, d.id, metrics)
+}
+
+func (edge *SparkplugEdge) device_death(d *sparkplug_device) *MqttPublication {
+	d.born = false
+	return edge.message(sparkplug.DDEATH, d.id, nil)
+}
+
+// Birth returns the NBIRTH message followed by a DBIRTH message for each
+// node, to be published each time the MQTT connection is established.
+func (edge *SparkplugEdge) Birth() []*MqttPublication {
+	edge.mutex.Lock()
+	defer edge.mutex.Unlock()
+
+	// Each connection starts a new session, ended by its own death certificate.
+	edge.bd_seq = edge.next_bd_seq
+	edge.next_bd_seq = (edge.next_bd_seq + 1) % 256
+	edge.set_will()
+	return edge.node_birth()
+}
+
+func (edge *SparkplugEdge) update_channel(cu *socket.ChannelUpdateEvent) []*MqttPublication {
+	if cu.Status != socket.CHANNEL_UPDATED || len(cu.Value) == 0 {
+		return nil
+	}
+	edge.channels[cu.ChannelName] = cu
+	if !edge.born {
+		return nil
+	}
+
+	d := edge.device_of(cu.ChannelName)
+	if d == nil {
+		if !edge.metrics[cu.ChannelName] {
+			// New metrics require a new birth certificate.
+			return edge.node_birth()
+		}
+		return []*MqttPublication{edge.message(sparkplug.NDATA, "", []*sparkplug.Metric{edge.channel_metric(cu)})}
+	}
+	if !d.born {
+		return nil
+	}
+	if !d.metrics[cu.ChannelName] {
+		return []*MqttPublication{edge.device_birth(d)}
+	}
+	return []*MqttPublication{edge.message(sparkplug.DDATA, d.id, []*sparkplug.Metric{edge.channel_metric(cu)})}
+}
+
+// rebirth returns the births needed to cover channels that are not yet
+// metrics of the edge node or of their device.
+func (edge *SparkplugEdge) rebirth() []*MqttPublication {
+	var messages []*MqttPublication
+
+	if !edge.born {
+		return nil
+	}
+	reborn := make(map[*sparkplug_device]bool)
+	for name := range edge.channels {
+		d := edge.device_of(name)
+		if d == nil && !edge.metrics[name] {
+			return edge.node_birth()
+		}
+		if d != nil && d.born && !d.metrics[name] {
+			reborn[d] = true
+		}
+	}
+	for _, d := range edge.sorted_devices() {
+		if reborn[d] {
+			messages = append(messages, edge.device_birth(d))
+		}
+	}
+	return messages
+}
+
+func (edge *SparkplugEdge) update_node(nu *socket.NodeUpdateEvent) *MqttPublication {
+	d := edge.device(nu.NodeId)
+	changed := d.state != nu.State
+	d.state = nu.State
+	if !edge.born {
+		return nil
+	}
+
+	switch {
+	case sparkplug_alive(d.state) && !d.born:
+		return edge.device_birth(d)
+	case !sparkplug_alive(d.state) && d.born:
+		return edge.device_death(d)
+	case d.born && changed:
+		return edge.message(sparkplug.DDATA, d.id, []*sparkplug.Metric{{Name: "Node/State", DataType: sparkplug.String, Value: d.state.String()}})
+	}
+	return nil
+}
+
+// HandleEvent updates the edge node with a nocand event, and returns the
+// messages to publish as a result.
+func (edge *SparkplugEdge) HandleEvent(e socket.Eventer) []*MqttPublication {
+	var messages []*MqttPublication
+
+	edge.mutex.Lock()
+	defer edge.mutex.Unlock()
+
+	switch ev := e.(type) {
+	case *socket.ChannelUpdateEvent:
+		messages = edge.update_channel(ev)
+	case *socket.ChannelListEvent:
+		for _, cu := range ev.Channels {
+			if cu.Status == socket.CHANNEL_UPDATED && len(cu.Value) > 0 {
+				edge.channels[cu.ChannelName] = cu
+			}
+		}
+		messages = edge.rebirth()
+	case *socket.NodeUpdateEvent:
+		messages = append(messages, edge.update_node(ev))
+	case *socket.NodeListEvent:
+		listed := make(map[nocan.NodeId]bool)
+		for _, nu := range ev.Nodes {
+			listed[nu.NodeId] = true
+			messages = append(messages, edge.update_node(nu))
+		}
+		// Nodes missing from the list are gone.
+		for _, d := range edge.sorted_devices() {
+			if !listed[d.node] {
+				messages = append(messages, edge.update_node(&socket.NodeUpdateEvent{NodeId: d.node, State: models.NodeStateUnknown}))
+			}
+		}
+	}
+	return messages
+}
+
+func sparkplug_value(m *sparkplug.Metric) ([]byte, error) {
+	if m.IsNull {
+		return nil, fmt.Errorf("Metric '%s' has no value", m.Name)
+	}
+	switch v := m.Value.(type) {
+	case int64:
+		return []byte(strconv.FormatInt(v, 10)), nil
+	case uint64:
+		return []byte(strconv.FormatUint(v, 10)), nil
+	case float32:
+		return []byte(strconv.FormatFloat(float64(v), 'g', -1, 32)), nil
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'g', -1, 64)), nil
+	case bool:
+		if v {
+			return []byte("1"), nil
+		}
+		return []byte("0"), nil
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	}
+	return nil, fmt.Errorf("Metric '%s' has an unsupported value type", m.Name)
+}
+
+// Command decodes an NCMD or DCMD message published on topic. It returns the
+// channel updates requested by the command, and the messages to publish in
+// response to a rebirth request. It returns false if topic is not a command
+// topic of the edge node.
+func (edge *SparkplugEdge) Command(topic string, payload []byte) ([]*SparkplugWrite, []*MqttPublication, bool, error) {
+	var writes []*SparkplugWrite
+	var messages []*MqttPublication
+
+	t, err := sparkplug.ParseTopic(topic)
+	if err != nil || t.Group != edge.Group || t.EdgeNode != edge.EdgeNode || (t.MessageType != sparkplug.NCMD && t.MessageType != sparkplug.DCMD) {
+		return nil, nil, false, nil
+	}
+	p, err := sparkplug.Unmarshal(payload)
+	if err != nil {
+		return nil, nil, true, err
+	}
+
+	edge.mutex.Lock()
+	defer edge.mutex.Unlock()
+
+	var d *sparkplug_device
+	if t.MessageType == sparkplug.DCMD {
+		for _, dev := range edge.devices {
+			if dev.id == t.Device {
+				d = dev
+			}
+		}
+		if d == nil {
+			return nil, nil, true, fmt.Errorf("Unknown Sparkplug device '%s'", t.Device)
+		}
+	}
+
+	for _, m := range p.Metrics {
+		if d == nil && m.Name == SPARKPLUG_REBIRTH {
+			if rebirth, ok := m.Value.(bool); ok && rebirth {
+				messages = append(messages, edge.node_birth()...)
+			}
+			continue
+		}
+		if edge.device_of(m.Name) != d {
+			return nil, nil, true, fmt.Errorf("Metric '%s' is not a channel of %s", m.Name, t.String())
+		}
+		value, err := sparkplug_value(m)
+		if err != nil {
+			return nil, nil, true, err
+		}
+		writes = append(writes, &SparkplugWrite{Channel: m.Name, Value: value})
+	}
+	return writes, messages, true, nil
+}
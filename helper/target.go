@@ -0,0 +1,161 @@
+package helper
+
+import (
+	"fmt"
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocanc/cmd/config"
+	"github.com/omzlo/nocanc/intelhex"
+	"strconv"
+	"strings"
+)
+
+// Targets lists the built-in target profiles.
+var Targets = []*intelhex.Target{intelhex.CANZERO}
+
+// ParseAddressRange parses an address range written as <start>-<end>, with
+// end excluded.
+func ParseAddressRange(s string) (intelhex.AddressRange, error) {
+	var ar intelhex.AddressRange
+
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return ar, fmt.Errorf("Address range must be written as <start>-<end>, got '%s'", s)
+	}
+	start, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 0, 32)
+	if err != nil {
+		return ar, fmt.Errorf("Invalid start address in range '%s': %s", s, err)
+	}
+	end, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 0, 32)
+	if err != nil {
+		return ar, fmt.Errorf("Invalid end address in range '%s': %s", s, err)
+	}
+	if end <= start {
+		return ar, fmt.Errorf("End address of range '%s' must be greater than its start address", s)
+	}
+	ar.Start, ar.End = uint32(start), uint32(end)
+	return ar, nil
+}
+
+func target_from_profile(profile *config.TargetProfile) (*intelhex.Target, error) {
+	if profile.FlashSize == 0 {
+		return nil, fmt.Errorf("Target %s: flash-size must be greater than 0", profile.Name)
+	}
+	if uint64(profile.FlashBase)+uint64(profile.FlashSize) > 1<<32 {
+		return nil, fmt.Errorf("Target %s: flash memory extends beyond the 32 bit address space", profile.Name)
+	}
+	target := &intelhex.Target{
+		Name:      profile.Name,
+		FlashBase: uint32(profile.FlashBase),
+		FlashSize: uint32(profile.FlashSize),
+		PageSize:  uint32(profile.PageSize),
+		AppOrigin: uint32(profile.FlashBase),
+	}
+	if profile.AppOrigin != 0 {
+		target.AppOrigin = uint32(profile.AppOrigin)
+	}
+	for _, s := range profile.Protected {
+		ar, err := ParseAddressRange(s)
+		if err != nil {
+			return nil, fmt.Errorf("Target %s: %s", profile.Name, err)
+		}
+		target.Protected = append(target.Protected, ar)
+	}
+	return target, nil
+}
+
+// FindTarget returns the target profile called name, looking first at the
+// profiles defined in conf, then at the built-in ones.
+func FindTarget(conf *config.Configuration, name string) (*intelhex.Target, error) {
+	var names []string
+
+	for _, profile := range conf.Targets {
+		if strings.EqualFold(profile.Name, name) {
+			return target_from_profile(profile)
+		}
+		names = append(names, profile.Name)
+	}
+	for _, target := range Targets {
+		if strings.EqualFold(target.Name, name) {
+			return target, nil
+		}
+		names = append(names, target.Name)
+	}
+	return nil, fmt.Errorf("Unknown target '%s', expected one of %s", name, strings.Join(names, ", "))
+}
+
+// ApplicationOrigin returns the address where applications start on the
+// target selected in the configuration, used to load raw binary images.
+func ApplicationOrigin() (uint32, error) {
+	target, err := FindTarget(&config.Settings, config.Settings.Target)
+	if err != nil {
+		return 0, err
+	}
+	return target.AppOrigin, nil
+}
+
+// TargetError reports why a firmware image cannot be uploaded to a target.
+type TargetError struct {
+	Target     string
+	Board      string
+	Violations []intelhex.TargetViolation
+}
+
+func (e *TargetError) Error() string {
+	var lines []string
+
+	if e.Board != "" {
+		lines = append(lines, fmt.Sprintf("Firmware was built for board %s, not for target %s", e.Board, e.Target))
+	}
+	if len(e.Violations) > 0 {
+		lines = append(lines, fmt.Sprintf("Firmware does not fit the memory map of target %s:", e.Target))
+		for _, v := range e.Violations {
+			lines = append(lines, "  "+v.String())
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// TargetValidator checks firmware images against a target profile before
+// they are uploaded.
+type TargetValidator struct {
+	Target *intelhex.Target
+	Mode   config.TargetCheck
+}
+
+// NewTargetValidator returns a validator for the target selected in conf,
+// or nil if target checks are disabled.
+func NewTargetValidator(conf *config.Configuration) (*TargetValidator, error) {
+	if conf.TargetCheck == config.TargetCheckOff {
+		return nil, nil
+	}
+	target, err := FindTarget(conf, conf.Target)
+	if err != nil {
+		return nil, err
+	}
+	return &TargetValidator{Target: target, Mode: conf.TargetCheck}, nil
+}
+
+// Validate checks that ihex fits the memory map of the target and, if
+// metadata names a board, that it matches the target. Problems are returned
+// as a *TargetError, or only logged as warnings in warn mode. A nil
+// validator accepts all images.
+func (v *TargetValidator) Validate(ihex *intelhex.IntelHex, metadata *intelhex.Metadata) error {
+	if v == nil {
+		return nil
+	}
+
+	terr := &TargetError{Target: v.Target.Name, Violations: v.Target.Check(ihex)}
+	if metadata != nil && metadata.Board != "" && !strings.EqualFold(metadata.Board, v.Target.Name) {
+		terr.Board = metadata.Board
+	}
+	if terr.Board == "" && len(terr.Violations) == 0 {
+		return nil
+	}
+	if v.Mode == config.TargetCheckWarn {
+		for _, line := range strings.Split(terr.Error(), "\n") {
+			clog.Warning("%s", line)
+		}
+		return nil
+	}
+	return terr
+}
@@ -0,0 +1,292 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Payload is a message value as seen by templates: '{{.Value}}' renders
+// it as a string rather than as a list of bytes.
+type Payload []byte
+
+func (p Payload) String() string {
+	return string(p)
+}
+
+// TemplateFuncs are the functions available in the templates of mqtt and
+// blynk mappings, in addition to the text/template builtins. Functions that
+// take a value accept it as their last argument, so they can be chained in
+// pipelines, as in '{{ .Value | i16le | scale 0.1 | round 1 }}'.
+//
+//	json, fromJson          encode to / decode from JSON
+//	int, float              parse or convert to a number
+//	u8, i8, u16le, u16be, i16le, i16be, u32le, u32be, i32le, i32be,
+//	f32 (same as f32le), f32le, f32be
+//	                        decode binary values, with an optional byte offset
+//	                        as first argument (e.g. 'u16le 2 .Value')
+//	scale, round            multiply by a factor, round to a number of decimals
+//	jq                      extract a field from JSON (e.g. 'jq ".a.b[0]" .Value')
+//	base64, fromBase64      encode to / decode from base64
+//	hex, fromHex            encode to / decode from hexadecimal
+var TemplateFuncs = template.FuncMap{
+	"json":       tmpl_json,
+	"fromJson":   tmpl_from_json,
+	"int":        tmpl_int,
+	"float":      tmpl_float,
+	"u8":         tmpl_decoder(1, func(b []byte) interface{} { return int64(b[0]) }),
+	"i8":         tmpl_decoder(1, func(b []byte) interface{} { return int64(int8(b[0])) }),
+	"u16le":      tmpl_decoder(2, func(b []byte) interface{} { return int64(binary.LittleEndian.Uint16(b)) }),
+	"u16be":      tmpl_decoder(2, func(b []byte) interface{} { return int64(binary.BigEndian.Uint16(b)) }),
+	"i16le":      tmpl_decoder(2, func(b []byte) interface{} { return int64(int16(binary.LittleEndian.Uint16(b))) }),
+	"i16be":      tmpl_decoder(2, func(b []byte) interface{} { return int64(int16(binary.BigEndian.Uint16(b))) }),
+	"u32le":      tmpl_decoder(4, func(b []byte) interface{} { return int64(binary.LittleEndian.Uint32(b)) }),
+	"u32be":      tmpl_decoder(4, func(b []byte) interface{} { return int64(binary.BigEndian.Uint32(b)) }),
+	"i32le":      tmpl_decoder(4, func(b []byte) interface{} { return int64(int32(binary.LittleEndian.Uint32(b))) }),
+	"i32be":      tmpl_decoder(4, func(b []byte) interface{} { return int64(int32(binary.BigEndian.Uint32(b))) }),
+	"f32":        tmpl_decoder(4, func(b []byte) interface{} { return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))) }),
+	"f32le":      tmpl_decoder(4, func(b []byte) interface{} { return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))) }),
+	"f32be":      tmpl_decoder(4, func(b []byte) interface{} { return float64(math.Float32frombits(binary.BigEndian.Uint32(b))) }),
+	"scale":      tmpl_scale,
+	"round":      tmpl_round,
+	"jq":         tmpl_jq,
+	"base64":     tmpl_base64,
+	"fromBase64": tmpl_from_base64,
+	"hex":        tmpl_hex,
+	"fromHex":    tmpl_from_hex,
+}
+
+// NewTemplate parses text as a template with TemplateFuncs.
+func NewTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Funcs(TemplateFuncs).Parse(text)
+}
+
+func ExecuteTemplate(t *template.Template, data interface{}) ([]byte, error) {
+	b := new(bytes.Buffer)
+	if err := t.Execute(b, data); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func tmpl_bytes(v interface{}) []byte {
+	switch x := v.(type) {
+	case Payload:
+		return x
+	case []byte:
+		return x
+	case string:
+		return []byte(x)
+	case nil:
+		return nil
+	}
+	return []byte(fmt.Sprint(v))
+}
+
+func tmpl_json(v interface{}) (string, error) {
+	switch x := v.(type) {
+	case Payload:
+		v = string(x)
+	case []byte:
+		v = string(x)
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func tmpl_from_json(v interface{}) (interface{}, error) {
+	var r interface{}
+
+	d := json.NewDecoder(bytes.NewReader(tmpl_bytes(v)))
+	d.UseNumber()
+	if err := d.Decode(&r); err != nil {
+		return nil, fmt.Errorf("fromJson: %s", err)
+	}
+	return r, nil
+}
+
+func tmpl_int(v interface{}) (int64, error) {
+	switch x := v.(type) {
+	case int:
+		return int64(x), nil
+	case int64:
+		return x, nil
+	case float64:
+		return int64(x), nil
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i, nil
+		}
+	}
+	s := strings.TrimSpace(string(tmpl_bytes(v)))
+	if i, err := strconv.ParseInt(s, 0, 64); err == nil {
+		return i, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("int: cannot convert %q to an integer", s)
+	}
+	return int64(f), nil
+}
+
+func tmpl_float(v interface{}) (float64, error) {
+	switch x := v.(type) {
+	case int:
+		return float64(x), nil
+	case int64:
+		return float64(x), nil
+	case float64:
+		return x, nil
+	case float32:
+		return float64(x), nil
+	}
+	s := strings.TrimSpace(string(tmpl_bytes(v)))
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("float: cannot convert %q to a number", s)
+	}
+	return f, nil
+}
+
+// tmpl_decoder returns a template function decoding a value of size bytes,
+// called either as 'f VALUE' or 'f OFFSET VALUE'.
+func tmpl_decoder(size int, decode func([]byte) interface{}) func(...interface{}) (interface{}, error) {
+	return func(args ...interface{}) (interface{}, error) {
+		var offset int64
+		var err error
+
+		switch len(args) {
+		case 1:
+		case 2:
+			if offset, err = tmpl_int(args[0]); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("binary decoding expects an optional offset and a value, got %d arguments", len(args))
+		}
+		b := tmpl_bytes(args[len(args)-1])
+		if offset < 0 || int(offset)+size > len(b) {
+			return nil, fmt.Errorf("cannot decode %d bytes at offset %d of a %d byte value", size, offset, len(b))
+		}
+		return decode(b[offset : int(offset)+size]), nil
+	}
+}
+
+func tmpl_scale(factor interface{}, v interface{}) (float64, error) {
+	f, err := tmpl_float(factor)
+	if err != nil {
+		return 0, err
+	}
+	x, err := tmpl_float(v)
+	if err != nil {
+		return 0, err
+	}
+	return x * f, nil
+}
+
+func tmpl_round(decimals int, v interface{}) (float64, error) {
+	x, err := tmpl_float(v)
+	if err != nil {
+		return 0, err
+	}
+	p := math.Pow(10, float64(decimals))
+	return math.Round(x*p) / p, nil
+}
+
+// tmpl_jq extracts a field from a JSON value with a jq-style path, such as
+// '.sensors[0].value' or '.["key with spaces"]'. The value may be JSON text
+// or a value already decoded with fromJson. Missing fields yield nil.
+func tmpl_jq(path string, v interface{}) (interface{}, error) {
+	var err error
+
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+	default:
+		if v, err = tmpl_from_json(v); err != nil {
+			return nil, err
+		}
+	}
+
+	p := strings.TrimSpace(path)
+	if !strings.HasPrefix(p, ".") {
+		return nil, fmt.Errorf("jq: path '%s' must start with '.'", path)
+	}
+	p = p[1:]
+	for p != "" {
+		var key string
+		index := -1
+
+		switch {
+		case p[0] == '.':
+			p = p[1:]
+			continue
+		case strings.HasPrefix(p, "[\""):
+			end := strings.Index(p, "\"]")
+			if end < 0 {
+				return nil, fmt.Errorf("jq: unterminated key in path '%s'", path)
+			}
+			key, p = p[2:end], p[end+2:]
+		case p[0] == '[':
+			end := strings.Index(p, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("jq: unterminated index in path '%s'", path)
+			}
+			if index, err = strconv.Atoi(p[1:end]); err != nil {
+				return nil, fmt.Errorf("jq: invalid index in path '%s'", path)
+			}
+			p = p[end+1:]
+		default:
+			end := strings.IndexAny(p, ".[")
+			if end < 0 {
+				end = len(p)
+			}
+			key, p = p[:end], p[end:]
+		}
+
+		if index >= 0 {
+			a, ok := v.([]interface{})
+			if !ok || index >= len(a) {
+				return nil, nil
+			}
+			v = a[index]
+		} else {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, nil
+			}
+			v = m[key]
+		}
+	}
+	return v, nil
+}
+
+func tmpl_base64(v interface{}) string {
+	return base64.StdEncoding.EncodeToString(tmpl_bytes(v))
+}
+
+func tmpl_from_base64(v interface{}) (Payload, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(tmpl_bytes(v))))
+	if err != nil {
+		return nil, fmt.Errorf("fromBase64: %s", err)
+	}
+	return Payload(b), nil
+}
+
+func tmpl_hex(v interface{}) string {
+	return hex.EncodeToString(tmpl_bytes(v))
+}
+
+func tmpl_from_hex(v interface{}) (Payload, error) {
+	b, err := hex.DecodeString(strings.TrimSpace(string(tmpl_bytes(v))))
+	if err != nil {
+		return nil, fmt.Errorf("fromHex: %s", err)
+	}
+	return Payload(b), nil
+}
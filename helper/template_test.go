@@ -0,0 +1,153 @@
+package helper
+
+import (
+	"testing"
+)
+
+func execute_test_template(t *testing.T, text string, value []byte) (string, error) {
+	tmpl, err := NewTemplate("test", text)
+	if err != nil {
+		t.Fatalf("Failed to parse template %q: %s", text, err)
+	}
+	out, err := ExecuteTemplate(tmpl, &struct{ Value Payload }{Payload(value)})
+	return string(out), err
+}
+
+func TestTemplateDecoders(t *testing.T) {
+	value := []byte{0xFE, 0xFF, 0x01, 0x02, 0x00, 0x00, 0x80, 0x3F}
+
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{"{{ u8 .Value }}", "254"},
+		{"{{ i8 .Value }}", "-2"},
+		{"{{ u8 2 .Value }}", "1"},
+		{"{{ u16le .Value }}", "65534"},
+		{"{{ u16be .Value }}", "65279"},
+		{"{{ i16le .Value }}", "-2"},
+		{"{{ i16be .Value }}", "-257"},
+		{"{{ u16le 2 .Value }}", "513"},
+		{"{{ u16be 2 .Value }}", "258"},
+		{"{{ u32le .Value }}", "33685502"},
+		{"{{ u32be .Value }}", "4278124802"},
+		{"{{ i32le .Value }}", "33685502"},
+		{"{{ i32be .Value }}", "-16842494"},
+		{"{{ f32 4 .Value }}", "1"},
+		{"{{ f32le 4 .Value }}", "1"},
+		{"{{ f32be 4 .Value }}", "4.600602988224807e-41"},
+		{"{{ .Value | u8 7 }}", "63"},
+	}
+	for _, test := range tests {
+		out, err := execute_test_template(t, test.text, value)
+		if err != nil {
+			t.Errorf("%q failed: %s", test.text, err)
+			continue
+		}
+		if out != test.expected {
+			t.Errorf("%q returned %q, expected %q", test.text, out, test.expected)
+		}
+	}
+}
+
+func TestTemplateDecoderOffsets(t *testing.T) {
+	value := []byte{0x01, 0x02, 0x03, 0x04}
+
+	for _, text := range []string{
+		"{{ u32le 1 .Value }}",
+		"{{ u16be 3 .Value }}",
+		"{{ u8 4 .Value }}",
+		"{{ u8 -1 .Value }}",
+		"{{ u16le 0 1 .Value }}",
+	} {
+		if out, err := execute_test_template(t, text, value); err == nil {
+			t.Errorf("%q returned %q, expected an error", text, out)
+		}
+	}
+	if out, err := execute_test_template(t, "{{ i32be .Value }}", nil); err == nil {
+		t.Errorf("decoding an empty value returned %q, expected an error", out)
+	}
+}
+
+func TestTemplateJq(t *testing.T) {
+	value := []byte(`{"sensors":[{"name":"t1","value":21.5},{"name":"t2","value":-3}],"key with spaces":"ok","nested":{"a":{"b":true}}}`)
+
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{`{{ jq ".sensors[0].name" .Value }}`, "t1"},
+		{`{{ jq ".sensors[0].value" .Value }}`, "21.5"},
+		{`{{ jq ".sensors[1].value" .Value }}`, "-3"},
+		{`{{ jq ".[\"key with spaces\"]" .Value }}`, "ok"},
+		{`{{ jq ".nested.a.b" .Value }}`, "true"},
+		{`{{ jq ".sensors[2].name" .Value }}`, "<no value>"},
+		{`{{ jq ".missing.field" .Value }}`, "<no value>"},
+		{`{{ jq ".sensors.name" .Value }}`, "<no value>"},
+		{`{{ .Value | fromJson | jq ".sensors[1].name" }}`, "t2"},
+		{`{{ jq ".sensors[0].value" .Value | scale 2 }}`, "43"},
+	}
+	for _, test := range tests {
+		out, err := execute_test_template(t, test.text, value)
+		if err != nil {
+			t.Errorf("%q failed: %s", test.text, err)
+			continue
+		}
+		if out != test.expected {
+			t.Errorf("%q returned %q, expected %q", test.text, out, test.expected)
+		}
+	}
+
+	for _, text := range []string{
+		`{{ jq "sensors" .Value }}`,
+		`{{ jq ".sensors[x]" .Value }}`,
+		`{{ jq ".sensors[0" .Value }}`,
+		`{{ jq ".[\"key" .Value }}`,
+	} {
+		if out, err := execute_test_template(t, text, value); err == nil {
+			t.Errorf("%q returned %q, expected an error", text, out)
+		}
+	}
+	if out, err := execute_test_template(t, `{{ jq ".a" .Value }}`, []byte("not json")); err == nil {
+		t.Errorf("jq on invalid JSON returned %q, expected an error", out)
+	}
+}
+
+func TestTemplateScaleRound(t *testing.T) {
+	tests := []struct {
+		text     string
+		value    []byte
+		expected string
+	}{
+		{"{{ .Value | scale 0.1 }}", []byte("215"), "21.5"},
+		{"{{ .Value | scale 10 }}", []byte("1.5"), "15"},
+		{"{{ .Value | scale -1 }}", []byte("4"), "-4"},
+		{"{{ .Value | round 1 }}", []byte("21.46"), "21.5"},
+		{"{{ .Value | round 2 }}", []byte("3.14159"), "3.14"},
+		{"{{ .Value | round 0 }}", []byte("2.5"), "3"},
+		{"{{ .Value | round 0 }}", []byte("-2.5"), "-3"},
+		{"{{ .Value | round -2 }}", []byte("1234"), "1200"},
+		{"{{ .Value | i16le | scale 0.01 | round 1 }}", []byte{0x6A, 0x08}, "21.5"},
+		{"{{ .Value | i16le | scale 0.1 | round 1 }}", []byte{0xF6, 0xFF}, "-1"},
+	}
+	for _, test := range tests {
+		out, err := execute_test_template(t, test.text, test.value)
+		if err != nil {
+			t.Errorf("%q on %q failed: %s", test.text, test.value, err)
+			continue
+		}
+		if out != test.expected {
+			t.Errorf("%q on %q returned %q, expected %q", test.text, test.value, out, test.expected)
+		}
+	}
+
+	for _, text := range []string{
+		"{{ .Value | scale 2 }}",
+		"{{ .Value | round 1 }}",
+		`{{ .Value | scale "x" }}`,
+	} {
+		if out, err := execute_test_template(t, text, []byte("abc")); err == nil {
+			t.Errorf("%q returned %q, expected an error", text, out)
+		}
+	}
+}
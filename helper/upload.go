@@ -0,0 +1,216 @@
+package helper
+
+import (
+	"github.com/omzlo/nocanc/cmd/config"
+	"github.com/omzlo/nocanc/intelhex"
+	"github.com/omzlo/nocand/models/nocan"
+	"github.com/omzlo/nocand/socket"
+	"sort"
+	"sync"
+	"time"
+)
+
+// UPLOAD_MAX_BACKOFF caps the delay between two attempts of an upload.
+const UPLOAD_MAX_BACKOFF = 30 * time.Second
+
+// FirmwareUpload tracks the address ranges of a firmware image that nocand
+// acknowledged while uploading it to a node. If Resume is set, a failed
+// upload is resumed by sending only the remaining data, skipping
+// acknowledged data in whole flash pages of PageSize bytes, since resuming in
+// the middle of a page could erase its first part. Otherwise, each request
+// sends the whole firmware again.
+//
+// Resuming requires a nocand that does not erase the application flash when
+// an upload starts: current versions of nocand erase it on every upload
+// request, which would lose the pages written by the failed attempt.
+type FirmwareUpload struct {
+	NodeId   nocan.NodeId
+	Firmware *intelhex.IntelHex
+	PageSize uint32
+	Resume   bool
+	mutex    sync.Mutex
+	acked    []intelhex.AddressRange
+	sending  []*intelhex.IntelHexMemBlock
+}
+
+// NewFirmwareUpload prepares the upload of firmware to a node, using the
+// page size of the selected target profile. Failed uploads are resumed if
+// upload-resume is enabled in the configuration.
+func NewFirmwareUpload(nodeId nocan.NodeId, firmware *intelhex.IntelHex) *FirmwareUpload {
+	page_size := intelhex.CANZERO.PageSize
+	if target, err := FindTarget(&config.Settings, config.Settings.Target); err == nil {
+		page_size = target.PageSize
+	}
+	return &FirmwareUpload{NodeId: nodeId, Firmware: firmware, PageSize: page_size, Resume: config.Settings.UploadResume}
+}
+
+// merge_ranges sorts ranges and joins those that overlap or touch.
+func merge_ranges(ranges []intelhex.AddressRange) []intelhex.AddressRange {
+	var merged []intelhex.AddressRange
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	for _, r := range ranges {
+		n := len(merged)
+		if n > 0 && r.Start <= merged[n-1].End {
+			if r.End > merged[n-1].End {
+				merged[n-1].End = r.End
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// skipped returns the acknowledged ranges reduced to whole pages.
+func (u *FirmwareUpload) skipped() []intelhex.AddressRange {
+	var ranges []intelhex.AddressRange
+
+	for _, r := range u.acked {
+		start, end := uint64(r.Start), uint64(r.End)
+		if u.PageSize > 0 {
+			page_size := uint64(u.PageSize)
+			start = (start + page_size - 1) / page_size * page_size
+			end = end / page_size * page_size
+		}
+		if start < end {
+			ranges = append(ranges, intelhex.AddressRange{Start: uint32(start), End: uint32(end)})
+		}
+	}
+	return ranges
+}
+
+// remaining returns the data records of the firmware, without the data
+// skipped because it was acknowledged.
+func (u *FirmwareUpload) remaining() []*intelhex.IntelHexMemBlock {
+	var blocks []*intelhex.IntelHexMemBlock
+
+	skipped := u.skipped()
+	for _, block := range u.Firmware.Blocks {
+		if block.Type != intelhex.DataRecord {
+			continue
+		}
+		pos := uint64(block.Address)
+		end := pos + uint64(len(block.Data))
+		emit := func(to uint64) {
+			if to > pos {
+				offset := pos - uint64(block.Address)
+				blocks = append(blocks, &intelhex.IntelHexMemBlock{Type: intelhex.DataRecord, Address: uint32(pos), Data: block.Data[offset : offset+to-pos]})
+			}
+		}
+		for _, r := range skipped {
+			if uint64(r.End) <= pos {
+				continue
+			}
+			if uint64(r.Start) >= end {
+				break
+			}
+			emit(uint64(r.Start))
+			pos = uint64(r.End)
+		}
+		if pos < end {
+			emit(end)
+		}
+	}
+	return blocks
+}
+
+// Request returns an upload request for the data that remains to be sent, or
+// for the whole firmware if Resume is not set. If everything was acknowledged
+// but the upload still failed, the whole firmware is sent again.
+func (u *FirmwareUpload) Request() *socket.NodeFirmwareEvent {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if !u.Resume {
+		u.acked = nil
+	}
+	u.sending = u.remaining()
+	if len(u.sending) == 0 {
+		u.acked = nil
+		u.sending = u.remaining()
+	}
+	request := socket.NewNodeFirmwareEvent(u.NodeId).ConfigureAsUpload()
+	for _, block := range u.sending {
+		request.AppendBlock(block.Address, block.Data)
+	}
+	return request
+}
+
+// Acknowledge records that the first count bytes of the last request were
+// transferred, as reported by NodeFirmwareProgressEvent.BytesTransferred.
+func (u *FirmwareUpload) Acknowledge(count uint32) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	for _, block := range u.sending {
+		if count == 0 {
+			break
+		}
+		n := uint32(len(block.Data))
+		if n > count {
+			n = count
+		}
+		u.acked = append(u.acked, intelhex.AddressRange{Start: block.Address, End: block.Address + n})
+		count -= n
+	}
+	u.acked = merge_ranges(u.acked)
+}
+
+// Acknowledged returns the number of bytes of the firmware acknowledged so far.
+func (u *FirmwareUpload) Acknowledged() uint32 {
+	var total uint32
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	for _, r := range u.acked {
+		total += r.Len()
+	}
+	return total
+}
+
+// Remaining returns the number of bytes of the firmware not acknowledged yet.
+func (u *FirmwareUpload) Remaining() uint32 {
+	acked := u.Acknowledged()
+	if acked >= uint32(u.Firmware.Size) {
+		return 0
+	}
+	return uint32(u.Firmware.Size) - acked
+}
+
+// Progress returns the percentage of the firmware acknowledged so far.
+func (u *FirmwareUpload) Progress() float32 {
+	if u.Firmware.Size == 0 {
+		return 0
+	}
+	return 100 * float32(u.Acknowledged()) / float32(u.Firmware.Size)
+}
+
+// RetryPolicy describes how many times a failed upload is retried, and how
+// long to wait before each attempt.
+type RetryPolicy struct {
+	Retries int
+	Backoff time.Duration
+}
+
+// DefaultRetryPolicy returns the retry policy of the configuration.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Retries: int(config.Settings.UploadRetries),
+		Backoff: time.Duration(config.Settings.UploadBackoff),
+	}
+}
+
+// Delay returns the time to wait before retry number attempt, counted from
+// 1, doubling the backoff after each retry up to UPLOAD_MAX_BACKOFF.
+func (rp RetryPolicy) Delay(attempt int) time.Duration {
+	delay := rp.Backoff
+	for i := 1; i < attempt && delay < UPLOAD_MAX_BACKOFF; i++ {
+		delay *= 2
+	}
+	if delay > UPLOAD_MAX_BACKOFF {
+		delay = UPLOAD_MAX_BACKOFF
+	}
+	return delay
+}
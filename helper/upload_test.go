@@ -0,0 +1,117 @@
+package helper
+
+import (
+	"github.com/omzlo/nocanc/intelhex"
+	"github.com/omzlo/nocand/socket"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	tests := []struct {
+		backoff  time.Duration
+		attempt  int
+		expected time.Duration
+	}{
+		{2 * time.Second, 1, 2 * time.Second},
+		{2 * time.Second, 2, 4 * time.Second},
+		{2 * time.Second, 3, 8 * time.Second},
+		{2 * time.Second, 4, 16 * time.Second},
+		{2 * time.Second, 5, UPLOAD_MAX_BACKOFF},
+		{2 * time.Second, 100, UPLOAD_MAX_BACKOFF},
+		{2 * time.Second, 0, 2 * time.Second},
+		{time.Minute, 1, UPLOAD_MAX_BACKOFF},
+		{0, 3, 0},
+	}
+	for _, test := range tests {
+		policy := RetryPolicy{Retries: 3, Backoff: test.backoff}
+		if delay := policy.Delay(test.attempt); delay != test.expected {
+			t.Errorf("Delay(%d) with a backoff of %s is %s, expected %s", test.attempt, test.backoff, delay, test.expected)
+		}
+	}
+}
+
+func TestMergeRanges(t *testing.T) {
+	ranges := merge_ranges([]intelhex.AddressRange{{30, 40}, {0, 10}, {10, 20}, {35, 50}, {38, 39}})
+	expected := []intelhex.AddressRange{{0, 20}, {30, 50}}
+	if !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("Merged ranges are %v, expected %v", ranges, expected)
+	}
+}
+
+func test_upload(resume bool) *FirmwareUpload {
+	firmware := intelhex.New()
+	firmware.Add(intelhex.DataRecord, 0x2000, make([]byte, 200))
+	firmware.Add(intelhex.DataRecord, 0x3000, make([]byte, 10))
+	return &FirmwareUpload{NodeId: 1, Firmware: firmware, PageSize: 64, Resume: resume}
+}
+
+func check_request(t *testing.T, what string, request *socket.NodeFirmwareEvent, expected ...intelhex.AddressRange) {
+	t.Helper()
+
+	var ranges []intelhex.AddressRange
+	for _, block := range request.Code {
+		ranges = append(ranges, intelhex.AddressRange{Start: block.Offset, End: block.Offset + uint32(len(block.Data))})
+	}
+	if request.NodeId != 1 || request.Download || !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("%s: request for node %d (download %t) sends %v, expected an upload to node 1 of %v", what, request.NodeId, request.Download, ranges, expected)
+	}
+}
+
+func TestFirmwareUploadResume(t *testing.T) {
+	upload := test_upload(true)
+	whole := []intelhex.AddressRange{{0x2000, 0x20C8}, {0x3000, 0x300A}}
+
+	check_request(t, "first attempt", upload.Request(), whole...)
+	upload.Acknowledge(130)
+	if upload.Acknowledged() != 130 || upload.Remaining() != 80 {
+		t.Errorf("Upload acknowledged %d bytes with %d left, expected 130 and 80", upload.Acknowledged(), upload.Remaining())
+	}
+
+	// Only whole pages are skipped.
+	check_request(t, "second attempt", upload.Request(), intelhex.AddressRange{0x2080, 0x20C8}, intelhex.AddressRange{0x3000, 0x300A})
+	upload.Acknowledge(72 + 5)
+	if upload.Acknowledged() != 205 {
+		t.Errorf("Upload acknowledged %d bytes, expected 205", upload.Acknowledged())
+	}
+	check_request(t, "third attempt", upload.Request(), intelhex.AddressRange{0x20C0, 0x20C8}, intelhex.AddressRange{0x3000, 0x300A})
+
+	// Progress events report the bytes transferred so far in the request, so
+	// acknowledging them again does not change anything.
+	upload.Acknowledge(8)
+	upload.Acknowledge(8)
+	if upload.Acknowledged() != 205 || upload.Progress() != 100*205.0/210 {
+		t.Errorf("Upload acknowledged %d bytes (%.1f%%), expected 205", upload.Acknowledged(), upload.Progress())
+	}
+
+	// Partial pages are sent again even if all their data was acknowledged.
+	upload.Acknowledge(18)
+	if upload.Remaining() != 0 {
+		t.Errorf("Upload has %d bytes left, expected none", upload.Remaining())
+	}
+	check_request(t, "partial pages", upload.Request(), intelhex.AddressRange{0x20C0, 0x20C8}, intelhex.AddressRange{0x3000, 0x300A})
+
+	// When all pages were acknowledged, the whole firmware is sent again.
+	upload.Firmware.Crop(0x2000, 0x2080)
+	upload.Request()
+	upload.Acknowledge(128)
+	check_request(t, "after full acknowledgement", upload.Request(), intelhex.AddressRange{0x2000, 0x2080})
+}
+
+func TestFirmwareUploadRetry(t *testing.T) {
+	upload := test_upload(false)
+	whole := []intelhex.AddressRange{{0x2000, 0x20C8}, {0x3000, 0x300A}}
+
+	check_request(t, "first attempt", upload.Request(), whole...)
+	upload.Acknowledge(130)
+	if upload.Progress() != 100*130.0/210 {
+		t.Errorf("Upload progress is %.1f%%, expected %.1f%%", upload.Progress(), 100*130.0/210)
+	}
+
+	// Without resume, each attempt sends the whole firmware.
+	check_request(t, "second attempt", upload.Request(), whole...)
+	if upload.Acknowledged() != 0 {
+		t.Errorf("Retried upload starts with %d bytes acknowledged, expected none", upload.Acknowledged())
+	}
+}
@@ -0,0 +1,446 @@
+package history
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocand/models/nocan"
+	"github.com/omzlo/nocand/socket"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Channel updates are stored in one segment file per day (UTC), named after
+// the date, e.g. 'history-20210214.dat'. Each record is encoded as:
+//
+//   - 4 bytes: length of the remaining record (big endian)
+//   - 8 bytes: update time in nanoseconds since the Unix epoch
+//   - 2 bytes: channel id (big endian)
+//   - 1 byte: channel status
+//   - 1 byte: length of the channel name, followed by the name
+//   - 1 byte: length of the value, followed by the value
+//
+// Segments are only appended to, except when the segment of the current day
+// alone exceeds the size limit, in which case its oldest records are dropped.
+// A truncated record at the end of a segment (e.g. after a crash) is ignored
+// when reading, and removed before appending new records.
+const (
+	SEGMENT_PREFIX      = "history-"
+	SEGMENT_SUFFIX      = ".dat"
+	SEGMENT_DATE_FORMAT = "20060102"
+	MAX_RECORD_SIZE     = 8 + 2 + 1 + 1 + 255 + 1 + 255
+)
+
+// Retention limits the amount of history kept on disk. Zero values mean no limit.
+type Retention struct {
+	MaxAge  time.Duration
+	MaxSize int64
+}
+
+type Store struct {
+	mutex     sync.Mutex
+	dir       string
+	retention Retention
+	read_only bool
+	segment   *os.File
+	day       string
+	size      int64
+}
+
+func segment_day(t time.Time) string {
+	return t.UTC().Format(SEGMENT_DATE_FORMAT)
+}
+
+func segment_name(day string) string {
+	return SEGMENT_PREFIX + day + SEGMENT_SUFFIX
+}
+
+// Open opens the history store located in dir, creating the directory if
+// needed, and applies the retention limits to the existing segments.
+func Open(dir string, retention Retention) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	store := &Store{dir: dir, retention: retention}
+	if err := store.enforce_retention(time.Now()); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// OpenReadOnly opens the history store located in dir for queries only:
+// retention limits are not applied and Record fails.
+func OpenReadOnly(dir string) (*Store, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("History store %s is not a directory", dir)
+	}
+	return &Store{dir: dir, read_only: true}, nil
+}
+
+func (s *Store) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.segment == nil {
+		return nil
+	}
+	err := s.segment.Close()
+	s.segment = nil
+	return err
+}
+
+type segment_info struct {
+	day  string
+	path string
+	size int64
+}
+
+// segments returns the list of segment files in the store, oldest first.
+func (s *Store) segments() ([]segment_info, error) {
+	var result []segment_info
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, SEGMENT_PREFIX) || !strings.HasSuffix(name, SEGMENT_SUFFIX) {
+			continue
+		}
+		day := strings.TrimSuffix(strings.TrimPrefix(name, SEGMENT_PREFIX), SEGMENT_SUFFIX)
+		if _, err := time.Parse(SEGMENT_DATE_FORMAT, day); err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, segment_info{day, filepath.Join(s.dir, name), info.Size()})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].day < result[j].day })
+	return result, nil
+}
+
+// enforce_retention removes the segments that are older than the maximum age
+// or, oldest first, that exceed the maximum size. If the segment of the
+// current day alone exceeds the maximum size, its oldest records are dropped
+// until it only takes 90% of it, so that it is not rewritten on every update.
+func (s *Store) enforce_retention(now time.Time) error {
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, seg := range segments {
+		total += seg.size
+	}
+
+	today := segment_day(now)
+	for _, seg := range segments {
+		if seg.day == today {
+			if s.retention.MaxSize > 0 && total > s.retention.MaxSize {
+				target := s.retention.MaxSize - s.retention.MaxSize/10
+				size, err := s.trim_segment(seg, seg.size-(total-target))
+				if err != nil {
+					return err
+				}
+				total -= seg.size - size
+			}
+			break
+		}
+		expired := false
+		if s.retention.MaxAge > 0 {
+			end, _ := time.Parse(SEGMENT_DATE_FORMAT, seg.day)
+			expired = now.Sub(end.Add(24*time.Hour)) > s.retention.MaxAge
+		}
+		if s.retention.MaxSize > 0 && total > s.retention.MaxSize {
+			expired = true
+		}
+		if !expired {
+			break
+		}
+		clog.Info("Removing history segment %s", seg.path)
+		if err := os.Remove(seg.path); err != nil {
+			return err
+		}
+		total -= seg.size
+	}
+	s.size = total
+	return nil
+}
+
+// trim_segment rewrites a segment, keeping only its most recent records that
+// fit in keep bytes, and returns its new size.
+func (s *Store) trim_segment(seg segment_info, keep int64) (int64, error) {
+	var records [][]byte
+	var size int64
+
+	_, err := scan_segment(seg.path, -1, func(cu *socket.ChannelUpdateEvent) {
+		records = append(records, encode_record(cu))
+	})
+	if err != nil {
+		return seg.size, err
+	}
+	first := len(records)
+	for first > 0 && size+int64(len(records[first-1])) <= keep {
+		first--
+		size += int64(len(records[first]))
+	}
+
+	clog.Info("Dropping %d old records from history segment %s", first, seg.path)
+	tmp_path := seg.path + ".tmp"
+	f, err := os.OpenFile(tmp_path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return seg.size, err
+	}
+	w := bufio.NewWriter(f)
+	for _, record := range records[first:] {
+		w.Write(record)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp_path)
+		return seg.size, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp_path)
+		return seg.size, err
+	}
+	if s.segment != nil && s.day == seg.day {
+		s.segment.Close()
+		s.segment = nil
+	}
+	if err := os.Rename(tmp_path, seg.path); err != nil {
+		return seg.size, err
+	}
+	return size, nil
+}
+
+func (s *Store) open_segment(now time.Time) error {
+	day := segment_day(now)
+	if s.segment != nil && s.day == day {
+		return nil
+	}
+	if s.segment != nil {
+		s.segment.Close()
+		s.segment = nil
+	}
+	path := filepath.Join(s.dir, segment_name(day))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if info.Size() > 0 {
+		valid, err := scan_segment(path, -1, func(*socket.ChannelUpdateEvent) {})
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if valid < info.Size() {
+			clog.Warning("Truncating history segment %s from %d to %d bytes", path, info.Size(), valid)
+			if err := f.Truncate(valid); err != nil {
+				f.Close()
+				return err
+			}
+		}
+	}
+	s.segment = f
+	s.day = day
+	return nil
+}
+
+func encode_record(cu *socket.ChannelUpdateEvent) []byte {
+	name := cu.ChannelName
+	if len(name) > 255 {
+		name = name[:255]
+	}
+	value := cu.Value
+	if len(value) > 255 {
+		value = value[:255]
+	}
+
+	b := make([]byte, 4, 4+MAX_RECORD_SIZE)
+	b = append(b, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(b[4:], uint64(cu.UpdatedAt.UnixNano()))
+	b = append(b, byte(cu.ChannelId>>8), byte(cu.ChannelId), byte(cu.Status), byte(len(name)))
+	b = append(b, name...)
+	b = append(b, byte(len(value)))
+	b = append(b, value...)
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	return b
+}
+
+func decode_record(b []byte) (*socket.ChannelUpdateEvent, error) {
+	if len(b) < 13 {
+		return nil, fmt.Errorf("History record is too short")
+	}
+	t := time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+	id := nocan.ChannelId(binary.BigEndian.Uint16(b[8:]))
+	status := socket.ChannelStatus(b[10])
+	name_len := int(b[11])
+	if len(b) < 12+name_len+1 {
+		return nil, fmt.Errorf("History record has an invalid name length")
+	}
+	name := string(b[12 : 12+name_len])
+	value_len := int(b[12+name_len])
+	if len(b) != 13+name_len+value_len {
+		return nil, fmt.Errorf("History record has an invalid value length")
+	}
+	value := make([]byte, value_len)
+	copy(value, b[13+name_len:])
+	return socket.NewChannelUpdateEvent(name, id, status, value, t), nil
+}
+
+// Record appends a channel update to the store. Updates without a time
+// stamp are recorded with the current time. Retention limits are applied
+// when a new segment is started, and whenever the store exceeds its maximum
+// size.
+func (s *Store) Record(cu *socket.ChannelUpdateEvent) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.read_only {
+		return fmt.Errorf("History store %s is opened read-only", s.dir)
+	}
+	now := time.Now()
+	if cu.UpdatedAt.IsZero() {
+		cu = socket.NewChannelUpdateEvent(cu.ChannelName, cu.ChannelId, cu.Status, cu.Value, now)
+	}
+	if s.segment == nil || s.day != segment_day(now) || (s.retention.MaxSize > 0 && s.size > s.retention.MaxSize) {
+		if err := s.enforce_retention(now); err != nil {
+			return err
+		}
+	}
+	if err := s.open_segment(now); err != nil {
+		return err
+	}
+	record := encode_record(cu)
+	n, err := s.segment.Write(record)
+	s.size += int64(n)
+	return err
+}
+
+// Query returns the updates of the channel named channel_name recorded
+// between from and to included, in chronological order. If channel_name is
+// empty, updates of all channels are returned.
+func (s *Store) Query(channel_name string, from time.Time, to time.Time) ([]*socket.ChannelUpdateEvent, error) {
+	var result []*socket.ChannelUpdateEvent
+
+	// The list of segments and their sizes is taken under the lock, so that
+	// records appended while the segments are read are not returned half
+	// written. Segments trimmed in the meantime are replaced as a whole, and
+	// removed segments are skipped.
+	s.mutex.Lock()
+	segments, err := s.segments()
+	s.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	first, last := segment_day(from), segment_day(to)
+	for _, seg := range segments {
+		if seg.day < first || seg.day > last {
+			continue
+		}
+		_, err := scan_segment(seg.path, seg.size, func(cu *socket.ChannelUpdateEvent) {
+			if channel_name != "" && cu.ChannelName != channel_name {
+				return
+			}
+			if cu.UpdatedAt.Before(from) || cu.UpdatedAt.After(to) {
+				return
+			}
+			result = append(result, cu)
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].UpdatedAt.Before(result[j].UpdatedAt) })
+	return result, nil
+}
+
+// scan_segment calls fn for each record of the first limit bytes of the
+// segment file at path, or of the whole file if limit is negative, and returns
+// the size of the segment up to the end of the last complete record.
+func scan_segment(path string, limit int64, fn func(*socket.ChannelUpdateEvent)) (int64, error) {
+	var header [4]byte
+	var offset int64
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var r io.Reader = bufio.NewReader(f)
+	if limit >= 0 {
+		r = io.LimitReader(r, limit)
+	}
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return offset, nil
+			}
+			return offset, err
+		}
+		length := binary.BigEndian.Uint32(header[:])
+		if length > MAX_RECORD_SIZE {
+			return offset, fmt.Errorf("Corrupted history segment %s: record length %d is too large", path, length)
+		}
+		b := make([]byte, length)
+		if _, err := io.ReadFull(r, b); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				clog.DebugX("Ignoring truncated record at the end of history segment %s", path)
+				return offset, nil
+			}
+			return offset, err
+		}
+		cu, err := decode_record(b)
+		if err != nil {
+			return offset, fmt.Errorf("Corrupted history segment %s: %s", path, err)
+		}
+		fn(cu)
+		offset += int64(len(header) + len(b))
+	}
+}
+
+// ParseTime parses a time given either as an RFC 3339 time stamp, a date
+// (e.g. '2021-02-14'), a number of seconds since the Unix epoch, or a negative
+// duration relative to now (e.g. '-24h'). Positive durations are rejected, as
+// the history does not extend into the future.
+func ParseTime(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		if d > 0 {
+			return time.Time{}, fmt.Errorf("Invalid time '%s', relative times must be in the past, such as '-%s'", s, s)
+		}
+		return now.Add(d), nil
+	}
+	var secs int64
+	if _, err := fmt.Sscanf(s, "%d", &secs); err == nil && fmt.Sprintf("%d", secs) == s {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid time '%s', expected an RFC 3339 time stamp, a date, a Unix time or a duration such as '-24h'", s)
+}
@@ -0,0 +1,271 @@
+package history
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/omzlo/nocand/models/nocan"
+	"github.com/omzlo/nocand/socket"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func test_update(name string, id int, value string, t time.Time) *socket.ChannelUpdateEvent {
+	return socket.NewChannelUpdateEvent(name, nocan.ChannelId(id), socket.CHANNEL_UPDATED, []byte(value), t)
+}
+
+// write_segment writes a segment file for day containing updates.
+func write_segment(t *testing.T, dir string, day string, updates ...*socket.ChannelUpdateEvent) string {
+	var data []byte
+
+	for _, cu := range updates {
+		data = append(data, encode_record(cu)...)
+	}
+	path := filepath.Join(dir, segment_name(day))
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to write segment %s: %s", path, err)
+	}
+	return path
+}
+
+func check_updates(t *testing.T, what string, updates []*socket.ChannelUpdateEvent, expected ...*socket.ChannelUpdateEvent) {
+	t.Helper()
+
+	if len(updates) != len(expected) {
+		t.Errorf("%s: got %d updates, expected %d", what, len(updates), len(expected))
+		for _, cu := range updates {
+			t.Logf("  %s %s=%q", cu.UpdatedAt, cu.ChannelName, cu.Value)
+		}
+		return
+	}
+	for i, cu := range updates {
+		e := expected[i]
+		if cu.ChannelName != e.ChannelName || cu.ChannelId != e.ChannelId || cu.Status != e.Status || !bytes.Equal(cu.Value, e.Value) || !cu.UpdatedAt.Equal(e.UpdatedAt) {
+			t.Errorf("%s: update %d is %s #%d (%d) %q at %s, expected %s #%d (%d) %q at %s", what, i,
+				cu.ChannelName, cu.ChannelId, cu.Status, cu.Value, cu.UpdatedAt,
+				e.ChannelName, e.ChannelId, e.Status, e.Value, e.UpdatedAt)
+		}
+	}
+}
+
+func TestRecordQuery(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir, Retention{})
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	defer store.Close()
+
+	now := time.Now()
+	updates := []*socket.ChannelUpdateEvent{
+		test_update("temperature", 1, "21.5", now.Add(-3*time.Second)),
+		test_update("humidity", 2, "", now.Add(-2*time.Second)),
+		test_update("temperature", 1, string(make([]byte, 255)), now.Add(-1*time.Second)),
+	}
+	for _, cu := range updates {
+		if err := store.Record(cu); err != nil {
+			t.Fatalf("Record failed: %s", err)
+		}
+	}
+
+	from, to := now.Add(-time.Minute), now
+	result, err := store.Query("", from, to)
+	if err != nil {
+		t.Fatalf("Query failed: %s", err)
+	}
+	check_updates(t, "all channels", result, updates...)
+
+	result, err = store.Query("temperature", from, to)
+	if err != nil {
+		t.Fatalf("Query failed: %s", err)
+	}
+	check_updates(t, "one channel", result, updates[0], updates[2])
+
+	result, err = store.Query("", now.Add(-2*time.Second), now.Add(-2*time.Second))
+	if err != nil {
+		t.Fatalf("Query failed: %s", err)
+	}
+	check_updates(t, "time range", result, updates[1])
+
+	// A read-only store sees the same records, and cannot record updates.
+	ro, err := OpenReadOnly(dir)
+	if err != nil {
+		t.Fatalf("OpenReadOnly failed: %s", err)
+	}
+	result, err = ro.Query("", from, to)
+	if err != nil {
+		t.Fatalf("Query failed: %s", err)
+	}
+	check_updates(t, "read-only", result, updates...)
+	if err := ro.Record(updates[0]); err == nil {
+		t.Errorf("Recording in a read-only store succeeded, expected an error")
+	}
+	if _, err := OpenReadOnly(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("Opening a missing store read-only succeeded, expected an error")
+	}
+}
+
+func TestQuerySegments(t *testing.T) {
+	dir := t.TempDir()
+	day1 := time.Date(2021, 2, 13, 23, 0, 0, 0, time.UTC)
+	day2 := time.Date(2021, 2, 14, 1, 0, 0, 0, time.UTC)
+	a := test_update("a", 1, "1", day1)
+	b := test_update("a", 1, "2", day2)
+	write_segment(t, dir, segment_day(day2), b)
+	write_segment(t, dir, segment_day(day1), a)
+	ioutil.WriteFile(filepath.Join(dir, "history-notadate.dat"), []byte("ignored"), 0644)
+
+	store, err := OpenReadOnly(dir)
+	if err != nil {
+		t.Fatalf("OpenReadOnly failed: %s", err)
+	}
+	result, err := store.Query("a", day1.Add(-time.Hour), day2)
+	if err != nil {
+		t.Fatalf("Query failed: %s", err)
+	}
+	check_updates(t, "two days", result, a, b)
+
+	result, err = store.Query("a", day2.Add(-time.Hour), day2.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Query failed: %s", err)
+	}
+	check_updates(t, "second day", result, b)
+}
+
+func TestRetention(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	old := write_segment(t, dir, segment_day(now.Add(-72*time.Hour)), test_update("a", 1, "old", now.Add(-72*time.Hour)))
+	recent := write_segment(t, dir, segment_day(now.Add(-24*time.Hour)), test_update("a", 1, "recent", now.Add(-24*time.Hour)))
+
+	store, err := Open(dir, Retention{MaxAge: 36 * time.Hour})
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	store.Close()
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("Segment %s older than the maximum age was kept", old)
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Errorf("Segment %s within the maximum age was removed: %s", recent, err)
+	}
+
+	// Old segments are removed first when the store is too large.
+	record_size := int64(len(encode_record(test_update("a", 1, "0000", now))))
+	store, err = Open(dir, Retention{MaxSize: 20 * record_size})
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	defer store.Close()
+
+	var updates []*socket.ChannelUpdateEvent
+	for i := 0; i < 50; i++ {
+		cu := test_update("a", 1, fmt.Sprintf("%04d", i), now.Add(time.Duration(i-50)*time.Millisecond))
+		if err := store.Record(cu); err != nil {
+			t.Fatalf("Record failed: %s", err)
+		}
+		updates = append(updates, cu)
+	}
+	if _, err := os.Stat(recent); !os.IsNotExist(err) {
+		t.Errorf("Segment %s was kept although the store exceeds its maximum size", recent)
+	}
+
+	// Once it exceeds the maximum size, the current segment is trimmed to 90%
+	// of it, keeping the most recent records. The last record may be appended
+	// beyond the maximum size.
+	segments, err := store.segments()
+	if err != nil {
+		t.Fatalf("Failed to list segments: %s", err)
+	}
+	if len(segments) != 1 || segments[0].size > 21*record_size {
+		t.Fatalf("Store has segments %v, expected a single segment of at most %d bytes", segments, 21*record_size)
+	}
+	result, err := store.Query("a", now.Add(-time.Minute), now)
+	if err != nil {
+		t.Fatalf("Query failed: %s", err)
+	}
+	if len(result) < 10 {
+		t.Fatalf("Store kept %d records, expected at least 10", len(result))
+	}
+	check_updates(t, "trimmed", result, updates[len(updates)-len(result):]...)
+}
+
+func TestTruncatedSegment(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	a := test_update("a", 1, "1", now.Add(-2*time.Second))
+	b := test_update("a", 1, "2", now.Add(-1*time.Second))
+	c := test_update("a", 1, "3", now)
+
+	// A crash left half of b at the end of the segment of today.
+	path := write_segment(t, dir, segment_day(now), a)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open segment: %s", err)
+	}
+	f.Write(encode_record(b)[:10])
+	f.Close()
+
+	store, err := Open(dir, Retention{})
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	defer store.Close()
+
+	result, err := store.Query("", now.Add(-time.Minute), now)
+	if err != nil {
+		t.Fatalf("Query failed: %s", err)
+	}
+	check_updates(t, "truncated", result, a)
+
+	// The truncated record is removed before appending.
+	if err := store.Record(c); err != nil {
+		t.Fatalf("Record failed: %s", err)
+	}
+	result, err = store.Query("", now.Add(-time.Minute), now)
+	if err != nil {
+		t.Fatalf("Query failed: %s", err)
+	}
+	check_updates(t, "repaired", result, a, c)
+
+	// Records with an invalid length are reported as corruption.
+	ioutil.WriteFile(filepath.Join(dir, segment_name(segment_day(now.Add(-24*time.Hour)))), []byte{0xFF, 0xFF, 0xFF, 0xFF}, 0644)
+	if _, err := store.Query("", now.Add(-48*time.Hour), now); err == nil {
+		t.Errorf("Query of a corrupted segment succeeded, expected an error")
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2021, 2, 14, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		s        string
+		expected time.Time
+	}{
+		{"2021-02-13T10:30:00Z", time.Date(2021, 2, 13, 10, 30, 0, 0, time.UTC)},
+		{"2021-02-13T10:30:00.5+01:00", time.Date(2021, 2, 13, 9, 30, 0, 500000000, time.UTC)},
+		{"2021-02-13", time.Date(2021, 2, 13, 0, 0, 0, 0, time.Local)},
+		{"1613304000", time.Unix(1613304000, 0)},
+		{"-1h", now.Add(-time.Hour)},
+		{"-24h30m", now.Add(-24*time.Hour - 30*time.Minute)},
+		{"0s", now},
+	}
+	for _, test := range tests {
+		parsed, err := ParseTime(test.s, now)
+		if err != nil {
+			t.Errorf("ParseTime(%q) failed: %s", test.s, err)
+			continue
+		}
+		if !parsed.Equal(test.expected) {
+			t.Errorf("ParseTime(%q) returned %s, expected %s", test.s, parsed, test.expected)
+		}
+	}
+
+	for _, s := range []string{"1h", "+24h", "yesterday", "", "12abc", "2021-02-30"} {
+		if parsed, err := ParseTime(s, now); err == nil {
+			t.Errorf("ParseTime(%q) returned %s, expected an error", s, parsed)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package intelhex
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// LoadBinary loads a raw binary image, placing its first byte at address base.
+func (ihex *IntelHex) LoadBinary(r io.Reader, base uint32) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("Failed to read binary firmware: %s", err.Error())
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("Binary firmware is empty")
+	}
+	if uint64(base)+uint64(len(data)) > (1 << 32) {
+		return fmt.Errorf("Binary firmware of %d bytes does not fit in memory at base address 0x%08x", len(data), base)
+	}
+	ihex.Add(DataRecord, base, data)
+	return nil
+}
+
+// SaveBinary writes the data records of the image as a raw binary image,
+// starting at the lowest address of the image. Gaps between blocks are
+// filled with pad.
+func (ihex *IntelHex) SaveBinary(w io.Writer, pad byte) error {
+	start, end, ok := ihex.dataRange()
+	if !ok {
+		return nil
+	}
+	if end-start > 1<<28 {
+		return fmt.Errorf("Binary image would span %d bytes, which is too large", end-start)
+	}
+
+	image := make([]byte, end-start)
+	for i := range image {
+		image[i] = pad
+	}
+	for _, block := range ihex.Blocks {
+		if block.Type == DataRecord {
+			copy(image[uint64(block.Address)-start:], block.Data)
+		}
+	}
+	_, err := w.Write(image)
+	return err
+}
+
+// dataRange returns the lowest address and the address following the
+// highest byte covered by data records in the image.
+func (ihex *IntelHex) dataRange() (uint64, uint64, bool) {
+	var start, end uint64
+	found := false
+
+	for _, block := range ihex.Blocks {
+		if block.Type != DataRecord || len(block.Data) == 0 {
+			continue
+		}
+		bstart := uint64(block.Address)
+		bend := bstart + uint64(len(block.Data))
+		if !found || bstart < start {
+			start = bstart
+		}
+		if !found || bend > end {
+			end = bend
+		}
+		found = true
+	}
+	return start, end, found
+}
@@ -0,0 +1,85 @@
+package intelhex
+
+import (
+	"fmt"
+	"sort"
+)
+
+// AddressRange describes the memory addresses from Start included to End excluded.
+type AddressRange struct {
+	Start uint32 `json:"start"`
+	End   uint32 `json:"end"`
+}
+
+func (ar AddressRange) Len() uint32 {
+	return ar.End - ar.Start
+}
+
+func (ar AddressRange) String() string {
+	return fmt.Sprintf("0x%08x-0x%08x (%d bytes)", ar.Start, ar.End-1, ar.Len())
+}
+
+// ERASED_FLASH is the value of erased flash memory bytes.
+const ERASED_FLASH = 0xFF
+
+// Compare checks that every byte of the data records of ihex is found with the
+// same value in actual, and returns the address ranges that differ.
+// Data in actual that is not covered by ihex, such as the padding of flash
+// memory read back from a node, is ignored. Trailing ERASED_FLASH bytes of a
+// block of ihex may be missing from actual, since they match erased flash that
+// a node does not necessarily return, but they must match if present.
+func (ihex *IntelHex) Compare(actual *IntelHex) []AddressRange {
+	var mismatches []AddressRange
+
+	reference := actual.sortedDataBlocks()
+
+	for _, block := range ihex.sortedDataBlocks() {
+		trimmed := &IntelHexMemBlock{block.Type, block.Address, block.Data}
+		trimmed.Trim(ERASED_FLASH)
+
+		for i, b := range block.Data {
+			address := block.Address + uint32(i)
+			value, ok := lookupByte(reference, address)
+			if ok && value == b {
+				continue
+			}
+			if !ok && i >= len(trimmed.Data) {
+				continue
+			}
+			n := len(mismatches)
+			if n > 0 && mismatches[n-1].End == address {
+				mismatches[n-1].End++
+			} else {
+				mismatches = append(mismatches, AddressRange{address, address + 1})
+			}
+		}
+	}
+	return mismatches
+}
+
+// sortedDataBlocks returns the data records of ihex sorted by address.
+func (ihex *IntelHex) sortedDataBlocks() []*IntelHexMemBlock {
+	blocks := make([]*IntelHexMemBlock, 0, len(ihex.Blocks))
+	for _, block := range ihex.Blocks {
+		if block.Type == DataRecord {
+			blocks = append(blocks, block)
+		}
+	}
+	sort.SliceStable(blocks, func(i, j int) bool {
+		return blocks[i].Address < blocks[j].Address
+	})
+	return blocks
+}
+
+// lookupByte finds the value at address in a list of non-overlapping blocks
+// sorted by address.
+func lookupByte(blocks []*IntelHexMemBlock, address uint32) (byte, bool) {
+	i := sort.Search(len(blocks), func(i int) bool {
+		return blocks[i].Address > address
+	}) - 1
+
+	if i >= 0 && uint64(address) < uint64(blocks[i].Address)+uint64(len(blocks[i].Data)) {
+		return blocks[i].Data[address-blocks[i].Address], true
+	}
+	return 0, false
+}
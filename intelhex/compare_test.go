@@ -0,0 +1,60 @@
+package intelhex
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	reference := new_test_image(data_block(0x2000, 1, 2, 3, 4), data_block(0x3000, 5, 6))
+
+	tests := []struct {
+		what     string
+		actual   *IntelHex
+		expected []AddressRange
+	}{
+		{"identical", new_test_image(data_block(0x2000, 1, 2, 3, 4), data_block(0x3000, 5, 6)), nil},
+		{"padded", new_test_image(data_block(0x1FF0, make([]byte, 0x10)...), data_block(0x2000, 1, 2, 3, 4, 0xFF, 0xFF), data_block(0x3000, 5, 6)), nil},
+		{"different", new_test_image(data_block(0x2000, 1, 0, 0, 4), data_block(0x3000, 5, 0)), []AddressRange{{0x2001, 0x2003}, {0x3001, 0x3002}}},
+		{"missing", new_test_image(data_block(0x2000, 1, 2)), []AddressRange{{0x2002, 0x2004}, {0x3000, 0x3002}}},
+		{"empty", New(), []AddressRange{{0x2000, 0x2004}, {0x3000, 0x3002}}},
+	}
+	for _, test := range tests {
+		if mismatches := reference.Compare(test.actual); !reflect.DeepEqual(mismatches, test.expected) {
+			t.Errorf("%s: mismatches are %v, expected %v", test.what, mismatches, test.expected)
+		}
+	}
+}
+
+func TestCompareErasedFlash(t *testing.T) {
+	reference := new_test_image(data_block(0x2000, 1, 0xFF, 2, 0xFF, 0xFF))
+
+	tests := []struct {
+		what     string
+		actual   *IntelHex
+		expected []AddressRange
+	}{
+		// Trailing 0xFF bytes missing from the download match erased flash.
+		{"trailing 0xFF missing", new_test_image(data_block(0x2000, 1, 0xFF, 2)), nil},
+		{"trailing 0xFF partly missing", new_test_image(data_block(0x2000, 1, 0xFF, 2, 0xFF)), nil},
+		// They must match if they were downloaded.
+		{"trailing 0xFF different", new_test_image(data_block(0x2000, 1, 0xFF, 2, 0xFF, 0x00)), []AddressRange{{0x2004, 0x2005}}},
+		// 0xFF bytes followed by other data are not trailing.
+		{"inner 0xFF missing", new_test_image(data_block(0x2000, 1), data_block(0x2002, 2)), []AddressRange{{0x2001, 0x2002}}},
+		{"data missing", new_test_image(data_block(0x2000, 1, 0xFF)), []AddressRange{{0x2002, 0x2003}}},
+	}
+	for _, test := range tests {
+		if mismatches := reference.Compare(test.actual); !reflect.DeepEqual(mismatches, test.expected) {
+			t.Errorf("%s: mismatches are %v, expected %v", test.what, mismatches, test.expected)
+		}
+	}
+
+	block := &IntelHexMemBlock{DataRecord, 0, []byte{0xFF, 1, 0xFF, 0xFF}}
+	if n := block.Trim(0xFF); n != 2 || !reflect.DeepEqual(block.Data, []byte{0xFF, 1}) {
+		t.Errorf("Trim removed %d bytes leaving % x, expected 2 bytes leaving ff 01", n, block.Data)
+	}
+	block = &IntelHexMemBlock{DataRecord, 0, []byte{0xFF, 0xFF}}
+	if n := block.Trim(0xFF); n != 2 || len(block.Data) != 0 {
+		t.Errorf("Trim removed %d bytes leaving % x, expected 2 bytes leaving nothing", n, block.Data)
+	}
+}
@@ -0,0 +1,101 @@
+package intelhex
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// DIGEST_PAD is the value of the gaps between blocks when computing digests.
+const DIGEST_PAD = 0xFF
+
+// Digest identifies the content of a firmware image, independently of its
+// file format and of how its data is split into records.
+type Digest struct {
+	CRC32  uint32
+	SHA256 [sha256.Size]byte
+}
+
+// Digest computes the CRC32 (IEEE) and SHA-256 of the normalized image, as
+// it would be saved by SaveBinary with DIGEST_PAD filling gaps between
+// blocks. Blocks are hashed one after the other and gaps are hashed in small
+// chunks, so that sparse images spanning a large address range can be
+// digested without allocating memory for their gaps. It returns an
+// *OverlapError if data records overlap.
+func (ihex *IntelHex) Digest() (*Digest, error) {
+	var digest Digest
+	var fill [4096]byte
+	var end uint64
+	started := false
+
+	normalized, err := Merge(ihex)
+	if err != nil {
+		return nil, err
+	}
+	for i := range fill {
+		fill[i] = DIGEST_PAD
+	}
+	crc := crc32.NewIEEE()
+	sha := sha256.New()
+	w := io.MultiWriter(crc, sha)
+	for _, block := range normalized.Blocks {
+		if block.Type != DataRecord {
+			continue
+		}
+		if started {
+			for gap := uint64(block.Address) - end; gap > 0; {
+				n := uint64(len(fill))
+				if n > gap {
+					n = gap
+				}
+				w.Write(fill[:n])
+				gap -= n
+			}
+		}
+		w.Write(block.Data)
+		end = uint64(block.Address) + uint64(len(block.Data))
+		started = true
+	}
+	digest.CRC32 = crc.Sum32()
+	copy(digest.SHA256[:], sha.Sum(nil))
+	return &digest, nil
+}
+
+func (d *Digest) CRC32String() string {
+	return fmt.Sprintf("%08x", d.CRC32)
+}
+
+func (d *Digest) SHA256String() string {
+	return hex.EncodeToString(d.SHA256[:])
+}
+
+func (d *Digest) String() string {
+	return fmt.Sprintf("crc32 %s, sha256 %s", d.CRC32String(), d.SHA256String())
+}
+
+func (d *Digest) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{"crc32": d.CRC32String(), "sha256": d.SHA256String()})
+}
+
+func (d *Digest) UnmarshalJSON(data []byte) error {
+	var v struct {
+		CRC32  string `json:"crc32"`
+		SHA256 string `json:"sha256"`
+	}
+
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if _, err := fmt.Sscanf(v.CRC32, "%08x", &d.CRC32); err != nil {
+		return fmt.Errorf("Invalid CRC32 digest '%s'", v.CRC32)
+	}
+	sha, err := hex.DecodeString(v.SHA256)
+	if err != nil || len(sha) != len(d.SHA256) {
+		return fmt.Errorf("Invalid SHA-256 digest '%s'", v.SHA256)
+	}
+	copy(d.SHA256[:], sha)
+	return nil
+}
@@ -0,0 +1,68 @@
+package intelhex
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"testing"
+)
+
+func TestDigest(t *testing.T) {
+	ihex := new_test_image(data_block(0x2004, 3, 4), data_block(0x2000, 1))
+	digest, err := ihex.Digest()
+	if err != nil {
+		t.Fatalf("Digest failed: %s", err)
+	}
+
+	// The digest is the one of the image saved as binary, with gaps filled with 0xFF.
+	binary := []byte{1, 0xFF, 0xFF, 0xFF, 3, 4}
+	if digest.CRC32 != crc32.ChecksumIEEE(binary) || digest.SHA256 != sha256.Sum256(binary) {
+		t.Errorf("Digest is %s, expected the digest of % x", digest, binary)
+	}
+
+	// It does not depend on how data is split into records.
+	split := new_test_image(data_block(0x2000, 1), data_block(0x2004, 3), data_block(0x2005, 4))
+	split.Blocks = append(split.Blocks, &IntelHexMemBlock{StartLinearAddressRecord, 0, nil})
+	if other, err := split.Digest(); err != nil || *other != *digest {
+		t.Errorf("Digest of the split image is %s (%v), expected %s", other, err, digest)
+	}
+
+	if _, err := new_test_image(data_block(0x2000, 1, 2), data_block(0x2001, 3)).Digest(); err == nil {
+		t.Errorf("Digest of overlapping data succeeded, expected an error")
+	}
+
+	data, err := json.Marshal(digest)
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+	var decoded Digest
+	if err := json.Unmarshal(data, &decoded); err != nil || decoded != *digest {
+		t.Errorf("Digest %s was decoded from %s as %s (%v)", digest, data, &decoded, err)
+	}
+}
+
+func TestDigestSparse(t *testing.T) {
+	// The gap of nearly 256MB is hashed without being allocated.
+	ihex := new_test_image(data_block(0x2000, 1), data_block(0x10000000, 2))
+	digest, err := ihex.Digest()
+	if err != nil {
+		t.Fatalf("Digest of a sparse image failed: %s", err)
+	}
+
+	crc := crc32.NewIEEE()
+	sha := sha256.New()
+	out := io.MultiWriter(crc, sha)
+	fill := bytes.Repeat([]byte{DIGEST_PAD}, 1<<20)
+	gap := 0x10000000 - 0x2001
+	out.Write([]byte{1})
+	for ; gap > len(fill); gap -= len(fill) {
+		out.Write(fill)
+	}
+	out.Write(fill[:gap])
+	out.Write([]byte{2})
+	if digest.CRC32 != crc.Sum32() || !bytes.Equal(digest.SHA256[:], sha.Sum(nil)) {
+		t.Errorf("Digest of the sparse image is %s, expected crc32 %08x", digest, crc.Sum32())
+	}
+}
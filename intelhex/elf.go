@@ -0,0 +1,40 @@
+package intelhex
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+)
+
+// LoadElf loads the PT_LOAD segments of an ELF executable. Segments are
+// placed at their physical (load) address, which is where they live in flash.
+func (ihex *IntelHex) LoadElf(r io.ReaderAt) error {
+	file, err := elf.NewFile(r)
+	if err != nil {
+		return fmt.Errorf("Failed to parse ELF file: %s", err.Error())
+	}
+	defer file.Close()
+
+	count := 0
+	for i, prog := range file.Progs {
+		if prog.Type != elf.PT_LOAD || prog.Filesz == 0 {
+			continue
+		}
+		if prog.Paddr+prog.Filesz > (1 << 32) {
+			return fmt.Errorf("ELF segment %d at 0x%x does not fit in a 32 bit address space", i, prog.Paddr)
+		}
+		data := make([]byte, prog.Filesz)
+		if _, err := prog.ReadAt(data, 0); err != nil {
+			return fmt.Errorf("Failed to read ELF segment %d: %s", i, err.Error())
+		}
+		ihex.Add(DataRecord, uint32(prog.Paddr), data)
+		count++
+	}
+	if count == 0 {
+		return fmt.Errorf("ELF file does not contain any loadable segment")
+	}
+	if file.Entry != 0 && file.Entry < (1<<32) {
+		ihex.Start = &StartAddress{StartLinearAddressRecord, uint32(file.Entry)}
+	}
+	return nil
+}
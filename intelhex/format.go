@@ -0,0 +1,150 @@
+package intelhex
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Format int
+
+const (
+	FormatUnknown Format = iota
+	FormatIntelHex
+	FormatSrec
+	FormatBinary
+	FormatElf
+)
+
+const elf_magic = "\x7fELF"
+
+// format_head_size is the number of bytes read to guess the format of a file.
+const format_head_size = 512
+
+var formatStrings = [...]string{"unknown", "ihex", "srec", "bin", "elf"}
+
+func (f Format) String() string {
+	if int(f) < len(formatStrings) {
+		return formatStrings[f]
+	}
+	return formatStrings[FormatUnknown]
+}
+
+// FormatFromExtension guesses the format of a firmware file from its name.
+func FormatFromExtension(filename string) Format {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".hex", ".ihex", ".ihx":
+		return FormatIntelHex
+	case ".srec", ".s19", ".s28", ".s37", ".mot":
+		return FormatSrec
+	case ".bin":
+		return FormatBinary
+	case ".elf", ".axf":
+		return FormatElf
+	}
+	return FormatUnknown
+}
+
+// FormatFromContent guesses the format of a firmware image from its first
+// bytes. Raw binary images cannot be recognized, so content that does not
+// look like another format is reported as FormatUnknown.
+func FormatFromContent(head []byte) Format {
+	switch {
+	case bytes.HasPrefix(head, []byte(elf_magic)):
+		return FormatElf
+	case len(head) > 0 && head[0] == ':':
+		return FormatIntelHex
+	case len(head) > 1 && head[0] == 'S' && head[1] >= '0' && head[1] <= '9':
+		return FormatSrec
+	}
+	return FormatUnknown
+}
+
+// DetectFormat determines the format of a firmware file from its name, and
+// falls back to its content if the extension is not recognized. Raw binary
+// images are only recognized by their .bin extension.
+func DetectFormat(filename string, head []byte) Format {
+	if f := FormatFromExtension(filename); f != FormatUnknown {
+		return f
+	}
+	return FormatFromContent(head)
+}
+
+// LoadFormat loads a firmware image in the given format. The base address is
+// only used for raw binary images.
+func (ihex *IntelHex) LoadFormat(r io.Reader, format Format, base uint32) error {
+	switch format {
+	case FormatIntelHex:
+		return ihex.Load(r)
+	case FormatSrec:
+		return ihex.LoadSrec(r)
+	case FormatBinary:
+		return ihex.LoadBinary(r, base)
+	case FormatElf:
+		if ra, ok := r.(io.ReaderAt); ok {
+			return ihex.LoadElf(ra)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return ihex.LoadElf(bytes.NewReader(data))
+	}
+	return fmt.Errorf("Unrecognized firmware format, use a .hex, .srec, .elf or .bin file name")
+}
+
+// SaveFormat saves a firmware image in the given format. ELF output is not supported.
+func (ihex *IntelHex) SaveFormat(w io.Writer, format Format) error {
+	switch format {
+	case FormatIntelHex:
+		return ihex.Save(w)
+	case FormatSrec:
+		return ihex.SaveSrec(w)
+	case FormatBinary:
+		return ihex.SaveBinary(w, 0xFF)
+	}
+	return fmt.Errorf("Saving firmware in %s format is not supported", format)
+}
+
+// LoadReader loads a firmware image from r, guessing its format from
+// filename and from its first bytes. Text formats are parsed as they are
+// read, without buffering the whole file.
+func LoadReader(r io.Reader, filename string, base uint32) (*IntelHex, error) {
+	ihex, _, err := LoadReaderFormat(r, filename, base)
+	return ihex, err
+}
+
+// LoadReaderFormat is like LoadReader, and also returns the detected format.
+func LoadReaderFormat(r io.Reader, filename string, base uint32) (*IntelHex, Format, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(format_head_size)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, FormatUnknown, err
+	}
+
+	format := DetectFormat(filename, head)
+	if format == FormatUnknown {
+		return nil, format, fmt.Errorf("Unrecognized firmware format, use a .hex, .srec, .elf or .bin file name")
+	}
+	ihex := New()
+	if err := ihex.LoadFormat(br, format, base); err != nil {
+		return nil, format, fmt.Errorf("%s parser: %s", format, err.Error())
+	}
+	return ihex, format, nil
+}
+
+// LoadFile loads a firmware file, guessing its format from its name and content.
+func LoadFile(filename string, base uint32) (*IntelHex, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return LoadReader(file, filename, base)
+}
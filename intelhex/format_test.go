@@ -0,0 +1,262 @@
+package intelhex
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestLoadSrec(t *testing.T) {
+	data := strings.Join([]string{
+		"S0060000686472BB",
+		"S1061234010203AD",
+		"S206123456040554",
+		"S3061234567806DF",
+		"S5030003F9",
+		"S70500002000DA",
+		"S1061234010203AD",
+	}, "\n")
+
+	ihex := New()
+	if err := ihex.LoadSrec(strings.NewReader(data)); err != nil {
+		t.Fatalf("LoadSrec failed: %s", err)
+	}
+	// Records after the termination record are ignored.
+	check_blocks(t, "srec", ihex, data_block(0x1234, 1, 2, 3), data_block(0x123456, 4, 5), data_block(0x12345678, 6))
+	if ihex.Start == nil || *ihex.Start != (StartAddress{StartLinearAddressRecord, 0x2000}) {
+		t.Errorf("Start address is %v, expected 0x00002000", ihex.Start)
+	}
+
+	// Termination records are optional, and a zero start address is ignored.
+	for _, data := range []string{"S1061234010203AD\n", "S1061234010203AD\nS804000000FB\n"} {
+		ihex = New()
+		if err := ihex.LoadSrec(strings.NewReader(data)); err != nil {
+			t.Fatalf("LoadSrec of %q failed: %s", data, err)
+		}
+		check_blocks(t, "srec without start", ihex, data_block(0x1234, 1, 2, 3))
+		if ihex.Start != nil {
+			t.Errorf("Start address of %q is %v, expected none", data, ihex.Start)
+		}
+	}
+}
+
+func TestLoadSrecErrors(t *testing.T) {
+	for _, data := range []string{
+		"S1061234010203AE",    // S1 checksum
+		"S206123456040555",    // S2 checksum
+		"S3061234567806D0",    // S3 checksum
+		"S1071234010203AD",    // length does not match
+		"S4061234010203AD",    // unknown record type
+		"S3030000FC",          // too short for a 4 byte address
+		"S10612340102ZZAD",    // not hexadecimal
+		":0100000001FE",       // not an S-record
+		"S1061234010203AD\nX", // invalid second line
+	} {
+		if err := New().LoadSrec(strings.NewReader(data)); err == nil {
+			t.Errorf("LoadSrec of %q succeeded, expected an error", data)
+		}
+	}
+}
+
+func TestSaveSrec(t *testing.T) {
+	tests := []struct {
+		address uint32
+		start   uint32
+		types   string
+	}{
+		{0x1000, 0, "019"},
+		{0x1000, 0x123456, "028"},
+		{0x123456, 0, "028"},
+		{0x12345678, 0x12345678, "037"},
+	}
+	for _, test := range tests {
+		ihex := new_test_image(data_block(test.address, 1, 2, 3))
+		if test.start != 0 {
+			ihex.Start = &StartAddress{StartLinearAddressRecord, test.start}
+		}
+		var out bytes.Buffer
+		if err := ihex.SaveSrec(&out); err != nil {
+			t.Fatalf("SaveSrec failed: %s", err)
+		}
+		types := ""
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			types += line[1:2]
+		}
+		if types != test.types {
+			t.Errorf("Image at 0x%x with start 0x%x saved as S%s records, expected S%s", test.address, test.start, types, test.types)
+		}
+
+		loaded := New()
+		if err := loaded.LoadSrec(&out); err != nil {
+			t.Fatalf("LoadSrec failed: %s", err)
+		}
+		check_blocks(t, "srec round trip", loaded, data_block(test.address, 1, 2, 3))
+	}
+}
+
+type test_segment struct {
+	ptype elf.ProgType
+	paddr uint32
+	vaddr uint32
+	data  []byte
+	memsz uint32
+}
+
+// make_elf builds a little endian 32 bit ARM executable with the given
+// program headers and no section headers.
+func make_elf(entry uint32, segments ...test_segment) []byte {
+	var out bytes.Buffer
+
+	header := elf.Header32{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_ARM),
+		Version:   uint32(elf.EV_CURRENT),
+		Entry:     entry,
+		Phoff:     52,
+		Ehsize:    52,
+		Phentsize: 32,
+		Phnum:     uint16(len(segments)),
+	}
+	copy(header.Ident[:], elf_magic)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	binary.Write(&out, binary.LittleEndian, &header)
+
+	offset := uint32(52 + 32*len(segments))
+	for _, s := range segments {
+		binary.Write(&out, binary.LittleEndian, &elf.Prog32{
+			Type:   uint32(s.ptype),
+			Off:    offset,
+			Vaddr:  s.vaddr,
+			Paddr:  s.paddr,
+			Filesz: uint32(len(s.data)),
+			Memsz:  s.memsz,
+			Flags:  uint32(elf.PF_R),
+			Align:  4,
+		})
+		offset += uint32(len(s.data))
+	}
+	for _, s := range segments {
+		out.Write(s.data)
+	}
+	return out.Bytes()
+}
+
+func TestLoadElf(t *testing.T) {
+	data := make_elf(0x2101,
+		test_segment{ptype: elf.PT_LOAD, paddr: 0x2000, vaddr: 0x2000, data: []byte{1, 2, 3, 4}, memsz: 4},
+		// .data is loaded from flash at its physical address, and .bss
+		// (memsz beyond filesz) is not part of the image.
+		test_segment{ptype: elf.PT_LOAD, paddr: 0x2004, vaddr: 0x20000000, data: []byte{5, 6}, memsz: 0x100},
+		test_segment{ptype: elf.PT_LOAD, paddr: 0x3000, vaddr: 0x20000100, memsz: 0x40},
+		test_segment{ptype: elf.PT_NOTE, paddr: 0x4000, data: []byte{7, 8}, memsz: 2},
+	)
+
+	ihex := New()
+	if err := ihex.LoadElf(bytes.NewReader(data)); err != nil {
+		t.Fatalf("LoadElf failed: %s", err)
+	}
+	check_blocks(t, "elf", ihex, data_block(0x2000, 1, 2, 3, 4, 5, 6))
+	if ihex.Start == nil || *ihex.Start != (StartAddress{StartLinearAddressRecord, 0x2101}) {
+		t.Errorf("Start address is %v, expected 0x00002101", ihex.Start)
+	}
+
+	// LoadReader buffers ELF files, which need random access.
+	loaded, err := LoadReader(bytes.NewReader(data), "firmware", 0)
+	if err != nil {
+		t.Fatalf("LoadReader failed: %s", err)
+	}
+	check_blocks(t, "elf reader", loaded, data_block(0x2000, 1, 2, 3, 4, 5, 6))
+
+	empty := make_elf(0, test_segment{ptype: elf.PT_LOAD, paddr: 0x3000, memsz: 0x40})
+	if err := New().LoadElf(bytes.NewReader(empty)); err == nil {
+		t.Errorf("Loading an ELF file without loadable data succeeded, expected an error")
+	}
+	if err := New().LoadElf(bytes.NewReader(data[:40])); err == nil {
+		t.Errorf("Loading a truncated ELF file succeeded, expected an error")
+	}
+}
+
+func TestLoadBinary(t *testing.T) {
+	ihex := New()
+	if err := ihex.LoadBinary(bytes.NewReader([]byte{1, 2, 3}), 0x2000); err != nil {
+		t.Fatalf("LoadBinary failed: %s", err)
+	}
+	check_blocks(t, "binary", ihex, data_block(0x2000, 1, 2, 3))
+
+	if err := New().LoadBinary(bytes.NewReader(nil), 0x2000); err == nil {
+		t.Errorf("Loading an empty binary succeeded, expected an error")
+	}
+	if err := New().LoadBinary(bytes.NewReader([]byte{1, 2}), 0xFFFFFFFF); err == nil {
+		t.Errorf("Loading a binary beyond the 32 bit address space succeeded, expected an error")
+	}
+
+	var out bytes.Buffer
+	ihex = new_test_image(data_block(0x2004, 3), data_block(0x2000, 1, 2))
+	if err := ihex.SaveBinary(&out, 0xEE); err != nil {
+		t.Fatalf("SaveBinary failed: %s", err)
+	}
+	if expected := []byte{1, 2, 0xEE, 0xEE, 3}; !bytes.Equal(out.Bytes(), expected) {
+		t.Errorf("SaveBinary wrote % x, expected % x", out.Bytes(), expected)
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		filename string
+		head     string
+		expected Format
+	}{
+		{"app.hex", "", FormatIntelHex},
+		{"APP.IHX", "", FormatIntelHex},
+		{"app.s19", "", FormatSrec},
+		{"app.mot", "", FormatSrec},
+		{"app.bin", ":0100000001FE", FormatBinary},
+		{"app.axf", "", FormatElf},
+		{"app.hex", "S1061234010203AD", FormatIntelHex},
+		{"firmware", ":0100000001FE", FormatIntelHex},
+		{"firmware.txt", "S1061234010203AD", FormatSrec},
+		{"firmware", elf_magic + "\x01\x01", FormatElf},
+		{"firmware", "\x00\x01\x02", FormatUnknown},
+		{"firmware", "Sx", FormatUnknown},
+		{"firmware", "", FormatUnknown},
+	}
+	for _, test := range tests {
+		if format := DetectFormat(test.filename, []byte(test.head)); format != test.expected {
+			t.Errorf("DetectFormat(%q, %q) returned %s, expected %s", test.filename, test.head, format, test.expected)
+		}
+	}
+}
+
+func TestLoadReaderFormat(t *testing.T) {
+	tests := []struct {
+		filename string
+		data     string
+		format   Format
+	}{
+		{"firmware", ":021234000102B5\n:00000001FF\n", FormatIntelHex},
+		{"firmware", "S1061234010203AD\n", FormatSrec},
+		{"firmware.bin", "\x01\x02", FormatBinary},
+	}
+	for _, test := range tests {
+		_, format, err := LoadReaderFormat(strings.NewReader(test.data), test.filename, 0x1234)
+		if err != nil {
+			t.Errorf("Loading %s failed: %s", test.format, err)
+			continue
+		}
+		if format != test.format {
+			t.Errorf("%q was loaded as %s, expected %s", test.data, format, test.format)
+		}
+	}
+
+	// Raw binary images are only recognized by their extension.
+	if _, _, err := LoadReaderFormat(strings.NewReader("\x01\x02"), "firmware", 0); err == nil {
+		t.Errorf("Loading unrecognized content succeeded, expected an error")
+	}
+	if _, _, err := LoadReaderFormat(strings.NewReader(":021234000102B6\n:00000001FF\n"), "app.hex", 0); err == nil {
+		t.Errorf("Loading a hex file with a checksum error succeeded, expected an error")
+	}
+}
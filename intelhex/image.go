@@ -0,0 +1,245 @@
+package intelhex
+
+import (
+	"fmt"
+)
+
+// OverlapError reports addresses where data is defined more than once.
+type OverlapError struct {
+	Range AddressRange
+}
+
+func (e *OverlapError) Error() string {
+	return fmt.Sprintf("Overlapping data at %s", e.Range)
+}
+
+// IterateBlocks calls fn for each block of the image, in order, with extra as
+// its last argument. It stops at the first error returned by fn.
+func (ihex *IntelHex) IterateBlocks(fn func(uint8, uint32, []byte, interface{}) error, extra interface{}) error {
+	for _, block := range ihex.Blocks {
+		if err := fn(block.Type, block.Address, block.Data, extra); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ihex *IntelHex) update_size() {
+	ihex.Size = 0
+	for _, block := range ihex.Blocks {
+		ihex.Size += uint(len(block.Data))
+	}
+}
+
+// otherBlocks returns the blocks of ihex that are not data records.
+func (ihex *IntelHex) otherBlocks() []*IntelHexMemBlock {
+	var blocks []*IntelHexMemBlock
+
+	for _, block := range ihex.Blocks {
+		if block.Type != DataRecord {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
+
+// MemoryMap returns the address ranges covered by data records, sorted by
+// address. Contiguous and overlapping blocks are reported as a single range.
+func (ihex *IntelHex) MemoryMap() []AddressRange {
+	var ranges []AddressRange
+
+	for _, block := range ihex.sortedDataBlocks() {
+		if len(block.Data) == 0 {
+			continue
+		}
+		end := block.Address + uint32(len(block.Data))
+		n := len(ranges)
+		if n > 0 && block.Address <= ranges[n-1].End {
+			if end > ranges[n-1].End {
+				ranges[n-1].End = end
+			}
+			continue
+		}
+		ranges = append(ranges, AddressRange{block.Address, end})
+	}
+	return ranges
+}
+
+// Normalize sorts data records by address and joins contiguous ones, so that
+// the image has one block for each range of its memory map. It returns an
+// *OverlapError if data records overlap, in which case ihex is not modified.
+func (ihex *IntelHex) Normalize() error {
+	var blocks []*IntelHexMemBlock
+
+	for _, block := range ihex.sortedDataBlocks() {
+		if len(block.Data) == 0 {
+			continue
+		}
+		n := len(blocks)
+		if n > 0 {
+			last := blocks[n-1]
+			last_end := last.Address + uint32(len(last.Data))
+			if block.Address < last_end {
+				end := block.Address + uint32(len(block.Data))
+				if end > last_end {
+					end = last_end
+				}
+				return &OverlapError{AddressRange{block.Address, end}}
+			}
+			if block.Address == last_end {
+				last.Data = append(last.Data, block.Data...)
+				continue
+			}
+		}
+		data := make([]byte, len(block.Data))
+		copy(data, block.Data)
+		blocks = append(blocks, &IntelHexMemBlock{DataRecord, block.Address, data})
+	}
+	ihex.Blocks = append(blocks, ihex.otherBlocks()...)
+	ihex.update_size()
+	return nil
+}
+
+// Merge returns a normalized image combining the data records of all images,
+// such as a bootloader and an application. It returns an *OverlapError if
+// two images define data at the same address. The merged image keeps the
+// addressing mode and record length of the first image, and the first start
+// address found.
+func Merge(images ...*IntelHex) (*IntelHex, error) {
+	merged := New()
+
+	if len(images) > 0 {
+		merged.Addressing = images[0].Addressing
+		merged.RecordLength = images[0].RecordLength
+	}
+	for _, image := range images {
+		if merged.Start == nil && image.Start != nil {
+			start := *image.Start
+			merged.Start = &start
+		}
+		for _, block := range image.Blocks {
+			data := make([]byte, len(block.Data))
+			copy(data, block.Data)
+			merged.Blocks = append(merged.Blocks, &IntelHexMemBlock{block.Type, block.Address, data})
+		}
+	}
+	if err := merged.Normalize(); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+// Fill fills the gaps between data records with pad, from address start
+// included to address end excluded. The image is normalized first.
+func (ihex *IntelHex) Fill(start uint32, end uint32, pad byte) error {
+	if err := ihex.Normalize(); err != nil {
+		return err
+	}
+
+	address := start
+	for _, r := range ihex.MemoryMap() {
+		if address >= end {
+			break
+		}
+		if r.Start > address {
+			gap_end := r.Start
+			if gap_end > end {
+				gap_end = end
+			}
+			ihex.Add(DataRecord, address, pad_bytes(gap_end-address, pad))
+		}
+		if r.End > address {
+			address = r.End
+		}
+	}
+	if address < end {
+		ihex.Add(DataRecord, address, pad_bytes(end-address, pad))
+	}
+	return ihex.Normalize()
+}
+
+func pad_bytes(length uint32, pad byte) []byte {
+	data := make([]byte, length)
+	for i := range data {
+		data[i] = pad
+	}
+	return data
+}
+
+// Crop removes data outside the addresses from start included to end excluded.
+func (ihex *IntelHex) Crop(start uint32, end uint32) {
+	var blocks []*IntelHexMemBlock
+
+	for _, block := range ihex.Blocks {
+		if block.Type != DataRecord {
+			blocks = append(blocks, block)
+			continue
+		}
+		bstart := uint64(block.Address)
+		bend := bstart + uint64(len(block.Data))
+		if bstart < uint64(start) {
+			bstart = uint64(start)
+		}
+		if bend > uint64(end) {
+			bend = uint64(end)
+		}
+		if bstart >= bend {
+			continue
+		}
+		offset := bstart - uint64(block.Address)
+		blocks = append(blocks, &IntelHexMemBlock{DataRecord, uint32(bstart), block.Data[offset : offset+bend-bstart]})
+	}
+	ihex.Blocks = blocks
+	ihex.update_size()
+}
+
+// Relocate moves all data records by offset bytes, which may be negative.
+func (ihex *IntelHex) Relocate(offset int64) error {
+	for _, block := range ihex.Blocks {
+		if block.Type != DataRecord {
+			continue
+		}
+		address := int64(block.Address) + offset
+		if address < 0 || address+int64(len(block.Data)) > 1<<32 {
+			return fmt.Errorf("Relocating block at 0x%08x by %d bytes would move it out of the 32 bit address space", block.Address, offset)
+		}
+	}
+	for _, block := range ihex.Blocks {
+		if block.Type == DataRecord {
+			block.Address = uint32(int64(block.Address) + offset)
+		}
+	}
+	return nil
+}
+
+// Split normalizes the image and splits its data records at page_size
+// boundaries, so that no block spans more than one page.
+func (ihex *IntelHex) Split(page_size uint32) error {
+	var blocks []*IntelHexMemBlock
+
+	if page_size == 0 {
+		return fmt.Errorf("Page size must be greater than 0")
+	}
+	if err := ihex.Normalize(); err != nil {
+		return err
+	}
+	for _, block := range ihex.Blocks {
+		if block.Type != DataRecord {
+			blocks = append(blocks, block)
+			continue
+		}
+		address := uint64(block.Address)
+		data := block.Data
+		for len(data) > 0 {
+			length := uint64(page_size) - address%uint64(page_size)
+			if length > uint64(len(data)) {
+				length = uint64(len(data))
+			}
+			blocks = append(blocks, &IntelHexMemBlock{DataRecord, uint32(address), data[:length]})
+			address += length
+			data = data[length:]
+		}
+	}
+	ihex.Blocks = blocks
+	return nil
+}
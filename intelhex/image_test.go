@@ -0,0 +1,199 @@
+package intelhex
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func new_test_image(blocks ...*IntelHexMemBlock) *IntelHex {
+	ihex := New()
+	for _, block := range blocks {
+		ihex.Blocks = append(ihex.Blocks, &IntelHexMemBlock{block.Type, block.Address, append([]byte(nil), block.Data...)})
+	}
+	ihex.update_size()
+	return ihex
+}
+
+func data_block(address uint32, data ...byte) *IntelHexMemBlock {
+	return &IntelHexMemBlock{DataRecord, address, data}
+}
+
+func check_blocks(t *testing.T, what string, ihex *IntelHex, expected ...*IntelHexMemBlock) {
+	t.Helper()
+
+	if len(ihex.Blocks) != len(expected) {
+		t.Errorf("%s: got %d blocks, expected %d", what, len(ihex.Blocks), len(expected))
+		for _, block := range ihex.Blocks {
+			t.Logf("  block at 0x%08x: % x", block.Address, block.Data)
+		}
+		return
+	}
+	size := uint(0)
+	for i, block := range ihex.Blocks {
+		if block.Type != expected[i].Type || block.Address != expected[i].Address || !bytes.Equal(block.Data, expected[i].Data) {
+			t.Errorf("%s: block %d is type %d at 0x%08x with % x, expected type %d at 0x%08x with % x", what, i, block.Type, block.Address, block.Data, expected[i].Type, expected[i].Address, expected[i].Data)
+		}
+		size += uint(len(expected[i].Data))
+	}
+	if ihex.Size != size {
+		t.Errorf("%s: size is %d, expected %d", what, ihex.Size, size)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	bootloader := new_test_image(data_block(0x0000, 1, 2, 3, 4))
+	application := new_test_image(data_block(0x2000, 5, 6), data_block(0x0004, 7, 8))
+	application.Start = &StartAddress{StartLinearAddressRecord, 0x2000}
+	bootloader.Addressing = AddressingSegment
+	bootloader.RecordLength = 32
+
+	merged, err := Merge(bootloader, application)
+	if err != nil {
+		t.Fatalf("Merge failed: %s", err)
+	}
+	check_blocks(t, "merged", merged, data_block(0x0000, 1, 2, 3, 4, 7, 8), data_block(0x2000, 5, 6))
+	if merged.Start == nil || *merged.Start != *application.Start {
+		t.Errorf("Merged start address is %v, expected %v", merged.Start, application.Start)
+	}
+	if merged.Addressing != AddressingSegment || merged.RecordLength != 32 {
+		t.Errorf("Merged image uses %s addressing with %d byte records, expected those of the first image", merged.Addressing, merged.RecordLength)
+	}
+
+	// The merged image does not share data with its sources.
+	merged.Blocks[0].Data[0] = 0xFF
+	if bootloader.Blocks[0].Data[0] != 1 {
+		t.Errorf("Modifying the merged image modified its source")
+	}
+}
+
+func TestMergeOverlap(t *testing.T) {
+	tests := []struct {
+		a, b     *IntelHexMemBlock
+		expected AddressRange
+	}{
+		{data_block(0x100, 1, 2, 3, 4), data_block(0x102, 5, 6, 7, 8), AddressRange{0x102, 0x104}},
+		{data_block(0x102, 5, 6, 7, 8), data_block(0x100, 1, 2, 3, 4), AddressRange{0x102, 0x104}},
+		{data_block(0x100, 1, 2, 3, 4), data_block(0x101, 5), AddressRange{0x101, 0x102}},
+		{data_block(0x100, 1, 2), data_block(0x100, 1, 2), AddressRange{0x100, 0x102}},
+	}
+	for _, test := range tests {
+		_, err := Merge(new_test_image(test.a), new_test_image(test.b))
+		overlap, ok := err.(*OverlapError)
+		if !ok {
+			t.Errorf("Merging 0x%x+%d with 0x%x+%d returned %v, expected an overlap error", test.a.Address, len(test.a.Data), test.b.Address, len(test.b.Data), err)
+			continue
+		}
+		if overlap.Range != test.expected {
+			t.Errorf("Merging 0x%x+%d with 0x%x+%d reported overlap %s, expected %s", test.a.Address, len(test.a.Data), test.b.Address, len(test.b.Data), overlap.Range, test.expected)
+		}
+	}
+
+	// Adjacent images do not overlap.
+	merged, err := Merge(new_test_image(data_block(0x100, 1, 2)), new_test_image(data_block(0x102, 3)))
+	if err != nil {
+		t.Fatalf("Merging adjacent images failed: %s", err)
+	}
+	check_blocks(t, "adjacent", merged, data_block(0x100, 1, 2, 3))
+}
+
+func TestMemoryMap(t *testing.T) {
+	ihex := new_test_image(data_block(0x20, 1), data_block(0x10, 1, 2), data_block(0x12, 3), data_block(0x11, 4, 5, 6))
+	expected := []AddressRange{{0x10, 0x14}, {0x20, 0x21}}
+	if ranges := ihex.MemoryMap(); !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("Memory map is %v, expected %v", ranges, expected)
+	}
+}
+
+func TestFill(t *testing.T) {
+	ihex := new_test_image(data_block(0x04, 1, 2), data_block(0x08, 3))
+	if err := ihex.Fill(0x02, 0x0B, 0xFF); err != nil {
+		t.Fatalf("Fill failed: %s", err)
+	}
+	check_blocks(t, "fill", ihex, data_block(0x02, 0xFF, 0xFF, 1, 2, 0xFF, 0xFF, 3, 0xFF, 0xFF))
+
+	// Data outside the filled range is kept, and gaps outside it are not filled.
+	ihex = new_test_image(data_block(0x00, 1), data_block(0x04, 2), data_block(0x10, 3))
+	if err := ihex.Fill(0x02, 0x06, 0x00); err != nil {
+		t.Fatalf("Fill failed: %s", err)
+	}
+	check_blocks(t, "partial fill", ihex, data_block(0x00, 1), data_block(0x02, 0, 0, 2, 0), data_block(0x10, 3))
+
+	// Filling an empty image creates a single block.
+	ihex = New()
+	if err := ihex.Fill(0x10, 0x13, 0xAA); err != nil {
+		t.Fatalf("Fill failed: %s", err)
+	}
+	check_blocks(t, "empty fill", ihex, data_block(0x10, 0xAA, 0xAA, 0xAA))
+
+	ihex = new_test_image(data_block(0x00, 1, 2), data_block(0x01, 3))
+	if err := ihex.Fill(0, 0x10, 0xFF); err == nil {
+		t.Errorf("Filling an image with overlapping data succeeded, expected an error")
+	}
+}
+
+func TestCrop(t *testing.T) {
+	ihex := new_test_image(data_block(0x00, 1, 2, 3, 4), data_block(0x10, 5, 6, 7, 8), data_block(0x20, 9))
+	ihex.Blocks = append(ihex.Blocks, &IntelHexMemBlock{StartLinearAddressRecord, 0, nil})
+
+	ihex.Crop(0x02, 0x12)
+	check_blocks(t, "crop", ihex, data_block(0x02, 3, 4), data_block(0x10, 5, 6), &IntelHexMemBlock{StartLinearAddressRecord, 0, nil})
+
+	ihex = new_test_image(data_block(0x10, 1, 2))
+	ihex.Crop(0x00, 0x10)
+	check_blocks(t, "crop before", ihex)
+
+	ihex = new_test_image(data_block(0xFFFFFFFE, 1, 2))
+	ihex.Crop(0xFFFFFFFF, 0xFFFFFFFF)
+	check_blocks(t, "crop empty range", ihex)
+}
+
+func TestRelocate(t *testing.T) {
+	ihex := new_test_image(data_block(0x2000, 1, 2), data_block(0x3000, 3))
+	if err := ihex.Relocate(-0x2000); err != nil {
+		t.Fatalf("Relocate failed: %s", err)
+	}
+	check_blocks(t, "relocate down", ihex, data_block(0x0000, 1, 2), data_block(0x1000, 3))
+
+	if err := ihex.Relocate(0x8000); err != nil {
+		t.Fatalf("Relocate failed: %s", err)
+	}
+	check_blocks(t, "relocate up", ihex, data_block(0x8000, 1, 2), data_block(0x9000, 3))
+
+	// Failed relocations leave the image untouched.
+	if err := ihex.Relocate(-0x8001); err == nil {
+		t.Errorf("Relocating below address 0 succeeded, expected an error")
+	}
+	if err := ihex.Relocate(0x100000000 - 0x9000); err == nil {
+		t.Errorf("Relocating beyond the 32 bit address space succeeded, expected an error")
+	}
+	check_blocks(t, "failed relocation", ihex, data_block(0x8000, 1, 2), data_block(0x9000, 3))
+
+	// The last block may end exactly at the end of the address space.
+	if err := ihex.Relocate(0x100000000 - 0x9001); err != nil {
+		t.Errorf("Relocating to the end of the 32 bit address space failed: %s", err)
+	}
+	check_blocks(t, "relocate to the end", ihex, data_block(0xFFFFEFFF, 1, 2), data_block(0xFFFFFFFF, 3))
+}
+
+func TestSplit(t *testing.T) {
+	ihex := new_test_image(data_block(0x06, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11), data_block(0x20, 12, 13))
+	if err := ihex.Split(4); err != nil {
+		t.Fatalf("Split failed: %s", err)
+	}
+	check_blocks(t, "split", ihex,
+		data_block(0x06, 1, 2),
+		data_block(0x08, 3, 4, 5, 6),
+		data_block(0x0C, 7, 8, 9, 10),
+		data_block(0x10, 11),
+		data_block(0x20, 12, 13))
+
+	if err := ihex.Split(0); err == nil {
+		t.Errorf("Splitting with a page size of 0 succeeded, expected an error")
+	}
+
+	ihex = new_test_image(data_block(0x00, 1, 2), data_block(0x01, 3))
+	if err := ihex.Split(4); err == nil {
+		t.Errorf("Splitting an image with overlapping data succeeded, expected an error")
+	}
+}
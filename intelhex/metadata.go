@@ -0,0 +1,142 @@
+package intelhex
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Firmware metadata can be embedded in the image as a string starting with
+// METADATA_MARKER, followed by key=value pairs separated by ';' and ending
+// with a NUL byte, e.g.:
+//
+//	const char nocan_firmware_info[] = "NOCANFW:version=1.2.0;git=4f2a9c1;board=canzero";
+//
+// It can also be provided in a JSON sidecar manifest, named after the
+// firmware file (see ManifestFile), which takes precedence.
+const (
+	METADATA_MARKER   = "NOCANFW:"
+	MANIFEST_SUFFIX   = ".manifest.json"
+	metadata_max_size = 256
+)
+
+// Metadata describes the build of a firmware image.
+type Metadata struct {
+	Version string `json:"version,omitempty"`
+	GitHash string `json:"git_hash,omitempty"`
+	Board   string `json:"board,omitempty"`
+}
+
+func (m *Metadata) String() string {
+	var parts []string
+
+	if m.Version != "" {
+		parts = append(parts, "version "+m.Version)
+	}
+	if m.GitHash != "" {
+		parts = append(parts, "git "+m.GitHash)
+	}
+	if m.Board != "" {
+		parts = append(parts, "board "+m.Board)
+	}
+	if len(parts) == 0 {
+		return "no metadata"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// merge copies the non empty fields of other into m.
+func (m *Metadata) merge(other *Metadata) {
+	if other.Version != "" {
+		m.Version = other.Version
+	}
+	if other.GitHash != "" {
+		m.GitHash = other.GitHash
+	}
+	if other.Board != "" {
+		m.Board = other.Board
+	}
+}
+
+// EmbeddedMetadata returns the metadata embedded in the data records of the
+// image, or nil if there is none.
+func (ihex *IntelHex) EmbeddedMetadata() *Metadata {
+	for _, block := range ihex.Blocks {
+		if block.Type != DataRecord {
+			continue
+		}
+		i := bytes.Index(block.Data, []byte(METADATA_MARKER))
+		if i < 0 {
+			continue
+		}
+		text := block.Data[i+len(METADATA_MARKER):]
+		if end := bytes.IndexByte(text, 0); end >= 0 {
+			text = text[:end]
+		}
+		if len(text) > metadata_max_size {
+			text = text[:metadata_max_size]
+		}
+
+		m := new(Metadata)
+		for _, item := range strings.Split(string(text), ";") {
+			kv := strings.SplitN(item, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			value := strings.TrimSpace(kv[1])
+			switch strings.TrimSpace(kv[0]) {
+			case "version":
+				m.Version = value
+			case "git", "git_hash":
+				m.GitHash = value
+			case "board":
+				m.Board = value
+			}
+		}
+		return m
+	}
+	return nil
+}
+
+// ManifestFile returns the name of the sidecar manifest of a firmware file,
+// e.g. 'app.manifest.json' for 'app.hex'.
+func ManifestFile(filename string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + MANIFEST_SUFFIX
+}
+
+// LoadManifest reads a JSON sidecar manifest.
+func LoadManifest(filename string) (*Metadata, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	m := new(Metadata)
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return m, nil
+}
+
+// LoadMetadata returns the metadata of a firmware image loaded from
+// filename, combining the metadata embedded in the image with the sidecar
+// manifest of the file if it exists. It returns nil if neither is found.
+func LoadMetadata(filename string, ihex *IntelHex) (*Metadata, error) {
+	m := ihex.EmbeddedMetadata()
+
+	manifest, err := LoadManifest(ManifestFile(filename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return nil, err
+	}
+	if m == nil {
+		return manifest, nil
+	}
+	m.merge(manifest)
+	return m, nil
+}
@@ -0,0 +1,148 @@
+package intelhex
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"github.com/omzlo/clog"
+	"io"
+	"strings"
+)
+
+// LoadSrec loads a Motorola S-record file, accepting S1, S2 and S3 data records.
+func (ihex *IntelHex) LoadSrec(r io.Reader) error {
+	line_count := 0
+
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		line_count++
+		line := strings.TrimSpace(scanner.Text())
+
+		if len(line) == 0 {
+			continue
+		}
+		if len(line) < 4 || line[0] != 'S' {
+			return fmt.Errorf("Missing 'S' at the beginning of line %d", line_count)
+		}
+		stype := line[1]
+		data, err := hex.DecodeString(line[2:])
+		if err != nil {
+			return fmt.Errorf("Failed to decode S-record data on line %d: %s", line_count, err.Error())
+		}
+		if len(data) < 1 || len(data) != 1+int(data[0]) {
+			return fmt.Errorf("Missing data in S-record on line %d", line_count)
+		}
+		var checksum uint8
+		for i := 0; i < len(data)-1; i++ {
+			checksum += data[i]
+		}
+		checksum = ^checksum
+		if checksum != data[len(data)-1] {
+			return fmt.Errorf("Checksum error on line %d, expected %02x but got %02x", line_count, data[len(data)-1], checksum)
+		}
+
+		var address_len int
+		switch stype {
+		case '0', '1', '5', '9':
+			address_len = 2
+		case '2', '6', '8':
+			address_len = 3
+		case '3', '7':
+			address_len = 4
+		default:
+			return fmt.Errorf("Unknown S-record type S%c on line %d", stype, line_count)
+		}
+		if len(data) < 2+address_len {
+			return fmt.Errorf("S%c record is too short on line %d", stype, line_count)
+		}
+		var address uint32
+		for i := 1; i <= address_len; i++ {
+			address = (address << 8) | uint32(data[i])
+		}
+		payload := data[1+address_len : len(data)-1]
+
+		switch stype {
+		case '0':
+			clog.Debug("S-record header on line %d: %q", line_count, payload)
+		case '1', '2', '3':
+			if len(payload) > 0 {
+				ihex.Add(DataRecord, address, payload)
+			}
+		case '5', '6':
+			// record counts are not checked
+		case '7', '8', '9':
+			if address != 0 {
+				ihex.Start = &StartAddress{StartLinearAddressRecord, address}
+			}
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Failed to read next data after line %d: %s", line_count, err.Error())
+	}
+	// S7/S8/S9 termination records are optional in practice.
+	return nil
+}
+
+// SaveSrec writes the data records of the image as Motorola S-records, using
+// the smallest address width (S1, S2 or S3) that covers the whole image and
+// its linear start address, which is written in the termination record.
+func (ihex *IntelHex) SaveSrec(w io.Writer) error {
+	var data_type, end_type byte
+	var address_len int
+
+	_, end, _ := ihex.dataRange()
+	var start uint32
+	if ihex.Start != nil && ihex.Start.Type == StartLinearAddressRecord {
+		start = ihex.Start.Value
+		if uint64(start) >= end {
+			end = uint64(start) + 1
+		}
+	}
+	switch {
+	case end <= 1<<16:
+		data_type, end_type, address_len = '1', '9', 2
+	case end <= 1<<24:
+		data_type, end_type, address_len = '2', '8', 3
+	default:
+		data_type, end_type, address_len = '3', '7', 4
+	}
+
+	if err := writeSrecRecord(w, '0', 2, 0, nil); err != nil {
+		return err
+	}
+	for _, block := range ihex.Blocks {
+		if block.Type != DataRecord {
+			continue
+		}
+		for pos := 0; pos < len(block.Data); pos += 16 {
+			blen := len(block.Data) - pos
+			if blen > 16 {
+				blen = 16
+			}
+			if err := writeSrecRecord(w, data_type, address_len, block.Address+uint32(pos), block.Data[pos:pos+blen]); err != nil {
+				return err
+			}
+		}
+	}
+	return writeSrecRecord(w, end_type, address_len, start, nil)
+}
+
+func writeSrecRecord(w io.Writer, stype byte, address_len int, address uint32, data []byte) error {
+	record := make([]byte, 0, 1+address_len+len(data)+1)
+	record = append(record, byte(address_len+len(data)+1))
+	for i := address_len - 1; i >= 0; i-- {
+		record = append(record, byte(address>>(8*uint(i))))
+	}
+	record = append(record, data...)
+
+	var checksum uint8
+	for _, b := range record {
+		checksum += b
+	}
+	record = append(record, ^checksum)
+
+	_, err := fmt.Fprintf(w, "S%c%s\n", stype, strings.ToUpper(hex.EncodeToString(record)))
+	return err
+}
@@ -0,0 +1,331 @@
+package intelhex
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"github.com/omzlo/clog"
+	"io"
+	"strings"
+)
+
+// DEFAULT_RECORD_LENGTH is the number of data bytes per record written when
+// no record length is specified.
+const DEFAULT_RECORD_LENGTH = 16
+
+// Addressing selects the records used to reach addresses beyond 64KB:
+// extended linear address records (type 04), or extended segment address
+// records (type 02), which only reach the first megabyte.
+type Addressing int
+
+const (
+	AddressingLinear Addressing = iota
+	AddressingSegment
+)
+
+func (a Addressing) String() string {
+	if a == AddressingSegment {
+		return "segment"
+	}
+	return "linear"
+}
+
+func (a *Addressing) Set(s string) error {
+	switch s {
+	case "linear":
+		*a = AddressingLinear
+	case "segment":
+		*a = AddressingSegment
+	default:
+		return fmt.Errorf("Addressing must be either 'linear' or 'segment', got '%s'", s)
+	}
+	return nil
+}
+
+// StartAddress is the execution start address of an image, given either by
+// a start segment address record (Value holds CS in its upper 16 bits and IP
+// in its lower 16 bits) or by a start linear address record (Value holds EIP).
+type StartAddress struct {
+	Type  uint8
+	Value uint32
+}
+
+func (s *StartAddress) String() string {
+	if s.Type == StartSegmentAddressRecord {
+		return fmt.Sprintf("%04x:%04x", s.Value>>16, s.Value&0xFFFF)
+	}
+	return fmt.Sprintf("0x%08x", s.Value)
+}
+
+// Record is a single Intel HEX record. For data records, Address is the
+// absolute address of the data, extended address records included. For
+// extended address records, it is the new base address, and for start
+// address records, the start address.
+type Record struct {
+	Type    uint8
+	Address uint32
+	Data    []byte
+}
+
+// Reader reads an Intel HEX file one record at a time, so that large files
+// can be processed without loading them whole.
+type Reader struct {
+	scanner          *bufio.Scanner
+	line_count       int
+	extended_address uint32
+	done             bool
+	linear           bool
+	segment          bool
+	record_length    uint8
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{scanner: bufio.NewScanner(r)}
+}
+
+// Next returns the next record of the file, or io.EOF after the end of file
+// record. Records of unknown type are skipped with a warning.
+func (hr *Reader) Next() (*Record, error) {
+	if hr.done {
+		return nil, io.EOF
+	}
+	for hr.scanner.Scan() {
+		hr.line_count++
+		line := strings.TrimSpace(hr.scanner.Text())
+
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != ':' {
+			return nil, fmt.Errorf("Missing ':' at the beginning of line %d", hr.line_count)
+		}
+		data, err := hex.DecodeString(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode hex file data on line %d: %s", hr.line_count, err.Error())
+		}
+		if len(data) < 5 || len(data) != (5+int(data[0])) {
+			return nil, fmt.Errorf("Missing data in hexfile on line %d", hr.line_count)
+		}
+		byte_count := data[0]
+		address := (uint32(data[1]) << 8) | uint32(data[2])
+		btype := data[3]
+		checksum := data[0]
+		for i := 1; i < len(data)-1; i++ {
+			checksum += data[i]
+		}
+		checksum = (^checksum) + 1
+		if checksum != data[len(data)-1] {
+			return nil, fmt.Errorf("Checksum error on line %d, expected %02x but got %02x", hr.line_count, data[len(data)-1], checksum)
+		}
+		payload := data[4 : 4+byte_count]
+
+		switch btype {
+		case DataRecord:
+			if byte_count > hr.record_length {
+				hr.record_length = byte_count
+			}
+			return &Record{btype, hr.extended_address + address, payload}, nil
+		case EndOfFileRecord:
+			if byte_count != 0 {
+				return nil, fmt.Errorf("End of file marker has non zero length on line %d", hr.line_count)
+			}
+			hr.done = true
+			return nil, io.EOF
+		case ExtendedSegmentAddressRecord:
+			if byte_count != 2 {
+				return nil, fmt.Errorf("Extended segment address record should be of length 2 on line %d", hr.line_count)
+			}
+			hr.extended_address = (uint32(payload[0]) << 12) | (uint32(payload[1]) << 4)
+			hr.segment = true
+			return &Record{btype, hr.extended_address, payload}, nil
+		case ExtendedLinearAddressRecord:
+			if byte_count != 2 {
+				return nil, fmt.Errorf("Extended linear address record should be of length 2 on line %d", hr.line_count)
+			}
+			hr.extended_address = (uint32(payload[0]) << 24) | (uint32(payload[1]) << 16)
+			hr.linear = true
+			return &Record{btype, hr.extended_address, payload}, nil
+		case StartSegmentAddressRecord, StartLinearAddressRecord:
+			if byte_count != 4 {
+				return nil, fmt.Errorf("Start address record is of incorrect length on line %d", hr.line_count)
+			}
+			value := (uint32(payload[0]) << 24) | (uint32(payload[1]) << 16) | (uint32(payload[2]) << 8) | uint32(payload[3])
+			return &Record{btype, value, payload}, nil
+		default:
+			clog.Warning("Firmware contains a block of unknown type %02x on line %d, which will be ignored.", btype, hr.line_count)
+		}
+	}
+	if err := hr.scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read next data after line %d: %s", hr.line_count, err.Error())
+	}
+	return nil, fmt.Errorf("Unexpected end of file on line %d", hr.line_count)
+}
+
+// Addressing returns the addressing mode of the records read so far, which
+// is segment addressing if only extended segment address records were found.
+func (hr *Reader) Addressing() Addressing {
+	if hr.segment && !hr.linear {
+		return AddressingSegment
+	}
+	return AddressingLinear
+}
+
+// RecordLength returns the length of the longest data record read so far.
+func (hr *Reader) RecordLength() uint8 {
+	return hr.record_length
+}
+
+// Writer writes an Intel HEX file, splitting data in records of up to
+// RecordLength bytes and inserting extended address records as needed.
+// Contiguous data is buffered until it fills a record, so that at most one
+// record is held in memory.
+type Writer struct {
+	w               *bufio.Writer
+	addressing      Addressing
+	record_length   int
+	base            uint32
+	pending_address uint32
+	pending         []byte
+}
+
+// NewWriter returns a Writer using the given addressing mode and record
+// length, or DEFAULT_RECORD_LENGTH if record_length is 0.
+func NewWriter(w io.Writer, addressing Addressing, record_length uint8) *Writer {
+	if record_length == 0 {
+		record_length = DEFAULT_RECORD_LENGTH
+	}
+	return &Writer{
+		w:             bufio.NewWriter(w),
+		addressing:    addressing,
+		record_length: int(record_length),
+		pending:       make([]byte, 0, record_length),
+	}
+}
+
+func (hw *Writer) write_record(rtype uint8, address uint16, data []byte) error {
+	checksum := uint8(len(data)) + uint8(address>>8) + uint8(address) + rtype
+	for _, b := range data {
+		checksum += b
+	}
+	_, err := fmt.Fprintf(hw.w, ":%02X%04X%02X%s%02X\n", len(data), address, rtype, strings.ToUpper(hex.EncodeToString(data)), (^checksum)+1)
+	return err
+}
+
+// record_space returns the size of the record starting at pending_address,
+// which must not cross a 64KB boundary.
+func (hw *Writer) record_space() int {
+	space := 0x10000 - int(hw.pending_address&0xFFFF)
+	if space > hw.record_length {
+		return hw.record_length
+	}
+	return space
+}
+
+// Flush writes buffered data as a final, possibly shorter, record.
+func (hw *Writer) Flush() error {
+	if len(hw.pending) == 0 {
+		return nil
+	}
+	base := hw.pending_address &^ 0xFFFF
+	if base != hw.base {
+		var err error
+
+		if hw.addressing == AddressingSegment {
+			err = hw.write_record(ExtendedSegmentAddressRecord, 0, []byte{byte(base >> 12), byte(base >> 4)})
+		} else {
+			err = hw.write_record(ExtendedLinearAddressRecord, 0, []byte{byte(base >> 24), byte(base >> 16)})
+		}
+		if err != nil {
+			return err
+		}
+		hw.base = base
+	}
+	if err := hw.write_record(DataRecord, uint16(hw.pending_address), hw.pending); err != nil {
+		return err
+	}
+	hw.pending_address += uint32(len(hw.pending))
+	hw.pending = hw.pending[:0]
+	return nil
+}
+
+// WriteData writes data at address.
+func (hw *Writer) WriteData(address uint32, data []byte) error {
+	end := uint64(address) + uint64(len(data))
+	if end > 1<<32 {
+		return fmt.Errorf("Data at 0x%08x extends beyond the 32 bit address space", address)
+	}
+	if hw.addressing == AddressingSegment && end > 1<<20 {
+		return fmt.Errorf("Data at 0x%08x cannot be reached with segment addressing, which is limited to 1MB", address)
+	}
+
+	if len(hw.pending) > 0 && address != hw.pending_address+uint32(len(hw.pending)) {
+		if err := hw.Flush(); err != nil {
+			return err
+		}
+	}
+	if len(hw.pending) == 0 {
+		hw.pending_address = address
+	}
+	for len(data) > 0 {
+		n := hw.record_space() - len(hw.pending)
+		if n > len(data) {
+			n = len(data)
+		}
+		hw.pending = append(hw.pending, data[:n]...)
+		data = data[n:]
+		if len(hw.pending) == hw.record_space() {
+			if err := hw.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteStart writes a start address record.
+func (hw *Writer) WriteStart(start *StartAddress) error {
+	if start.Type != StartSegmentAddressRecord && start.Type != StartLinearAddressRecord {
+		return fmt.Errorf("Invalid start address record type %d", start.Type)
+	}
+	if err := hw.Flush(); err != nil {
+		return err
+	}
+	v := start.Value
+	return hw.write_record(start.Type, 0, []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+}
+
+// Close writes the end of file record and flushes the underlying writer,
+// which is not closed.
+func (hw *Writer) Close() error {
+	if err := hw.Flush(); err != nil {
+		return err
+	}
+	if err := hw.write_record(EndOfFileRecord, 0, nil); err != nil {
+		return err
+	}
+	return hw.w.Flush()
+}
+
+// Copy copies the data and start address records read from r to w, then
+// closes w. It converts an Intel HEX file to another addressing mode or
+// record length without loading it whole.
+func Copy(w *Writer, r *Reader) error {
+	for {
+		record, err := r.Next()
+		if err == io.EOF {
+			return w.Close()
+		}
+		if err != nil {
+			return err
+		}
+		switch record.Type {
+		case DataRecord:
+			err = w.WriteData(record.Address, record.Data)
+		case StartSegmentAddressRecord, StartLinearAddressRecord:
+			err = w.WriteStart(&StartAddress{record.Type, record.Address})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package intelhex
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func check_lines(t *testing.T, what string, out string, expected ...string) {
+	t.Helper()
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if strings.Join(lines, " ") != strings.Join(expected, " ") {
+		t.Errorf("%s: wrote\n%s\nexpected\n%s", what, strings.Join(lines, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestWriterAddressing(t *testing.T) {
+	tests := []struct {
+		addressing Addressing
+		expected   []string
+	}{
+		{AddressingLinear, []string{":020000040001F9", ":02234500AABB31", ":00000001FF"}},
+		{AddressingSegment, []string{":020000021000EC", ":02234500AABB31", ":00000001FF"}},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+
+		w := NewWriter(&out, test.addressing, 0)
+		if err := w.WriteData(0x12345, []byte{0xAA, 0xBB}); err != nil {
+			t.Fatalf("WriteData failed: %s", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close failed: %s", err)
+		}
+		check_lines(t, test.addressing.String()+" addressing", out.String(), test.expected...)
+
+		ihex := New()
+		if err := ihex.Load(&out); err != nil {
+			t.Fatalf("Load failed: %s", err)
+		}
+		check_blocks(t, test.addressing.String()+" round trip", ihex, data_block(0x12345, 0xAA, 0xBB))
+		if ihex.Addressing != test.addressing {
+			t.Errorf("Image written with %s addressing was read with %s addressing", test.addressing, ihex.Addressing)
+		}
+	}
+}
+
+func TestWriterRecordLength(t *testing.T) {
+	data := make([]byte, 20)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	ihex := new_test_image(data_block(0x100, data...))
+	ihex.RecordLength = 8
+
+	var out bytes.Buffer
+	if err := ihex.Save(&out); err != nil {
+		t.Fatalf("Save failed: %s", err)
+	}
+	check_lines(t, "record length", out.String(),
+		":080100000001020304050607DB",
+		":0801080008090A0B0C0D0E0F93",
+		":0401100010111213A5",
+		":00000001FF")
+
+	loaded := New()
+	if err := loaded.Load(&out); err != nil {
+		t.Fatalf("Load failed: %s", err)
+	}
+	check_blocks(t, "record length round trip", loaded, data_block(0x100, data...))
+	if loaded.RecordLength != 8 {
+		t.Errorf("Record length is %d, expected 8", loaded.RecordLength)
+	}
+}
+
+func TestWriterStartAddress(t *testing.T) {
+	tests := []struct {
+		start    StartAddress
+		expected string
+	}{
+		{StartAddress{StartSegmentAddressRecord, 0x12345678}, ":0400000312345678E5"},
+		{StartAddress{StartLinearAddressRecord, 0x12345678}, ":0400000512345678E3"},
+	}
+	for _, test := range tests {
+		ihex := new_test_image(data_block(0x00, 1))
+		ihex.Start = &test.start
+
+		var out bytes.Buffer
+		if err := ihex.Save(&out); err != nil {
+			t.Fatalf("Save failed: %s", err)
+		}
+		check_lines(t, "start address", out.String(), ":0100000001FE", test.expected, ":00000001FF")
+
+		loaded := New()
+		if err := loaded.Load(&out); err != nil {
+			t.Fatalf("Load failed: %s", err)
+		}
+		if loaded.Start == nil || *loaded.Start != test.start {
+			t.Errorf("Start address read as %v, expected %v", loaded.Start, &test.start)
+		}
+	}
+
+	w := NewWriter(&bytes.Buffer{}, AddressingLinear, 0)
+	if err := w.WriteStart(&StartAddress{DataRecord, 0}); err == nil {
+		t.Errorf("Writing a start address of type %d succeeded, expected an error", DataRecord)
+	}
+}
+
+func TestWriterBoundary(t *testing.T) {
+	tests := []struct {
+		addressing Addressing
+		expected   []string
+	}{
+		{AddressingLinear, []string{":04FFFC0001020304F7", ":020000040001F9", ":0400000005060708E2", ":00000001FF"}},
+		{AddressingSegment, []string{":04FFFC0001020304F7", ":020000021000EC", ":0400000005060708E2", ":00000001FF"}},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+
+		// Records are split at 64KB boundaries, even if they are shorter.
+		w := NewWriter(&out, test.addressing, 16)
+		if err := w.WriteData(0xFFFC, []byte{1, 2, 3, 4, 5, 6, 7, 8}); err != nil {
+			t.Fatalf("WriteData failed: %s", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close failed: %s", err)
+		}
+		check_lines(t, test.addressing.String()+" boundary", out.String(), test.expected...)
+
+		ihex := New()
+		if err := ihex.Load(&out); err != nil {
+			t.Fatalf("Load failed: %s", err)
+		}
+		check_blocks(t, test.addressing.String()+" boundary round trip", ihex, data_block(0xFFFC, 1, 2, 3, 4, 5, 6, 7, 8))
+	}
+}
+
+func TestWriterSegmentLimit(t *testing.T) {
+	w := NewWriter(&bytes.Buffer{}, AddressingSegment, 0)
+	if err := w.WriteData(0xFFFFF, []byte{1}); err != nil {
+		t.Errorf("Writing the last byte of the first megabyte failed: %s", err)
+	}
+	if err := w.WriteData(0xFFFFF, []byte{1, 2}); err == nil {
+		t.Errorf("Writing beyond the first megabyte with segment addressing succeeded, expected an error")
+	}
+	if err := w.WriteData(0x100000, []byte{1}); err == nil {
+		t.Errorf("Writing at 0x100000 with segment addressing succeeded, expected an error")
+	}
+
+	w = NewWriter(&bytes.Buffer{}, AddressingLinear, 0)
+	if err := w.WriteData(0x100000, []byte{1}); err != nil {
+		t.Errorf("Writing at 0x100000 with linear addressing failed: %s", err)
+	}
+	if err := w.WriteData(0xFFFFFFFF, []byte{1, 2}); err == nil {
+		t.Errorf("Writing beyond the 32 bit address space succeeded, expected an error")
+	}
+}
+
+func TestCopy(t *testing.T) {
+	data := make([]byte, 80)
+	for i := range data {
+		data[i] = byte(i * 3)
+	}
+	ihex := new_test_image(data_block(0xFFF0, data...), data_block(0x20000, 1, 2, 3))
+	ihex.Start = &StartAddress{StartSegmentAddressRecord, 0x10000100}
+
+	var original bytes.Buffer
+	if err := ihex.Save(&original); err != nil {
+		t.Fatalf("Save failed: %s", err)
+	}
+
+	var out bytes.Buffer
+	if err := Copy(NewWriter(&out, AddressingSegment, 32), NewReader(&original)); err != nil {
+		t.Fatalf("Copy failed: %s", err)
+	}
+
+	copied := New()
+	if err := copied.Load(&out); err != nil {
+		t.Fatalf("Load failed: %s", err)
+	}
+	check_blocks(t, "copy", copied, data_block(0xFFF0, data...), data_block(0x20000, 1, 2, 3))
+	if copied.Start == nil || *copied.Start != *ihex.Start {
+		t.Errorf("Start address copied as %v, expected %v", copied.Start, ihex.Start)
+	}
+	if copied.Addressing != AddressingSegment || copied.RecordLength != 32 {
+		t.Errorf("Copy uses %s addressing with %d byte records, expected segment addressing with 32 byte records", copied.Addressing, copied.RecordLength)
+	}
+
+	// Copy stops on invalid input.
+	invalid := strings.NewReader(":0100000001FE\n:0100000001FF\n:00000001FF\n")
+	if err := Copy(NewWriter(&bytes.Buffer{}, AddressingLinear, 0), NewReader(invalid)); err == nil {
+		t.Errorf("Copying a file with a checksum error succeeded, expected an error")
+	}
+}
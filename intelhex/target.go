@@ -0,0 +1,92 @@
+package intelhex
+
+import (
+	"fmt"
+)
+
+// Target describes the flash memory of a kind of node. PageSize is the
+// smallest erasable unit of flash: writing data anywhere in a page erases
+// all of it. Protected lists the address ranges, such as the bootloader,
+// that firmware must not overwrite. AppOrigin is the address where
+// applications start, where raw binary images are loaded by default.
+type Target struct {
+	Name      string
+	FlashBase uint32
+	FlashSize uint32
+	PageSize  uint32
+	AppOrigin uint32
+	Protected []AddressRange
+}
+
+// CANZERO describes the Omzlo CANZERO (SAMD21G18), with 256KB of flash
+// erased in rows of 256 bytes, and the NoCAN bootloader in the first 8KB.
+var CANZERO = &Target{
+	Name:      "canzero",
+	FlashBase: 0,
+	FlashSize: 0x40000,
+	PageSize:  256,
+	AppOrigin: 0x2000,
+	Protected: []AddressRange{{0, 0x2000}},
+}
+
+// TargetViolation reports an address range of an image that cannot be
+// written to a target.
+type TargetViolation struct {
+	Range  AddressRange `json:"range"`
+	Reason string       `json:"reason"`
+}
+
+func (v TargetViolation) String() string {
+	return fmt.Sprintf("%s %s", v.Range, v.Reason)
+}
+
+// intersect returns the addresses common to a and the range from start
+// included to end excluded, which may extend past the 32 bit address space.
+func intersect(a AddressRange, start uint64, end uint64) (AddressRange, bool) {
+	if uint64(a.Start) > start {
+		start = uint64(a.Start)
+	}
+	if uint64(a.End) < end {
+		end = uint64(a.End)
+	}
+	if start >= end {
+		return AddressRange{}, false
+	}
+	return AddressRange{uint32(start), uint32(end)}, true
+}
+
+// Check returns the address ranges of the data records of ihex that lie
+// outside the flash memory of the target, or in a page that holds part of a
+// protected region.
+func (t *Target) Check(ihex *IntelHex) []TargetViolation {
+	var violations []TargetViolation
+
+	flash_end := uint64(t.FlashBase) + uint64(t.FlashSize)
+	for _, r := range ihex.MemoryMap() {
+		if ar, ok := intersect(r, 0, uint64(t.FlashBase)); ok {
+			violations = append(violations, TargetViolation{ar, fmt.Sprintf("is below the flash memory of target %s", t.Name)})
+		}
+		if ar, ok := intersect(r, flash_end, 1<<32); ok {
+			violations = append(violations, TargetViolation{ar, fmt.Sprintf("is beyond the flash memory of target %s", t.Name)})
+		}
+		for _, p := range t.Protected {
+			start, end := uint64(p.Start), uint64(p.End)
+			if ar, ok := intersect(r, start, end); ok {
+				violations = append(violations, TargetViolation{ar, fmt.Sprintf("overwrites protected region %s", p)})
+			}
+			if t.PageSize == 0 {
+				continue
+			}
+			page_size := uint64(t.PageSize)
+			page_start := start - start%page_size
+			page_end := (end + page_size - 1) / page_size * page_size
+			if ar, ok := intersect(r, page_start, start); ok {
+				violations = append(violations, TargetViolation{ar, fmt.Sprintf("shares a flash page with protected region %s", p)})
+			}
+			if ar, ok := intersect(r, end, page_end); ok {
+				violations = append(violations, TargetViolation{ar, fmt.Sprintf("shares a flash page with protected region %s", p)})
+			}
+		}
+	}
+	return violations
+}
@@ -0,0 +1,179 @@
+package metrics
+
+import (
+	"github.com/omzlo/nocand/models"
+	"github.com/omzlo/nocand/models/device"
+	"github.com/omzlo/nocand/models/nocan"
+	"github.com/omzlo/nocand/socket"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Collector derives metrics from the events sent by nocand.
+type Collector struct {
+	mutex           sync.Mutex
+	numeric         []string
+	power_status    *device.PowerStatus
+	nodes           map[nocan.NodeId]*socket.NodeUpdateEvent
+	channel_updates map[string]uint64
+	channel_values  map[string]float64
+	connected       bool
+}
+
+// NewCollector creates a collector. The values of channels whose name
+// matches one of the numeric patterns (e.g. 'temperature/*', see path.Match)
+// are exported as gauges.
+func NewCollector(numeric []string) *Collector {
+	return &Collector{
+		numeric:         numeric,
+		nodes:           make(map[nocan.NodeId]*socket.NodeUpdateEvent),
+		channel_updates: make(map[string]uint64),
+		channel_values:  make(map[string]float64),
+	}
+}
+
+func (c *Collector) is_numeric(channel_name string) bool {
+	for _, pattern := range c.numeric {
+		if ok, _ := path.Match(pattern, channel_name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// OnConnect records a (re)connection to nocand. It should be called each
+// time the nocand client connects.
+func (c *Collector) OnConnect() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.connected {
+		Reconnects.Inc()
+	}
+	c.connected = true
+}
+
+// HandleEvent updates the collector with an event received from nocand.
+// Events that are not relevant to metrics are ignored.
+func (c *Collector) HandleEvent(e socket.Eventer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	switch ev := e.(type) {
+	case *socket.BusPowerStatusUpdateEvent:
+		c.power_status = ev.Status
+	case *socket.NodeListEvent:
+		c.nodes = make(map[nocan.NodeId]*socket.NodeUpdateEvent)
+		for _, node := range ev.Nodes {
+			c.nodes[node.NodeId] = node
+		}
+	case *socket.NodeUpdateEvent:
+		c.nodes[ev.NodeId] = ev
+	case *socket.ChannelListEvent:
+		for _, channel := range ev.Channels {
+			c.update_channel_value(channel)
+		}
+	case *socket.ChannelUpdateEvent:
+		if ev.Status == socket.CHANNEL_UPDATED {
+			c.channel_updates[ev.ChannelName]++
+		}
+		c.update_channel_value(ev)
+	}
+}
+
+func (c *Collector) update_channel_value(cu *socket.ChannelUpdateEvent) {
+	switch cu.Status {
+	case socket.CHANNEL_DESTROYED:
+		delete(c.channel_values, cu.ChannelName)
+	case socket.CHANNEL_CREATED, socket.CHANNEL_UPDATED:
+		if !c.is_numeric(cu.ChannelName) || len(cu.Value) == 0 {
+			return
+		}
+		if v, err := strconv.ParseFloat(strings.TrimSpace(string(cu.Value)), 64); err == nil {
+			c.channel_values[cu.ChannelName] = v
+		}
+	}
+}
+
+// float32_value converts f without exposing float32 rounding artifacts
+// (e.g. 12.1 rather than 12.100000381469727).
+func float32_value(f float32) float64 {
+	v, _ := strconv.ParseFloat(strconv.FormatFloat(float64(f), 'g', -1, 32), 64)
+	return v
+}
+
+func bool_value(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// WriteTo writes the metrics of the collector, followed by the process
+// metrics, in the Prometheus text exposition format.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	mw := NewWriter(w)
+
+	c.mutex.Lock()
+	c.write_metrics(mw, time.Now())
+	c.mutex.Unlock()
+
+	WriteProcessMetrics(mw)
+	return mw.Result()
+}
+
+func (c *Collector) write_metrics(mw *Writer, now time.Time) {
+	if ps := c.power_status; ps != nil {
+		mw.Gauge("nocan_bus_voltage_volts", "Voltage of the NoCAN bus.", float32_value(ps.Voltage))
+		mw.Gauge("nocan_bus_current_sense", "Current sense value of the NoCAN bus (raw ADC value).", float64(ps.CurrentSense))
+		mw.Gauge("nocan_bus_reference_voltage_volts", "Reference voltage of the NoCAN bus driver.", float32_value(ps.RefLevel))
+		mw.Gauge("nocan_bus_powered", "Whether the NoCAN bus is powered.", bool_value(ps.Status&device.STATUS_POWERED != 0))
+		mw.Gauge("nocan_bus_fault", "Whether an electric fault was detected on the NoCAN bus.", bool_value(ps.Status&device.STATUS_FAULT != 0))
+	}
+
+	counts := make(map[models.NodeState]int)
+	var ids []int
+	for id, node := range c.nodes {
+		counts[node.State]++
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	mw.Header("nocan_nodes", "gauge", "Number of nodes, by state.")
+	for state := models.NodeState(0); state < models.NodeStateCount; state++ {
+		mw.Sample("nocan_nodes", float64(counts[state]), Label{"state", state.String()})
+	}
+
+	mw.Header("nocan_node_last_seen_seconds", "gauge", "Time elapsed since each node was last seen.")
+	for _, id := range ids {
+		node := c.nodes[nocan.NodeId(id)]
+		if node.LastSeen.IsZero() {
+			continue
+		}
+		mw.Sample("nocan_node_last_seen_seconds", now.Sub(node.LastSeen).Seconds(),
+			Label{"node", strconv.Itoa(id)}, Label{"udid", node.Udid.String()})
+	}
+
+	mw.CounterVec("nocan_channel_updates_total", "Number of updates received for each channel.", "channel", c.channel_updates)
+
+	mw.Header("nocan_channel_value", "gauge", "Last value of numeric channels.")
+	names := make([]string, 0, len(c.channel_values))
+	for name := range c.channel_values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		mw.Sample("nocan_channel_value", c.channel_values[name], Label{"channel", name})
+	}
+}
+
+func (c *Collector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.WriteTo(w)
+}
@@ -0,0 +1,175 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a monotonically increasing value, safe for concurrent use.
+type Counter struct {
+	value uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// CounterVec is a set of counters distinguished by the value of a single label.
+type CounterVec struct {
+	mutex  sync.Mutex
+	values map[string]uint64
+}
+
+func (cv *CounterVec) Inc(label string) {
+	cv.mutex.Lock()
+	defer cv.mutex.Unlock()
+	if cv.values == nil {
+		cv.values = make(map[string]uint64)
+	}
+	cv.values[label]++
+}
+
+// Values returns a copy of the counters, indexed by label value.
+func (cv *CounterVec) Values() map[string]uint64 {
+	cv.mutex.Lock()
+	defer cv.mutex.Unlock()
+
+	r := make(map[string]uint64, len(cv.values))
+	for k, v := range cv.values {
+		r[k] = v
+	}
+	return r
+}
+
+// Counters maintained by nocanc itself, independently of the state of the NoCAN network.
+var (
+	// Reconnects counts the number of times the connection to nocand was re-established.
+	Reconnects Counter
+	// MqttForwardFailures counts the channel updates and MQTT messages that
+	// could not be forwarded between NoCAN and the MQTT server.
+	MqttForwardFailures Counter
+	// JobOutcomes counts completed jobs, by outcome ('success' or 'error').
+	JobOutcomes CounterVec
+)
+
+// Label is a metric label name and value.
+type Label struct {
+	Name  string
+	Value string
+}
+
+var label_escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Writer writes metrics in the Prometheus text exposition format.
+// The first write error is recorded and makes subsequent writes no-ops.
+type Writer struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (mw *Writer) printf(format string, args ...interface{}) {
+	if mw.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(mw.w, format, args...)
+	mw.n += int64(n)
+	mw.err = err
+}
+
+// Header writes the HELP and TYPE lines of a metric family.
+func (mw *Writer) Header(name string, kind string, help string) {
+	mw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Sample writes one value of a metric.
+func (mw *Writer) Sample(name string, value float64, labels ...Label) {
+	var s strings.Builder
+
+	s.WriteString(name)
+	if len(labels) > 0 {
+		s.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				s.WriteByte(',')
+			}
+			s.WriteString(label.Name)
+			s.WriteString(`="`)
+			s.WriteString(label_escaper.Replace(label.Value))
+			s.WriteByte('"')
+		}
+		s.WriteByte('}')
+	}
+	mw.printf("%s %s\n", s.String(), format_value(value))
+}
+
+// Gauge writes a metric family made of a single gauge value.
+func (mw *Writer) Gauge(name string, help string, value float64) {
+	mw.Header(name, "gauge", help)
+	mw.Sample(name, value)
+}
+
+// Counter writes a metric family made of a single counter value.
+func (mw *Writer) Counter(name string, help string, value uint64) {
+	mw.Header(name, "counter", help)
+	mw.Sample(name, float64(value))
+}
+
+// CounterVec writes a metric family with one counter per label value.
+func (mw *Writer) CounterVec(name string, help string, label string, values map[string]uint64) {
+	mw.Header(name, "counter", help)
+	for _, key := range sorted_keys(values) {
+		mw.Sample(name, float64(values[key]), Label{label, key})
+	}
+}
+
+// Result returns the number of bytes written and the first error encountered.
+func (mw *Writer) Result() (int64, error) {
+	return mw.n, mw.err
+}
+
+func format_value(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sorted_keys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteProcessMetrics writes the counters maintained by nocanc itself.
+func WriteProcessMetrics(mw *Writer) {
+	mw.Counter("nocanc_reconnects_total", "Number of times the connection to nocand was re-established.", Reconnects.Value())
+	mw.Counter("nocanc_mqtt_forward_failures_total", "Number of messages that could not be forwarded between NoCAN and MQTT.", MqttForwardFailures.Value())
+	mw.CounterVec("nocanc_jobs_total", "Number of completed jobs, by outcome.", "outcome", JobOutcomes.Values())
+}
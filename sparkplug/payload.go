@@ -0,0 +1,345 @@
+package sparkplug
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// DataType is the type of a metric value, as defined by Sparkplug B.
+type DataType uint32
+
+const (
+	Unknown  DataType = 0
+	Int8     DataType = 1
+	Int16    DataType = 2
+	Int32    DataType = 3
+	Int64    DataType = 4
+	UInt8    DataType = 5
+	UInt16   DataType = 6
+	UInt32   DataType = 7
+	UInt64   DataType = 8
+	Float    DataType = 9
+	Double   DataType = 10
+	Boolean  DataType = 11
+	String   DataType = 12
+	DateTime DataType = 13
+	Text     DataType = 14
+	UUID     DataType = 15
+	Bytes    DataType = 17
+)
+
+var (
+	ErrTruncated = errors.New("Truncated Sparkplug payload")
+)
+
+// Metric is a Sparkplug B metric. Value holds an int64 for signed integer
+// types, an uint64 for unsigned integer types and DateTime, a float32, a
+// float64, a bool, a string or a []byte. Value is ignored if IsNull is true.
+type Metric struct {
+	Name      string
+	Alias     uint64
+	Timestamp uint64
+	DataType  DataType
+	IsNull    bool
+	Value     interface{}
+}
+
+// Payload is a Sparkplug B payload. Seq is nil for payloads without a
+// sequence number, such as NDEATH.
+type Payload struct {
+	Timestamp uint64
+	Metrics   []*Metric
+	Seq       *uint64
+}
+
+/* Protocol buffer wire format */
+
+const (
+	wire_varint  = 0
+	wire_fixed64 = 1
+	wire_bytes   = 2
+	wire_fixed32 = 5
+)
+
+func append_varint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+func append_tag(buf []byte, field int, wire int) []byte {
+	return append_varint(buf, uint64(field<<3|wire))
+}
+
+func append_uint(buf []byte, field int, v uint64) []byte {
+	return append_varint(append_tag(buf, field, wire_varint), v)
+}
+
+func append_bytes(buf []byte, field int, v []byte) []byte {
+	buf = append_varint(append_tag(buf, field, wire_bytes), uint64(len(v)))
+	return append(buf, v...)
+}
+
+func read_varint(data []byte) (uint64, int, error) {
+	var v uint64
+
+	for i := 0; i < len(data) && i < 10; i++ {
+		v |= uint64(data[i]&0x7F) << (7 * uint(i))
+		if data[i] < 0x80 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, ErrTruncated
+}
+
+// field is a decoded protocol buffer field: v holds the value of varint
+// and fixed fields, b the content of length-delimited fields.
+type field struct {
+	number int
+	wire   int
+	v      uint64
+	b      []byte
+}
+
+func read_fields(data []byte, fn func(*field) error) error {
+	for len(data) > 0 {
+		var f field
+
+		tag, n, err := read_varint(data)
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+		f.number, f.wire = int(tag>>3), int(tag&7)
+
+		switch f.wire {
+		case wire_varint:
+			if f.v, n, err = read_varint(data); err != nil {
+				return err
+			}
+		case wire_fixed64:
+			if n = 8; len(data) < n {
+				return ErrTruncated
+			}
+			f.v = binary.LittleEndian.Uint64(data)
+		case wire_fixed32:
+			if n = 4; len(data) < n {
+				return ErrTruncated
+			}
+			f.v = uint64(binary.LittleEndian.Uint32(data))
+		case wire_bytes:
+			length, l, err := read_varint(data)
+			if err != nil {
+				return err
+			}
+			if length > uint64(len(data)-l) {
+				return ErrTruncated
+			}
+			f.b = data[l : l+int(length)]
+			n = l + int(length)
+		default:
+			return fmt.Errorf("Unsupported protocol buffer wire type %d", f.wire)
+		}
+		data = data[n:]
+		if err := fn(&f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Encoding */
+
+func (m *Metric) marshal() ([]byte, error) {
+	var buf []byte
+
+	if m.Name != "" {
+		buf = append_bytes(buf, 1, []byte(m.Name))
+	}
+	if m.Alias != 0 {
+		buf = append_uint(buf, 2, m.Alias)
+	}
+	if m.Timestamp != 0 {
+		buf = append_uint(buf, 3, m.Timestamp)
+	}
+	buf = append_uint(buf, 4, uint64(m.DataType))
+	if m.IsNull {
+		return append_uint(buf, 7, 1), nil
+	}
+
+	invalid := fmt.Errorf("Invalid value %v (%T) for metric '%s' of type %d", m.Value, m.Value, m.Name, m.DataType)
+	switch m.DataType {
+	case Int8, Int16, Int32:
+		v, ok := m.Value.(int64)
+		if !ok {
+			return nil, invalid
+		}
+		buf = append_uint(buf, 10, uint64(uint32(int32(v))))
+	case UInt8, UInt16, UInt32:
+		v, ok := m.Value.(uint64)
+		if !ok {
+			return nil, invalid
+		}
+		buf = append_uint(buf, 10, uint64(uint32(v)))
+	case Int64:
+		v, ok := m.Value.(int64)
+		if !ok {
+			return nil, invalid
+		}
+		buf = append_uint(buf, 11, uint64(v))
+	case UInt64, DateTime:
+		v, ok := m.Value.(uint64)
+		if !ok {
+			return nil, invalid
+		}
+		buf = append_uint(buf, 11, v)
+	case Float:
+		v, ok := m.Value.(float32)
+		if !ok {
+			return nil, invalid
+		}
+		buf = append_tag(buf, 12, wire_fixed32)
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], math.Float32bits(v))
+		buf = append(buf, b[:]...)
+	case Double:
+		v, ok := m.Value.(float64)
+		if !ok {
+			return nil, invalid
+		}
+		buf = append_tag(buf, 13, wire_fixed64)
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+		buf = append(buf, b[:]...)
+	case Boolean:
+		v, ok := m.Value.(bool)
+		if !ok {
+			return nil, invalid
+		}
+		b := uint64(0)
+		if v {
+			b = 1
+		}
+		buf = append_uint(buf, 14, b)
+	case String, Text, UUID:
+		v, ok := m.Value.(string)
+		if !ok {
+			return nil, invalid
+		}
+		buf = append_bytes(buf, 15, []byte(v))
+	case Bytes:
+		v, ok := m.Value.([]byte)
+		if !ok {
+			return nil, invalid
+		}
+		buf = append_bytes(buf, 16, v)
+	default:
+		return nil, fmt.Errorf("Unsupported data type %d for metric '%s'", m.DataType, m.Name)
+	}
+	return buf, nil
+}
+
+// Marshal encodes the payload as a protocol buffer message.
+func (p *Payload) Marshal() ([]byte, error) {
+	var buf []byte
+
+	if p.Timestamp != 0 {
+		buf = append_uint(buf, 1, p.Timestamp)
+	}
+	for _, m := range p.Metrics {
+		mbuf, err := m.marshal()
+		if err != nil {
+			return nil, err
+		}
+		buf = append_bytes(buf, 2, mbuf)
+	}
+	if p.Seq != nil {
+		buf = append_uint(buf, 3, *p.Seq)
+	}
+	return buf, nil
+}
+
+/* Decoding */
+
+func unmarshal_metric(data []byte) (*Metric, error) {
+	m := new(Metric)
+
+	err := read_fields(data, func(f *field) error {
+		switch f.number {
+		case 1:
+			m.Name = string(f.b)
+		case 2:
+			m.Alias = f.v
+		case 3:
+			m.Timestamp = f.v
+		case 4:
+			m.DataType = DataType(f.v)
+		case 7:
+			m.IsNull = f.v != 0
+		case 10:
+			m.Value = f.v
+		case 11:
+			m.Value = f.v
+		case 12:
+			m.Value = math.Float32frombits(uint32(f.v))
+		case 13:
+			m.Value = math.Float64frombits(f.v)
+		case 14:
+			m.Value = f.v != 0
+		case 15:
+			m.Value = string(f.b)
+		case 16:
+			m.Value = append([]byte(nil), f.b...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Integers are sent unsigned on the wire. Negative Int8 and Int16 values
+	// are sign extended to 32 bits by most encoders, but not by all of them.
+	if v, ok := m.Value.(uint64); ok {
+		switch m.DataType {
+		case Int8:
+			m.Value = int64(int8(v))
+		case Int16:
+			m.Value = int64(int16(v))
+		case Int32:
+			m.Value = int64(int32(v))
+		case Int64:
+			m.Value = int64(v)
+		}
+	}
+	return m, nil
+}
+
+// Unmarshal decodes a protocol buffer encoded payload.
+func Unmarshal(data []byte) (*Payload, error) {
+	p := new(Payload)
+
+	err := read_fields(data, func(f *field) error {
+		switch f.number {
+		case 1:
+			p.Timestamp = f.v
+		case 2:
+			m, err := unmarshal_metric(f.b)
+			if err != nil {
+				return err
+			}
+			p.Metrics = append(p.Metrics, m)
+		case 3:
+			seq := f.v
+			p.Seq = &seq
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,180 @@
+package sparkplug
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestPayloadRoundTrip(t *testing.T) {
+	seq := uint64(42)
+	payload := &Payload{
+		Timestamp: 1613311200000,
+		Seq:       &seq,
+		Metrics: []*Metric{
+			{Name: "int8", Alias: 1, DataType: Int8, Value: int64(-128)},
+			{Name: "int16", Alias: 2, DataType: Int16, Value: int64(-32768)},
+			{Name: "int32", Alias: 3, DataType: Int32, Value: int64(math.MinInt32)},
+			{Name: "int64", Alias: 4, DataType: Int64, Value: int64(math.MinInt64)},
+			{Name: "uint8", DataType: UInt8, Value: uint64(255)},
+			{Name: "uint16", DataType: UInt16, Value: uint64(65535)},
+			{Name: "uint32", DataType: UInt32, Value: uint64(math.MaxUint32)},
+			{Name: "uint64", DataType: UInt64, Value: uint64(math.MaxUint64)},
+			{Name: "float", DataType: Float, Value: float32(-21.5)},
+			{Name: "double", DataType: Double, Value: float64(1e-300)},
+			{Name: "true", DataType: Boolean, Value: true},
+			{Name: "false", DataType: Boolean, Value: false},
+			{Name: "string", DataType: String, Value: "hello"},
+			{Name: "text", DataType: Text, Value: ""},
+			{Name: "uuid", DataType: UUID, Value: "123e4567-e89b-12d3-a456-426614174000"},
+			{Name: "datetime", Timestamp: 1613311200001, DataType: DateTime, Value: uint64(1613311200000)},
+			{Name: "bytes", DataType: Bytes, Value: []byte{0x00, 0xFF, 0x10}},
+			{Name: "null", DataType: Int32, IsNull: true},
+			{Alias: 5, DataType: Int16, Value: int64(7)},
+		},
+	}
+
+	data, err := payload.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+	decoded, err := Unmarshal(data)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+	if decoded.Timestamp != payload.Timestamp {
+		t.Errorf("Timestamp is %d, expected %d", decoded.Timestamp, payload.Timestamp)
+	}
+	if decoded.Seq == nil || *decoded.Seq != seq {
+		t.Errorf("Seq is %v, expected %d", decoded.Seq, seq)
+	}
+	if len(decoded.Metrics) != len(payload.Metrics) {
+		t.Fatalf("Decoded %d metrics, expected %d", len(decoded.Metrics), len(payload.Metrics))
+	}
+	for i, m := range payload.Metrics {
+		if !reflect.DeepEqual(decoded.Metrics[i], m) {
+			t.Errorf("Metric %d decoded as %+v, expected %+v", i, decoded.Metrics[i], m)
+		}
+	}
+}
+
+func TestPayloadWithoutSeq(t *testing.T) {
+	payload := &Payload{Metrics: []*Metric{{Name: "bdSeq", DataType: UInt64, Value: uint64(0)}}}
+
+	data, err := payload.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+	decoded, err := Unmarshal(data)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+	if decoded.Seq != nil {
+		t.Errorf("Seq is %d, expected none", *decoded.Seq)
+	}
+	if !reflect.DeepEqual(decoded, payload) {
+		t.Errorf("Payload decoded as %+v, expected %+v", decoded, payload)
+	}
+}
+
+func TestNegativeIntegers(t *testing.T) {
+	tests := []struct {
+		data_type DataType
+		value     int64
+	}{
+		{Int8, -1},
+		{Int8, -128},
+		{Int8, 127},
+		{Int16, -1},
+		{Int16, -32768},
+		{Int16, 32767},
+		{Int32, -1},
+		{Int32, math.MinInt32},
+		{Int32, math.MaxInt32},
+		{Int64, -1},
+	}
+	for _, test := range tests {
+		payload := &Payload{Metrics: []*Metric{{Name: "v", DataType: test.data_type, Value: test.value}}}
+		data, err := payload.Marshal()
+		if err != nil {
+			t.Errorf("Marshal of %d (type %d) failed: %s", test.value, test.data_type, err)
+			continue
+		}
+		decoded, err := Unmarshal(data)
+		if err != nil {
+			t.Errorf("Unmarshal of %d (type %d) failed: %s", test.value, test.data_type, err)
+			continue
+		}
+		if v := decoded.Metrics[0].Value; v != test.value {
+			t.Errorf("Value %d (type %d) decoded as %v", test.value, test.data_type, v)
+		}
+	}
+
+	// Negative 8, 16 and 32 bit integers are sent as 32 bit two's complement
+	// in the uint32 int_value field (10), as a 5 byte varint.
+	metric := &Metric{DataType: Int8, Value: int64(-1)}
+	data, err := metric.marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+	expected := []byte{0x20, byte(Int8), 0x50, 0xFF, 0xFF, 0xFF, 0xFF, 0x0F}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Int8 -1 encoded as % x, expected % x", data, expected)
+	}
+
+	// Some encoders do not sign extend narrow integers.
+	for _, test := range []struct {
+		data_type DataType
+		wire      []byte
+		value     int64
+	}{
+		{Int8, []byte{0xFF, 0x01}, -1},
+		{Int8, []byte{0x80, 0x01}, -128},
+		{Int16, []byte{0xFF, 0xFF, 0x03}, -1},
+		{Int16, []byte{0x80, 0x80, 0x02}, -32768},
+	} {
+		data := append([]byte{0x12, byte(3 + len(test.wire)), 0x20, byte(test.data_type), 0x50}, test.wire...)
+		decoded, err := Unmarshal(data)
+		if err != nil {
+			t.Errorf("Unmarshal of % x failed: %s", data, err)
+			continue
+		}
+		if v := decoded.Metrics[0].Value; v != test.value {
+			t.Errorf("Type %d value % x decoded as %v, expected %d", test.data_type, test.wire, v, test.value)
+		}
+	}
+}
+
+func TestMarshalInvalidValue(t *testing.T) {
+	for _, m := range []*Metric{
+		{Name: "a", DataType: Int32, Value: uint64(1)},
+		{Name: "b", DataType: UInt32, Value: int64(1)},
+		{Name: "c", DataType: Float, Value: float64(1)},
+		{Name: "d", DataType: String, Value: []byte("x")},
+		{Name: "e", DataType: Unknown, Value: int64(1)},
+	} {
+		if _, err := (&Payload{Metrics: []*Metric{m}}).Marshal(); err == nil {
+			t.Errorf("Marshal of metric %s with %T value for type %d succeeded, expected an error", m.Name, m.Value, m.DataType)
+		}
+	}
+}
+
+func TestUnmarshalTruncated(t *testing.T) {
+	seq := uint64(1)
+	data, err := (&Payload{Timestamp: 1, Seq: &seq, Metrics: []*Metric{{Name: "temperature", DataType: Double, Value: 21.5}}}).Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+	// The metric is encoded between the 2 bytes of the timestamp and the 2
+	// bytes of the sequence number, so cutting the payload anywhere inside it
+	// or inside one of the other fields must fail.
+	for n := 1; n < len(data); n++ {
+		if n == 2 || n == len(data)-2 {
+			continue
+		}
+		if _, err := Unmarshal(data[:n]); err == nil {
+			t.Errorf("Unmarshal of the first %d of %d bytes succeeded, expected an error", n, len(data))
+		}
+	}
+}
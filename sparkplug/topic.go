@@ -0,0 +1,57 @@
+package sparkplug
+
+import (
+	"fmt"
+	"strings"
+)
+
+const NAMESPACE = "spBv1.0"
+
+// Message types
+const (
+	NBIRTH = "NBIRTH"
+	NDEATH = "NDEATH"
+	DBIRTH = "DBIRTH"
+	DDEATH = "DDEATH"
+	NDATA  = "NDATA"
+	DDATA  = "DDATA"
+	NCMD   = "NCMD"
+	DCMD   = "DCMD"
+)
+
+// Topic is a Sparkplug B topic: spBv1.0/<group>/<type>/<edge node>[/<device>]
+type Topic struct {
+	Group       string
+	MessageType string
+	EdgeNode    string
+	Device      string
+}
+
+func (t *Topic) String() string {
+	s := NAMESPACE + "/" + t.Group + "/" + t.MessageType + "/" + t.EdgeNode
+	if t.Device != "" {
+		s += "/" + t.Device
+	}
+	return s
+}
+
+// ParseTopic parses a Sparkplug B topic.
+func ParseTopic(s string) (*Topic, error) {
+	parts := strings.Split(s, "/")
+	if (len(parts) != 4 && len(parts) != 5) || parts[0] != NAMESPACE {
+		return nil, fmt.Errorf("'%s' is not a Sparkplug B topic", s)
+	}
+	t := &Topic{Group: parts[1], MessageType: parts[2], EdgeNode: parts[3]}
+	if len(parts) == 5 {
+		t.Device = parts[4]
+	}
+	return t, nil
+}
+
+// ValidateId checks that s can be used as a group, edge node or device id.
+func ValidateId(s string) error {
+	if s == "" || strings.ContainsAny(s, "/+#") {
+		return fmt.Errorf("Sparkplug id '%s' must not be empty nor contain '/', '+' or '#'", s)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+// Subscribe to the server event stream at /api/v1/events.
+//
+// handlers maps event names (channel_update, node_update, power_status, job)
+// to callbacks receiving the decoded JSON data of each event.
+// If the browser does not support EventSource, fallback is called every
+// interval milliseconds instead.
+function subscribe_events(handlers, fallback, interval) {
+    if (typeof window.EventSource === 'undefined') {
+        if (fallback) {
+            return setInterval(fallback, interval);
+        }
+        return false;
+    }
+
+    var names = Object.keys(handlers);
+    var source = new EventSource("/api/v1/events?events=" + names.join(","));
+    names.forEach(function(name) {
+        source.addEventListener(name, function(event) {
+            handlers[name](JSON.parse(event.data));
+        });
+    });
+    if (fallback) {
+        // Refresh the whole page state after each reconnection, since events
+        // may have been lost while the stream was down.
+        source.addEventListener("open", fallback);
+    }
+    return source;
+}
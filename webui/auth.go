@@ -0,0 +1,153 @@
+package webui
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/omzlo/nocanc/cmd/config"
+	"github.com/omzlo/nocanc/helper"
+	"net/http"
+	"strings"
+)
+
+type access_level int
+
+const (
+	ACCESS_NONE access_level = iota
+	ACCESS_READ_ONLY
+	ACCESS_OPERATOR
+)
+
+func role_access_level(role config.WebuiRole) access_level {
+	switch role {
+	case config.WebuiRoleReadOnly:
+		return ACCESS_READ_ONLY
+	case config.WebuiRoleOperator:
+		return ACCESS_OPERATOR
+	}
+	return ACCESS_NONE
+}
+
+// required_access_level returns the access level needed to perform req:
+// requests that do not modify anything only require read-only access.
+func required_access_level(req *http.Request) access_level {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return ACCESS_READ_ONLY
+	}
+	return ACCESS_OPERATOR
+}
+
+// Authenticator checks the credentials of HTTP requests, provided either
+// through basic authentication or as a bearer token, against the users
+// defined in the webui configuration.
+type Authenticator struct {
+	users     []*config.WebuiUser
+	anonymous access_level
+	basic     bool
+	bearer    bool
+}
+
+func NewAuthenticator(conf *config.WebuiConfiguration) (*Authenticator, error) {
+	auth := &Authenticator{}
+
+	names := make(map[string]bool)
+	for i, user := range conf.Users {
+		if user.Password == "" && user.Token == "" {
+			return nil, fmt.Errorf("Webui user %d must have either a password or a token", i+1)
+		}
+		if user.Password != "" {
+			if user.Name == "" {
+				return nil, fmt.Errorf("Webui user %d has a password but no name", i+1)
+			}
+			auth.basic = true
+		}
+		if user.Token != "" {
+			auth.bearer = true
+		}
+		if user.Name != "" {
+			if names[user.Name] {
+				return nil, fmt.Errorf("Webui user '%s' is defined more than once", user.Name)
+			}
+			names[user.Name] = true
+		}
+		if user.Role == "" {
+			user.Role = config.WebuiRoleReadOnly
+		}
+		auth.users = append(auth.users, user)
+	}
+
+	switch {
+	case conf.AnonymousRole != "":
+		auth.anonymous = role_access_level(conf.AnonymousRole)
+	case len(auth.users) == 0:
+		auth.anonymous = ACCESS_OPERATOR
+	default:
+		auth.anonymous = ACCESS_NONE
+	}
+	return auth, nil
+}
+
+func secure_compare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func (auth *Authenticator) lookup(req *http.Request) (*config.WebuiUser, bool) {
+	if name, password, ok := req.BasicAuth(); ok {
+		for _, user := range auth.users {
+			if user.Password != "" && secure_compare(user.Name, name) && secure_compare(user.Password, password) {
+				return user, true
+			}
+		}
+		return nil, true
+	}
+
+	header := req.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		token := strings.TrimSpace(header[7:])
+		for _, user := range auth.users {
+			if user.Token != "" && secure_compare(user.Token, token) {
+				return user, true
+			}
+		}
+		return nil, true
+	}
+	return nil, false
+}
+
+// Authorize checks that req carries credentials granting the access level
+// required by its method. It returns the name of the authenticated user, or
+// "-" for anonymous requests.
+func (auth *Authenticator) Authorize(req *http.Request) (string, *helper.ExtendedError) {
+	required := required_access_level(req)
+
+	user, has_credentials := auth.lookup(req)
+	if !has_credentials {
+		if auth.anonymous >= required {
+			return "-", nil
+		}
+		return "-", helper.Unauthorized("Authentication required")
+	}
+	if user == nil {
+		return "-", helper.Unauthorized("Invalid credentials")
+	}
+
+	name := user.Name
+	if name == "" {
+		name = "token"
+	}
+	if role_access_level(user.Role) < required {
+		return name, helper.Forbidden(fmt.Sprintf("User role '%s' does not allow %s requests", user.Role, req.Method))
+	}
+	return name, nil
+}
+
+// Challenge adds the WWW-Authenticate headers that tell clients which
+// authentication schemes are accepted.
+func (auth *Authenticator) Challenge(w http.ResponseWriter) {
+	if auth.basic {
+		w.Header().Add("WWW-Authenticate", `Basic realm="nocanc", charset="UTF-8"`)
+	}
+	if auth.bearer {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="nocanc"`)
+	}
+}
@@ -2,8 +2,10 @@ package webui
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/omzlo/clog"
 	"github.com/omzlo/nocanc/helper"
+	"github.com/omzlo/nocanc/history"
 	"github.com/omzlo/nocand/models/nocan"
 	"github.com/omzlo/nocand/socket"
 	"io/ioutil"
@@ -12,31 +14,31 @@ import (
 	"time"
 )
 
-var ChannelList *socket.ChannelListEvent
-
 func on_channel_list_event(conn *socket.EventConn, e socket.Eventer) error {
-	ChannelList = e.(*socket.ChannelListEvent)
+	State.SetChannelList(e.(*socket.ChannelListEvent))
+	Metrics.HandleEvent(e)
 	return nil
 }
 
 func on_channel_update_event(conn *socket.EventConn, e socket.Eventer) error {
 	cu := e.(*socket.ChannelUpdateEvent)
-	if ChannelList == nil {
-		ChannelList = socket.NewChannelListEvent()
-	}
-	for i, channel := range ChannelList.Channels {
-		if channel.ChannelId == cu.ChannelId {
-			ChannelList.Channels[i] = cu
-			return nil
+	Events.Publish(EVENT_CHANNEL_UPDATE, cu)
+	State.UpdateChannel(cu)
+	Metrics.HandleEvent(cu)
+	if History != nil && cu.Status != socket.CHANNEL_NOT_FOUND {
+		if err := History.Record(cu); err != nil {
+			clog.Warning("Failed to record update of channel '%s' in history: %s", cu.ChannelName, err)
 		}
 	}
-	ChannelList.Append(cu)
 	return nil
 }
 
 func channels_index(w http.ResponseWriter, req *http.Request, params *Parameters) {
-	JsonSend(w, req, ChannelList)
-	return
+	channels, version := State.Channels()
+	if channels == nil {
+		channels = make([]*socket.ChannelUpdateEvent, 0)
+	}
+	JsonSendWithETag(w, req, &socket.ChannelListEvent{Channels: channels}, ETag("channels", version))
 }
 
 func channels_show(w http.ResponseWriter, req *http.Request, params *Parameters) {
@@ -44,11 +46,10 @@ func channels_show(w http.ResponseWriter, req *http.Request, params *Parameters)
 	if !ok {
 		return
 	}
-	for _, channel := range ChannelList.Channels {
-		if channel.ChannelId == c {
-			JsonSend(w, req, channel)
-			return
-		}
+	channel, version := State.Channel(c)
+	if channel != nil {
+		JsonSendWithETag(w, req, channel, ETag("channels", version))
+		return
 	}
 	ErrorSend(w, req, helper.NotFound(nil))
 }
@@ -81,6 +82,55 @@ func channels_update(w http.ResponseWriter, req *http.Request, params *Parameter
 	JsonSendWithStatus(w, req, nil, http.StatusNoContent)
 }
 
+func channels_history(w http.ResponseWriter, req *http.Request, params *Parameters) {
+	c, ok := parseChannel(w, req, params)
+	if !ok {
+		return
+	}
+	if History == nil {
+		ErrorSend(w, req, helper.NotFound("Channel history is not enabled"))
+		return
+	}
+	channel, _ := State.Channel(c)
+	if channel == nil {
+		ErrorSend(w, req, helper.NotFound(fmt.Sprintf("Channel %d does not exist", c)))
+		return
+	}
+
+	now := time.Now()
+	from, to := now.Add(-24*time.Hour), now
+	var err error
+	if s := params.Value["to"]; s != "" {
+		if to, err = history.ParseTime(s, now); err != nil {
+			ErrorSend(w, req, helper.BadRequest(err))
+			return
+		}
+	}
+	if s := params.Value["from"]; s != "" {
+		if from, err = history.ParseTime(s, now); err != nil {
+			ErrorSend(w, req, helper.BadRequest(err))
+			return
+		}
+	}
+
+	updates, err := History.Query(channel.ChannelName, from, to)
+	if err != nil {
+		ErrorSend(w, req, helper.InternalServerError(err))
+		return
+	}
+	if updates == nil {
+		updates = make([]*socket.ChannelUpdateEvent, 0)
+	}
+
+	JsonSend(w, req, &struct {
+		Id      nocan.ChannelId              `json:"id"`
+		Name    string                       `json:"name"`
+		From    time.Time                    `json:"from"`
+		To      time.Time                    `json:"to"`
+		History []*socket.ChannelUpdateEvent `json:"history"`
+	}{c, channel.ChannelName, from, to, updates})
+}
+
 func parseChannel(w http.ResponseWriter, req *http.Request, params *Parameters) (nocan.ChannelId, bool) {
 	channelId, err := strconv.ParseUint(params.Value["id"], 0, 8)
 	if err != nil {
@@ -6,20 +6,17 @@ import (
 	"net/http"
 )
 
-var (
-	DeviceInfo *socket.DeviceInformationEvent = nil
-)
-
 func on_device_information_event(conn *socket.EventConn, e socket.Eventer) error {
-	DeviceInfo = e.(*socket.DeviceInformationEvent)
+	State.SetDeviceInfo(e.(*socket.DeviceInformationEvent))
 	return nil
 }
 
 func device_info_index(w http.ResponseWriter, req *http.Request, params *Parameters) {
-	if DeviceInfo == nil {
+	di, version := State.DeviceInfo()
+	if di == nil {
 		ErrorSend(w, req, helper.NotFound("No device information available"))
 		return
 	}
 
-	JsonSend(w, req, DeviceInfo)
+	JsonSendWithETag(w, req, di, ETag("device_info", version))
 }
@@ -0,0 +1,135 @@
+package webui
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocanc/helper"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_CHANNEL_UPDATE = "channel_update"
+	EVENT_NODE_UPDATE    = "node_update"
+	EVENT_POWER_STATUS   = "power_status"
+	EVENT_JOB            = "job"
+)
+
+// StreamEvent is an event pushed to the clients of /api/v1/events.
+type StreamEvent struct {
+	Name string
+	Data []byte
+}
+
+// EventBroker dispatches events received from nocand to all HTTP clients
+// listening on the event stream. Clients that do not keep up lose events
+// rather than slowing down the others.
+type EventBroker struct {
+	mutex   sync.Mutex
+	clients map[chan *StreamEvent]bool
+}
+
+func NewEventBroker() *EventBroker {
+	return &EventBroker{clients: make(map[chan *StreamEvent]bool)}
+}
+
+var Events = NewEventBroker()
+
+func (b *EventBroker) Subscribe() chan *StreamEvent {
+	ch := make(chan *StreamEvent, 64)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.clients[ch] = true
+	return ch
+}
+
+func (b *EventBroker) Unsubscribe(ch chan *StreamEvent) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.clients, ch)
+}
+
+func (b *EventBroker) Publish(name string, content interface{}) {
+	data, err := json.Marshal(content)
+	if err != nil {
+		clog.Warning("Failed to encode %s event for streaming: %s", name, err)
+		return
+	}
+	event := &StreamEvent{Name: name, Data: data}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for ch := range b.clients {
+		select {
+		case ch <- event:
+		default:
+			clog.DebugXX("Dropping %s event for slow event stream client", name)
+		}
+	}
+}
+
+// job_event_updater publishes job progress on the event stream.
+type job_event_updater struct{}
+
+func (u job_event_updater) Update(job *helper.Job) {
+	Events.Publish(EVENT_JOB, job)
+}
+
+func write_stream_event(w http.ResponseWriter, event *StreamEvent) error {
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Name, event.Data)
+	return err
+}
+
+func events_index(w http.ResponseWriter, req *http.Request, params *Parameters) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		ErrorSend(w, req, helper.InternalServerError("Streaming is not supported by this connection"))
+		return
+	}
+
+	var filter map[string]bool
+	if list, ok := params.Value["events"]; ok && list != "" {
+		filter = make(map[string]bool)
+		for _, name := range strings.Split(list, ",") {
+			filter[name] = true
+		}
+	}
+
+	ch := Events.Subscribe()
+	defer Events.Unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", refresh)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case event := <-ch:
+			if filter != nil && !filter[event.Name] {
+				continue
+			}
+			if err := write_stream_event(w, event); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			if _, err := fmt.Fprintf(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
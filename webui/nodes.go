@@ -2,6 +2,7 @@ package webui
 
 import (
 	"fmt"
+	"github.com/omzlo/clog"
 	"github.com/omzlo/nocanc/helper"
 	"github.com/omzlo/nocanc/intelhex"
 	"github.com/omzlo/nocand/models"
@@ -11,35 +12,26 @@ import (
 	"strconv"
 )
 
-var NodeList *socket.NodeListEvent
-
 func on_node_list_event(conn *socket.EventConn, e socket.Eventer) error {
-	NodeList = e.(*socket.NodeListEvent)
+	State.SetNodeList(e.(*socket.NodeListEvent))
+	Metrics.HandleEvent(e)
 	return nil
 }
 
 func on_node_update_event(conn *socket.EventConn, e socket.Eventer) error {
 	nu := e.(*socket.NodeUpdateEvent)
-	if NodeList == nil {
-		NodeList = socket.NewNodeListEvent()
-	}
-	if nu.State == models.NodeStateUnresponsive {
-		NodeList.Exclude(nu.NodeId)
-	} else {
-		for i, node := range NodeList.Nodes {
-			if node.NodeId == nu.NodeId {
-				NodeList.Nodes[i] = nu
-				return nil
-			}
-		}
-		NodeList.Append(nu)
-	}
+	Events.Publish(EVENT_NODE_UPDATE, nu)
+	State.UpdateNode(nu, nu.State == models.NodeStateUnresponsive)
+	Metrics.HandleEvent(nu)
 	return nil
 }
 
 func nodes_index(w http.ResponseWriter, req *http.Request, params *Parameters) {
-	JsonSend(w, req, NodeList)
-	return
+	nodes, version := State.Nodes()
+	if nodes == nil {
+		nodes = make([]*socket.NodeUpdateEvent, 0)
+	}
+	JsonSendWithETag(w, req, &socket.NodeListEvent{Nodes: nodes}, ETag("nodes", version))
 }
 
 func nodes_show(w http.ResponseWriter, req *http.Request, params *Parameters) {
@@ -49,16 +41,29 @@ func nodes_show(w http.ResponseWriter, req *http.Request, params *Parameters) {
 		return
 	}
 
-	for _, node := range NodeList.Nodes {
-		if node.NodeId == nocan.NodeId(nodeId) {
-			JsonSend(w, req, node)
-			return
-		}
+	node, version := State.Node(nocan.NodeId(nodeId))
+	if node != nil {
+		JsonSendWithETag(w, req, node, ETag("nodes", version))
+		return
 	}
 
 	ErrorSend(w, req, helper.NotFound(fmt.Sprintf("Node %d does not exist", nodeId)))
 }
 
+// upload_base_address returns the address where a raw binary upload is
+// loaded, which defaults to the application origin of the target. Other
+// formats carry their own addresses.
+func upload_base_address(s string, filename string) (uint32, error) {
+	if intelhex.FormatFromExtension(filename) != intelhex.FormatBinary {
+		return 0, nil
+	}
+	if s == "" {
+		return helper.ApplicationOrigin()
+	}
+	base, err := strconv.ParseUint(s, 0, 32)
+	return uint32(base), err
+}
+
 func nodes_upload(w http.ResponseWriter, req *http.Request, params *Parameters) {
 	nodeId, err := strconv.ParseUint(params.Value["id"], 0, 8)
 	if err != nil {
@@ -67,20 +72,35 @@ func nodes_upload(w http.ResponseWriter, req *http.Request, params *Parameters)
 	}
 
 	req.ParseMultipartForm(512 * 1024)
-	file, _, err := req.FormFile("firmware")
+	file, header, err := req.FormFile("firmware")
+	if err != nil {
+		ErrorSend(w, req, helper.BadRequest(err))
+		return
+	}
+	base, err := upload_base_address(req.FormValue("base_address"), header.Filename)
 	if err != nil {
+		file.Close()
 		ErrorSend(w, req, helper.BadRequest(err))
 		return
 	}
-	ihex := intelhex.New()
-	err = ihex.Load(file)
+	ihex, err := intelhex.LoadReader(file, header.Filename, base)
 	file.Close()
 	if err != nil {
-		ErrorSend(w, req, helper.BadRequest("iHex parser: "+err.Error()))
+		ErrorSend(w, req, helper.BadRequest(err))
+		return
+	}
+
+	if err := Validator.Validate(ihex, ihex.EmbeddedMetadata()); err != nil {
+		ErrorSend(w, req, helper.BadRequest(err))
 		return
 	}
 
-	job, cerr := helper.UploadFirmware(NocanClient, nocan.NodeId(nodeId), ihex, nil)
+	if digest, err := ihex.Digest(); err == nil {
+		clog.Info("Uploading %s (%d bytes, %s) to node %d", header.Filename, ihex.Size, digest, nodeId)
+	}
+
+	updater := &ledger_updater{node_id: nocan.NodeId(nodeId), file: header.Filename, firmware: ihex}
+	job, cerr := helper.UploadFirmware(NocanClient, nocan.NodeId(nodeId), ihex, updater)
 	if cerr != nil {
 		ErrorSend(w, req, cerr)
 		return
@@ -94,6 +114,55 @@ func nodes_upload(w http.ResponseWriter, req *http.Request, params *Parameters)
 	JsonSendWithStatus(w, req, retval, http.StatusCreated)
 }
 
+// ledger_updater publishes job progress like job_event_updater, and records
+// successful uploads in the firmware ledger.
+type ledger_updater struct {
+	job_event_updater
+	node_id  nocan.NodeId
+	file     string
+	firmware *intelhex.IntelHex
+}
+
+func (u *ledger_updater) Update(job *helper.Job) {
+	u.job_event_updater.Update(job)
+	if job.Status != helper.JOB_SUCCESS || Ledger == nil {
+		return
+	}
+	udid := models.NullUdid8
+	if node, _ := State.Node(u.node_id); node != nil {
+		udid = node.Udid
+	}
+	go Ledger.RecordUpload(helper.NewClient(), u.node_id, udid, u.file, u.firmware, u.firmware.EmbeddedMetadata())
+}
+
+func nodes_firmware(w http.ResponseWriter, req *http.Request, params *Parameters) {
+	nodeId, err := strconv.ParseUint(params.Value["id"], 0, 8)
+	if err != nil {
+		ErrorSend(w, req, helper.BadRequest(err))
+		return
+	}
+	if Ledger == nil {
+		ErrorSend(w, req, helper.NotFound("The firmware ledger is not enabled"))
+		return
+	}
+
+	node, _ := State.Node(nocan.NodeId(nodeId))
+	if node == nil {
+		ErrorSend(w, req, helper.NotFound(fmt.Sprintf("Node %d does not exist", nodeId)))
+		return
+	}
+	entry, err := Ledger.Find(node.Udid)
+	if err != nil {
+		ErrorSend(w, req, helper.InternalServerError(err))
+		return
+	}
+	if entry == nil {
+		ErrorSend(w, req, helper.NotFound(fmt.Sprintf("No firmware upload recorded for node %d (%s)", nodeId, node.Udid)))
+		return
+	}
+	JsonSend(w, req, entry)
+}
+
 func nodes_reboot(w http.ResponseWriter, req *http.Request, params *Parameters) {
 	nodeId, err := strconv.ParseUint(params.Value["id"], 0, 8)
 	if err != nil {
@@ -6,17 +6,19 @@ import (
 	"net/http"
 )
 
-var PowerStatus *socket.BusPowerStatusUpdateEvent
-
 func on_power_status_update_event(conn *socket.EventConn, e socket.Eventer) error {
-	PowerStatus = e.(*socket.BusPowerStatusUpdateEvent)
+	ps := e.(*socket.BusPowerStatusUpdateEvent)
+	State.SetPowerStatus(ps)
+	Metrics.HandleEvent(ps)
+	Events.Publish(EVENT_POWER_STATUS, ps.Status)
 	return nil
 }
 
 func power_status_index(w http.ResponseWriter, req *http.Request, params *Parameters) {
-	if PowerStatus == nil {
+	ps, version := State.PowerStatus()
+	if ps == nil {
 		ErrorSend(w, req, helper.NotFound(nil))
 		return
 	}
-	JsonSend(w, req, PowerStatus.Status)
+	JsonSendWithETag(w, req, ps.Status, ETag("power_status", version))
 }
@@ -0,0 +1,201 @@
+package webui
+
+import (
+	"fmt"
+	"github.com/omzlo/nocand/models/nocan"
+	"github.com/omzlo/nocand/socket"
+	"sync"
+	"time"
+)
+
+// StateStore holds the latest state of the NoCAN network, as reported by
+// nocand. It is updated by NocanClient event callbacks and queried by HTTP
+// handlers.
+//
+// Lists are copy-on-write: updates replace them instead of modifying them,
+// so readers can safely range over the slices they obtain. Each part of the
+// state carries a version number, taken from a counter that is incremented
+// on every update.
+type StateStore struct {
+	mutex                     sync.RWMutex
+	version                   uint64
+	nodes                     []*socket.NodeUpdateEvent
+	nodes_version             uint64
+	channels                  []*socket.ChannelUpdateEvent
+	channels_version          uint64
+	power_status              *socket.BusPowerStatusUpdateEvent
+	power_status_version      uint64
+	device_info               *socket.DeviceInformationEvent
+	device_info_version       uint64
+	system_properties         *socket.SystemPropertiesEvent
+	system_properties_version uint64
+}
+
+func NewStateStore() *StateStore {
+	return &StateStore{}
+}
+
+var State = NewStateStore()
+
+func (s *StateStore) next_version() uint64 {
+	s.version++
+	return s.version
+}
+
+// Version returns the version of the most recent update of the store.
+func (s *StateStore) Version() uint64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.version
+}
+
+func (s *StateStore) SetNodeList(nl *socket.NodeListEvent) {
+	nodes := make([]*socket.NodeUpdateEvent, len(nl.Nodes))
+	copy(nodes, nl.Nodes)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nodes = nodes
+	s.nodes_version = s.next_version()
+}
+
+// UpdateNode adds or replaces a node in the node list, or removes it if
+// remove is true.
+func (s *StateStore) UpdateNode(nu *socket.NodeUpdateEvent, remove bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	nodes := make([]*socket.NodeUpdateEvent, 0, len(s.nodes)+1)
+	found := false
+	for _, node := range s.nodes {
+		if node.NodeId == nu.NodeId {
+			found = true
+			if remove {
+				continue
+			}
+			node = nu
+		}
+		nodes = append(nodes, node)
+	}
+	if !found {
+		if remove {
+			return
+		}
+		nodes = append(nodes, nu)
+	}
+	s.nodes = nodes
+	s.nodes_version = s.next_version()
+}
+
+func (s *StateStore) Nodes() ([]*socket.NodeUpdateEvent, uint64) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.nodes, s.nodes_version
+}
+
+func (s *StateStore) Node(id nocan.NodeId) (*socket.NodeUpdateEvent, uint64) {
+	nodes, version := s.Nodes()
+	for _, node := range nodes {
+		if node.NodeId == id {
+			return node, version
+		}
+	}
+	return nil, version
+}
+
+func (s *StateStore) SetChannelList(cl *socket.ChannelListEvent) {
+	channels := make([]*socket.ChannelUpdateEvent, len(cl.Channels))
+	copy(channels, cl.Channels)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.channels = channels
+	s.channels_version = s.next_version()
+}
+
+// UpdateChannel adds or replaces a channel in the channel list.
+func (s *StateStore) UpdateChannel(cu *socket.ChannelUpdateEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	channels := make([]*socket.ChannelUpdateEvent, 0, len(s.channels)+1)
+	found := false
+	for _, channel := range s.channels {
+		if channel.ChannelId == cu.ChannelId {
+			found = true
+			channel = cu
+		}
+		channels = append(channels, channel)
+	}
+	if !found {
+		channels = append(channels, cu)
+	}
+	s.channels = channels
+	s.channels_version = s.next_version()
+}
+
+func (s *StateStore) Channels() ([]*socket.ChannelUpdateEvent, uint64) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.channels, s.channels_version
+}
+
+func (s *StateStore) Channel(id nocan.ChannelId) (*socket.ChannelUpdateEvent, uint64) {
+	channels, version := s.Channels()
+	for _, channel := range channels {
+		if channel.ChannelId == id {
+			return channel, version
+		}
+	}
+	return nil, version
+}
+
+func (s *StateStore) SetPowerStatus(ps *socket.BusPowerStatusUpdateEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.power_status = ps
+	s.power_status_version = s.next_version()
+}
+
+func (s *StateStore) PowerStatus() (*socket.BusPowerStatusUpdateEvent, uint64) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.power_status, s.power_status_version
+}
+
+func (s *StateStore) SetDeviceInfo(di *socket.DeviceInformationEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.device_info = di
+	s.device_info_version = s.next_version()
+}
+
+func (s *StateStore) DeviceInfo() (*socket.DeviceInformationEvent, uint64) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.device_info, s.device_info_version
+}
+
+func (s *StateStore) SetSystemProperties(sp *socket.SystemPropertiesEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.system_properties = sp
+	s.system_properties_version = s.next_version()
+}
+
+func (s *StateStore) SystemProperties() (*socket.SystemPropertiesEvent, uint64) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.system_properties, s.system_properties_version
+}
+
+// state_epoch identifies this process, since versions restart from 0 each
+// time nocanc is started.
+var state_epoch = time.Now().UnixNano()
+
+// ETag returns the entity tag identifying the given version of a part of the
+// state, which includes the start time of the process so that tags issued
+// before a restart never match.
+func ETag(part string, version uint64) string {
+	return fmt.Sprintf(`"%s-%x-%d"`, part, state_epoch, version)
+}
@@ -6,18 +6,17 @@ import (
 	"net/http"
 )
 
-var SystemProperties *socket.SystemPropertiesEvent
-
 func on_system_properties_update_event(conn *socket.EventConn, e socket.Eventer) error {
-	SystemProperties = e.(*socket.SystemPropertiesEvent)
+	State.SetSystemProperties(e.(*socket.SystemPropertiesEvent))
 	return nil
 }
 
 func system_properties_index(w http.ResponseWriter, req *http.Request, params *Parameters) {
-	if SystemProperties == nil {
+	sp, version := State.SystemProperties()
+	if sp == nil {
 		ErrorSend(w, req, helper.NotFound(nil))
 		return
 	}
 
-	JsonSend(w, req, SystemProperties)
+	JsonSendWithETag(w, req, sp, ETag("system_properties", version))
 }
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"github.com/gobuffalo/packr/v2"
 	"github.com/omzlo/clog"
+	"github.com/omzlo/nocanc/cmd/config"
 	"github.com/omzlo/nocanc/helper"
+	"github.com/omzlo/nocanc/history"
+	"github.com/omzlo/nocanc/metrics"
 	"github.com/omzlo/nocand/socket"
 	"html/template"
 	"net/http"
@@ -14,6 +17,18 @@ import (
 
 var NocanClient *socket.EventConn
 
+// History, if not nil, records all channel updates.
+var History *history.Store
+
+// Ledger, if not nil, records the firmware uploaded to each node.
+var Ledger *helper.FirmwareLedger
+
+// Validator, if not nil, checks uploaded firmware against a target profile.
+var Validator *helper.TargetValidator
+
+// Metrics collects the metrics served on /metrics.
+var Metrics *metrics.Collector
+
 const API_PREFIX string = "/api/v1"
 
 var (
@@ -112,11 +127,28 @@ func (handler *TemplateHandler) ServeHTTP(w http.ResponseWriter, req *http.Reque
 	}
 }
 
-func Run(addr string, refresh_rate uint) error {
+func Run(conf *config.WebuiConfiguration, store *history.Store, ledger *helper.FirmwareLedger, validator *helper.TargetValidator, collector *metrics.Collector) error {
 	if mux != nil {
 		return fmt.Errorf("Webui is already running")
 	}
 
+	History = store
+	Ledger = ledger
+	Validator = validator
+	Metrics = collector
+
+	if (conf.TLSCertFile == "") != (conf.TLSKeyFile == "") {
+		return fmt.Errorf("Webui TLS requires both a certificate and a key file")
+	}
+
+	auth, err := NewAuthenticator(conf)
+	if err != nil {
+		return err
+	}
+	if len(conf.Users) > 0 && conf.TLSCertFile == "" {
+		clog.Warning("Webui users are defined but TLS is not enabled: credentials will be sent in clear text")
+	}
+
 	NocanClient = helper.NewNocanClient()
 
 	NocanClient.OnEvent(socket.ChannelListEventId, on_channel_list_event)
@@ -128,6 +160,7 @@ func Run(addr string, refresh_rate uint) error {
 	NocanClient.OnEvent(socket.SystemPropertiesEventId, on_system_properties_update_event)
 
 	NocanClient.OnConnect(func(conn *socket.EventConn) error {
+		Metrics.OnConnect()
 		if err := conn.Send(socket.NewChannelListRequestEvent()); err != nil {
 			return err
 		}
@@ -152,6 +185,7 @@ func Run(addr string, refresh_rate uint) error {
 	defer NocanClient.Terminate()
 
 	mux = NewServeMux()
+	mux.Auth = auth
 
 	static_files = packr.New("static", "./assets/static")
 	template_files = packr.New("templates", "./assets/templates")
@@ -161,28 +195,36 @@ func Run(addr string, refresh_rate uint) error {
 		panic(err)
 	}
 
-	refresh = refresh_rate
+	refresh = conf.Refresh
 
 	mux.HandleFunc("GET /api/v1/nodes", nodes_index)
 	mux.HandleFunc("GET /api/v1/nodes/:id", nodes_show)
+	mux.HandleFunc("GET /api/v1/nodes/:id/firmware", nodes_firmware)
 	mux.HandleFunc("POST /api/v1/nodes/:id/upload", nodes_upload)
 	mux.HandleFunc("PUT /api/v1/nodes/:id/reboot", nodes_reboot)
 	mux.HandleFunc("GET /api/v1/channels", channels_index)
 	mux.HandleFunc("GET /api/v1/channels/:id", channels_show)
 	mux.HandleFunc("PUT /api/v1/channels/:id", channels_update)
+	mux.HandleFunc("GET /api/v1/channels/:id/history", channels_history)
 	mux.HandleFunc("GET /api/v1/power_status", power_status_index)
 	mux.HandleFunc("GET /api/v1/device_info", device_info_index)
 	mux.HandleFunc("GET /api/v1/system_properties", system_properties_index)
 	mux.HandleFunc("GET /api/v1/jobs/:id", jobs_show)
 	mux.HandleFunc("GET /api/v1/news", news_index)
+	mux.HandleFunc("GET /api/v1/events", events_index)
 	mux.HandleFunc("GET /api/v1/*", not_found)
 	mux.Handle("GET /", coll.Handle("index"))
 	mux.Handle("GET /channels/:id", coll.Handle("channels_show"))
 	mux.Handle("GET /nodes/:id", coll.Handle("nodes_show"))
 	mux.Handle("GET /system", coll.Handle("system_show"))
+	mux.Handle("GET /metrics", SimpleHandler(Metrics))
 	mux.Handle("GET /static/*", SimpleHandler(http.StripPrefix("/static", http.FileServer(static_files))))
 	mux.HandleFunc("GET /*", default_handler)
 
-	clog.Info("Connect to the Webui at %s (refresh=%d)", addr, refresh)
-	return http.ListenAndServe(addr, mux)
+	if conf.TLSCertFile != "" {
+		clog.Info("Connect to the Webui at https://%s (refresh=%d)", conf.WebServer, refresh)
+		return http.ListenAndServeTLS(conf.WebServer, conf.TLSCertFile, conf.TLSKeyFile, mux)
+	}
+	clog.Info("Connect to the Webui at %s (refresh=%d)", conf.WebServer, refresh)
+	return http.ListenAndServe(conf.WebServer, mux)
 }
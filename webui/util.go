@@ -36,6 +36,20 @@ func JsonSend(w http.ResponseWriter, req *http.Request, content interface{}) {
 	JsonSendWithStatus(w, req, content, 200)
 }
 
+// JsonSendWithETag sends content tagged with etag, or an empty 304 response
+// if the client request shows that it already holds that version.
+func JsonSendWithETag(w http.ResponseWriter, req *http.Request, content interface{}, etag string) {
+	w.Header().Set("ETag", etag)
+	for _, match := range strings.Split(req.Header.Get("If-None-Match"), ",") {
+		match = strings.TrimSpace(match)
+		if match == etag || match == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	JsonSend(w, req, content)
+}
+
 func ErrorSend(w http.ResponseWriter, req *http.Request, e *helper.ExtendedError) {
 	clog.Warning("Request to %s returns %d %s: %s", req.URL.Path, e.Status, e.ErrorMessage, e.Information)
 	JsonSendWithStatus(w, req, e, e.Status)
@@ -89,6 +103,8 @@ func (g GoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, params *Par
 
 type ServeMux struct {
 	Patterns []HandlerDescriptor
+	// Auth, if not nil, restricts access to the handlers of the mux.
+	Auth *Authenticator
 }
 
 func NewServeMux() *ServeMux {
@@ -190,7 +206,27 @@ func (l *LogResponseWriter) WriteHeader(statusCode int) {
 	l.Origin.WriteHeader(statusCode)
 }
 
+func (l *LogResponseWriter) Flush() {
+	if flusher, ok := l.Origin.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 func (mux *ServeMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user := "-"
+	if mux.Auth != nil {
+		var err *helper.ExtendedError
+
+		user, err = mux.Auth.Authorize(r)
+		if err != nil {
+			if err.Status == http.StatusUnauthorized {
+				mux.Auth.Challenge(w)
+			}
+			ErrorSend(w, r, err)
+			return
+		}
+	}
+
 	handler, _, params := mux.Handler(r)
 	if handler == nil {
 		ErrorSend(w, r, helper.NotFound("No handler"))
@@ -198,6 +234,6 @@ func (mux *ServeMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	logger := NewLogResponseWriter(w)
 	handler.ServeHTTP(logger, r, params)
-	clog.Info("%s \"%s %s\" [%s] %d %d", r.RemoteAddr, r.Method, r.URL.Path, params, logger.StatusCode, logger.TotalBytes)
+	clog.Info("%s %s \"%s %s\" [%s] %d %d", r.RemoteAddr, user, r.Method, r.URL.Path, params, logger.StatusCode, logger.TotalBytes)
 
 }